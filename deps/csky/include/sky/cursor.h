@@ -48,10 +48,13 @@ struct sky_cursor {
     void *nextptr;
     void *endptr;
     void *ptr;
+    void *stateptr;
     bool eof;
     bool in_session;
     uint32_t last_timestamp;
     uint32_t session_idle_in_sec;
+    int64_t min_ts;
+    int64_t max_ts;
 
     sky_timestamp_descriptor timestamp_descriptor;
     sky_property_descriptor *property_descriptors;
@@ -114,6 +117,8 @@ void sky_cursor_set_ptr(sky_cursor *cursor, void *ptr, size_t sz);
 
 void sky_cursor_next_event(sky_cursor *cursor);
 
+bool sky_cursor_read_state(sky_cursor *cursor, void *target);
+
 bool sky_lua_cursor_next_event(sky_cursor *cursor);
 
 bool sky_cursor_eof(sky_cursor *cursor);
@@ -122,6 +127,8 @@ bool sky_cursor_eos(sky_cursor *cursor);
 
 void sky_cursor_set_session_idle(sky_cursor *cursor, uint32_t seconds);
 
+void sky_cursor_set_time_range(sky_cursor *cursor, int64_t min_ts, int64_t max_ts);
+
 void sky_cursor_next_session(sky_cursor *cursor);
 
 bool sky_lua_cursor_next_session(sky_cursor *cursor);
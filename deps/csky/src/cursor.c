@@ -36,6 +36,14 @@
 //
 //==============================================================================
 
+//--------------------------------------
+// Event Iteration
+//--------------------------------------
+
+void sky_cursor_read_event(sky_cursor *cursor, int64_t *ts);
+
+void sky_cursor_read_map(sky_cursor *cursor, void *target, void **ptr);
+
 //--------------------------------------
 // Setters
 //--------------------------------------
@@ -89,6 +97,8 @@ sky_cursor *sky_cursor_new(int32_t min_property_id,
     cursor->property_descriptors = calloc(property_count, sizeof(sky_property_descriptor));
     cursor->property_count = property_count;
     cursor->property_zero_descriptor = NULL;
+    cursor->min_ts = INT64_MIN;
+    cursor->max_ts = INT64_MAX;
     
     // Initialize all property descriptors to noop.
     int32_t i;
@@ -213,6 +223,7 @@ void sky_cursor_set_ptr(sky_cursor *cursor, void *ptr, size_t sz)
     cursor->nextptr    = ptr;
     cursor->endptr     = ptr + sz;
     cursor->ptr        = NULL;
+    cursor->stateptr   = NULL;
     cursor->in_session = true;
     cursor->last_timestamp      = 0;
     cursor->session_idle_in_sec = 0;
@@ -224,12 +235,30 @@ void sky_cursor_set_ptr(sky_cursor *cursor, void *ptr, size_t sz)
     
     // The first item is the current state so skip it.
     if(cursor->startptr != NULL && minipack_is_raw(cursor->startptr)) {
+        cursor->stateptr = cursor->startptr;
         cursor->startptr += minipack_sizeof_elem_and_data(cursor->startptr);
         cursor->nextptr = cursor->startptr;
     }
 }
 
 void sky_cursor_next_event(sky_cursor *cursor)
+{
+    // Events before the time range are still read so that permanent
+    // properties are accumulated but they are hidden from the caller and do
+    // not count toward the session.
+    while(true) {
+        int64_t ts = 0;
+        sky_cursor_read_event(cursor, &ts);
+        if(cursor->eof || !cursor->in_session || ts >= cursor->min_ts) {
+            break;
+        }
+        cursor->session_event_index--;
+        cursor->last_timestamp = 0;
+    }
+}
+
+// Reads the next event into the data object and returns its timestamp.
+void sky_cursor_read_event(sky_cursor *cursor, int64_t *ret)
 {
     // Ignore any calls when the cursor is out of session or EOF.
     if(cursor->eof || !cursor->in_session) {
@@ -264,6 +293,18 @@ void sky_cursor_next_event(sky_cursor *cursor)
         if(sz == 0) badcursordata("timestamp", ptr);
         uint32_t timestamp = sky_timestamp_to_seconds(ts);
         ptr += sz;
+        *ret = ts;
+
+        // Events are ordered so stop once the end of the time range is hit.
+        if(ts >= cursor->max_ts) {
+            cursor->eof        = true;
+            cursor->in_session = false;
+            cursor->ptr        = NULL;
+            cursor->startptr   = NULL;
+            cursor->nextptr    = NULL;
+            cursor->endptr     = NULL;
+            return;
+        }
 
         // Check for session boundry. This only applies if this is not the
         // first event in the session and a session idle time has been set.
@@ -294,37 +335,77 @@ void sky_cursor_next_event(sky_cursor *cursor)
             }
 
             // Read msgpack map!
-            uint32_t count = minipack_unpack_map(ptr, &sz);
-            if(sz == 0) {
-              minipack_unpack_nil(ptr, &sz);
-              if(sz == 0) {
-                badcursordata("datamap", ptr);
-              }
-            }
-            ptr += sz;
-
-            // Loop over key/value pairs.
-            uint32_t i;
-            for(i=0; i<count; i++) {
-                // Read property id (key).
-                int64_t property_id = minipack_unpack_int(ptr, &sz);
-                if(sz == 0) badcursordata("key", ptr);
-                ptr += sz;
-
-                // Read property value and set it on the data object.
-                sky_cursor_set_value(cursor, cursor->data, property_id, ptr, &sz);
-                if(sz == 0) {
-                  debug("[invalid read, skipping]");
-                  sz = minipack_sizeof_elem_and_data(ptr);
-                }
-                ptr += sz;
-            }
+            sky_cursor_read_map(cursor, cursor->data, &ptr);
+            if(cursor->eof) return;
 
             cursor->nextptr = ptr;
         }
     }
 }
 
+// Reads a map of property ids and values into a data object and moves the
+// pointer past the map.
+void sky_cursor_read_map(sky_cursor *cursor, void *target, void **ptr)
+{
+    size_t sz;
+    uint32_t count = minipack_unpack_map(*ptr, &sz);
+    if(sz == 0) {
+      minipack_unpack_nil(*ptr, &sz);
+      if(sz == 0) {
+        badcursordata("datamap", *ptr);
+      }
+    }
+    *ptr += sz;
+
+    // Loop over key/value pairs.
+    uint32_t i;
+    for(i=0; i<count; i++) {
+        // Read property id (key).
+        int64_t property_id = minipack_unpack_int(*ptr, &sz);
+        if(sz == 0) badcursordata("key", *ptr);
+        *ptr += sz;
+
+        // Read property value and set it on the data object.
+        sky_cursor_set_value(cursor, target, property_id, *ptr, &sz);
+        if(sz == 0) {
+          debug("[invalid read, skipping]");
+          sz = minipack_sizeof_elem_and_data(*ptr);
+        }
+        *ptr += sz;
+    }
+}
+
+// Reads the current state of the object into a data object. The state only
+// contains permanent properties. Returns false if the object has no state.
+bool sky_cursor_read_state(sky_cursor *cursor, void *target)
+{
+    memset(target, 0, cursor->data_sz);
+    if(cursor->stateptr == NULL) {
+        return false;
+    }
+
+    // The state is a [timestamp, data] array wrapped in a raw value.
+    size_t sz;
+    void *ptr = cursor->stateptr;
+    uint32_t length = minipack_unpack_raw(ptr, &sz);
+    if(sz == 0 || length == 0) return false;
+    ptr += sz;
+    minipack_unpack_array(ptr, &sz);
+    if(sz == 0) return false;
+    ptr += sz;
+    minipack_unpack_int(ptr, &sz);
+    if(sz == 0) return false;
+    ptr += sz;
+
+    bool eof = cursor->eof;
+    sky_cursor_read_map(cursor, target, &ptr);
+    if(cursor->eof && !eof) {
+        cursor->eof = false;
+        return false;
+    }
+    return true;
+}
+
 bool sky_lua_cursor_next_event(sky_cursor *cursor)
 {
     sky_cursor_next_event(cursor);
@@ -350,6 +431,12 @@ void sky_cursor_set_session_idle(sky_cursor *cursor, uint32_t seconds)
     cursor->in_session = (seconds > 0 ? false : !cursor->eof);
 }
 
+void sky_cursor_set_time_range(sky_cursor *cursor, int64_t min_ts, int64_t max_ts)
+{
+    cursor->min_ts = min_ts;
+    cursor->max_ts = max_ts;
+}
+
 void sky_cursor_next_session(sky_cursor *cursor)
 {
     // Set a flag to allow the cursor to continue iterating unless EOF is set.
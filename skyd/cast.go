@@ -18,3 +18,27 @@ func normalize(value interface{}) interface{} {
 	}
 	return value
 }
+
+// Converts a numeric value to a float64. Returns false if the value is not a
+// number.
+func castFloat64(value interface{}) (float64, bool) {
+	switch v := normalize(value).(type) {
+	case int64:
+		return float64(v), true
+	case float64:
+		return v, true
+	}
+	return 0, false
+}
+
+// Converts a string or byte slice to a string. Returns false if the value is
+// neither.
+func castString(value interface{}) (string, bool) {
+	switch v := value.(type) {
+	case string:
+		return v, true
+	case []byte:
+		return string(v), true
+	}
+	return "", false
+}
@@ -30,9 +30,12 @@ import (
 	"fmt"
 	"github.com/jmhodges/levigo"
 	"github.com/ugorji/go-msgpack"
+	"math"
 	"regexp"
 	"sort"
+	"sync/atomic"
 	"text/template"
+	"time"
 	"unsafe"
 )
 
@@ -48,12 +51,18 @@ type ExecutionEngine struct {
 	iterator     *levigo.Iterator
 	cursor       *C.sky_cursor
 	prefix       []byte
+	startKey     []byte
+	limitKey     []byte
 	state        *C.lua_State
 	header       string
 	source       string
 	fullSource   string
 	propertyFile *PropertyFile
 	propertyRefs []*Property
+	version      int64
+	minTimestamp int64
+	sample       float64
+	cancelled    int32
 
 	cprefix    unsafe.Pointer
 	cprefix_sz C.size_t
@@ -93,6 +102,9 @@ func NewExecutionEngine(table *Table, source string) (*ExecutionEngine, error) {
 		propertyFile: propertyFile,
 		source:       source,
 		propertyRefs: propertyRefs,
+		version:      propertyFile.Version(),
+		minTimestamp: math.MinInt64,
+		sample:       1,
 	}
 
 	// Initialize the engine.
@@ -147,12 +159,45 @@ func (e *ExecutionEngine) SetIterator(iterator *levigo.Iterator) error {
 	// Attach the new iterator.
 	e.iterator = iterator
 	if e.iterator != nil {
-		e.iterator.Seek(e.prefix)
+		if e.startKey != nil {
+			e.iterator.Seek(e.startKey)
+		} else {
+			e.iterator.Seek(e.prefix)
+		}
 	}
 
 	return nil
 }
 
+// Restricts the objects read by the cursor to the keys from start up to but
+// not including limit. Nil keys leave that side of the range open. This must
+// be set before the iterator.
+func (e *ExecutionEngine) SetKeyRange(start []byte, limit []byte) {
+	e.startKey = start
+	e.limitKey = limit
+}
+
+// Restricts the events read by the cursor to a time range. Zero times leave
+// that side of the range open. Objects whose last event occurs before the
+// start of the range are skipped entirely.
+func (e *ExecutionEngine) SetTimeRange(startTime time.Time, endTime time.Time) {
+	var min, max int64 = math.MinInt64, math.MaxInt64
+	if !startTime.IsZero() {
+		min = ShiftTime(startTime)
+	}
+	if !endTime.IsZero() {
+		max = ShiftTime(endTime)
+	}
+	e.minTimestamp = min
+	C.sky_cursor_set_time_range(e.cursor, C.int64_t(min), C.int64_t(max))
+}
+
+// Restricts the objects read by the cursor to a deterministic sample. The
+// rate is the fraction of objects that are included.
+func (e *ExecutionEngine) SetSample(rate float64) {
+	e.sample = rate
+}
+
 //------------------------------------------------------------------------------
 //
 // Methods
@@ -245,12 +290,35 @@ func (e *ExecutionEngine) Destroy() {
 	if e.iterator != nil {
 		e.SetIterator(nil)
 	}
+	if e.cursor != nil {
+		C.sky_cursor_free(e.cursor)
+		e.cursor = nil
+	}
+}
+
+// Clears the iterator and query options so that the compiled engine can be
+// reused by another query.
+func (e *ExecutionEngine) reset() {
+	e.SetIterator(nil)
+	e.SetKeyRange(nil, nil)
+	e.SetTimeRange(time.Time{}, time.Time{})
+	e.SetSample(1)
+	atomic.StoreInt32(&e.cancelled, 0)
+	if e.state != nil {
+		C.lua_settop(e.state, 0)
+	}
 }
 
 //--------------------------------------
 // Execution
 //--------------------------------------
 
+// Stops an aggregation before the next object is read. This is safe to call
+// from another goroutine while the aggregation is running.
+func (e *ExecutionEngine) Cancel() {
+	atomic.StoreInt32(&e.cancelled, 1)
+}
+
 // Executes an aggregation over the iterator.
 func (e *ExecutionEngine) Aggregate() (interface{}, error) {
 	functionName := C.CString("sky_aggregate")
@@ -380,7 +448,12 @@ func extractPropertyReferences(propertyFile *PropertyFile, source string) ([]*Pr
 		return nil, err
 	}
 	for _, match := range r.FindAllStringSubmatch(source, -1) {
+		// Timestamps are always available on the event.
 		name := match[1]
+		if name == "ts" || name == "timestamp" {
+			continue
+		}
+
 		property := propertyFile.GetPropertyByName(name)
 		if property == nil {
 			return nil, fmt.Errorf("Property not found: '%v'", name)
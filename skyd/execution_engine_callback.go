@@ -8,6 +8,8 @@ import "C"
 
 import (
 	"bytes"
+	"math"
+	"sync/atomic"
 	"unsafe"
 )
 
@@ -18,23 +20,49 @@ import (
 func executionEngine_nextObject(cursor unsafe.Pointer) C.int {
 	e := (*ExecutionEngine)(((*C.sky_cursor)(cursor)).context)
 
-	// If the iterator is invalid then exit.
-	if !e.iterator.Valid() {
-		return 0
-	}
+	for {
+		// If the query has been cancelled then stop reading objects.
+		if atomic.LoadInt32(&e.cancelled) != 0 {
+			return 0
+		}
 
-	// If the key prefix doesn't match then the iterator is done.
-	key := e.iterator.Key()
-	if !bytes.HasPrefix(key, e.prefix) {
-		return 0
-	}
+		// If the iterator is invalid then exit.
+		if !e.iterator.Valid() {
+			return 0
+		}
+
+		// If the key prefix doesn't match then the iterator is done.
+		key := e.iterator.Key()
+		if !bytes.HasPrefix(key, e.prefix) {
+			return 0
+		}
+
+		// If the key is past the end of the key range then the iterator is done.
+		if e.limitKey != nil && bytes.Compare(key, e.limitKey) >= 0 {
+			return 0
+		}
 
-	// Set the object data on the cursor.
-	value := e.iterator.Value()
-	C.sky_cursor_set_ptr(e.cursor, unsafe.Pointer(&value[0]), (C.size_t)(len(value)))
+		// Skip objects that are not in the sample.
+		if !sampleObject(key[len(e.prefix):], e.sample) {
+			e.iterator.Next()
+			continue
+		}
 
-	// Move to the next object.
-	e.iterator.Next()
+		// Skip objects that have no events within the time range.
+		value := e.iterator.Value()
+		if e.minTimestamp != math.MinInt64 {
+			if timestamp, ok := stateTimestamp(value); ok && timestamp < e.minTimestamp {
+				e.iterator.Next()
+				continue
+			}
+		}
 
-	return 1
+		// Set the object data on the cursor.
+		C.sky_cursor_set_ptr(e.cursor, unsafe.Pointer(&value[0]), (C.size_t)(len(value)))
+
+		// Move to the next object.
+		e.iterator.Next()
+
+		return 1
+	}
 }
@@ -0,0 +1,140 @@
+package skyd
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+//------------------------------------------------------------------------------
+//
+// Constants
+//
+//------------------------------------------------------------------------------
+
+// The number of idle engines kept by a pool by default.
+const DefaultExecutionEnginePoolSize = 8
+
+//------------------------------------------------------------------------------
+//
+// Typedefs
+//
+//------------------------------------------------------------------------------
+
+// An ExecutionEnginePool holds compiled execution engines that are idle so
+// that repeated queries can skip creating a Lua state and compiling source.
+// Engines are matched by table, query source and property schema version.
+type ExecutionEnginePool struct {
+	mutex sync.Mutex
+	size  int
+	idle  []*ExecutionEngine
+}
+
+//------------------------------------------------------------------------------
+//
+// Constructors
+//
+//------------------------------------------------------------------------------
+
+// NewExecutionEnginePool returns a new pool that keeps up to size idle engines.
+func NewExecutionEnginePool(size int) *ExecutionEnginePool {
+	return &ExecutionEnginePool{
+		size: size,
+		idle: make([]*ExecutionEngine, 0),
+	}
+}
+
+//------------------------------------------------------------------------------
+//
+// Accessors
+//
+//------------------------------------------------------------------------------
+
+// The maximum number of idle engines kept by the pool.
+func (p *ExecutionEnginePool) Size() int {
+	return p.size
+}
+
+// The number of engines currently idle in the pool.
+func (p *ExecutionEnginePool) Len() int {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return len(p.idle)
+}
+
+//------------------------------------------------------------------------------
+//
+// Methods
+//
+//------------------------------------------------------------------------------
+
+// Retrieves an idle engine compiled from the same source against the current
+// schema of the table. A new engine is created if none is available. Idle
+// engines compiled against an old schema of the table are destroyed.
+func (p *ExecutionEnginePool) Get(table *Table, source string) (*ExecutionEngine, error) {
+	if e := p.get(table, source); e != nil {
+		return e, nil
+	}
+	return NewExecutionEngine(table, source)
+}
+
+func (p *ExecutionEnginePool) get(table *Table, source string) *ExecutionEngine {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if table == nil || table.propertyFile == nil {
+		return nil
+	}
+	propertyFile := table.propertyFile
+	version := propertyFile.Version()
+
+	// Remove stale engines for the table.
+	idle := make([]*ExecutionEngine, 0, len(p.idle))
+	for _, e := range p.idle {
+		if e.tableName == table.Name && (e.propertyFile != propertyFile || e.version != version) {
+			e.Destroy()
+		} else {
+			idle = append(idle, e)
+		}
+	}
+	p.idle = idle
+
+	// Find the most recently used match.
+	for i := len(p.idle) - 1; i >= 0; i-- {
+		e := p.idle[i]
+		if e.tableName == table.Name && e.propertyFile == propertyFile && e.source == source {
+			p.idle = append(p.idle[:i], p.idle[i+1:]...)
+			atomic.StoreInt32(&e.cancelled, 0)
+			return e
+		}
+	}
+	return nil
+}
+
+// Returns an engine to the pool once a query is finished with it. The least
+// recently used engine is destroyed if the pool is full.
+func (p *ExecutionEnginePool) Put(e *ExecutionEngine) {
+	if e == nil {
+		return
+	}
+	e.reset()
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	p.idle = append(p.idle, e)
+	for len(p.idle) > p.size {
+		p.idle[0].Destroy()
+		p.idle = p.idle[1:]
+	}
+}
+
+// Destroys all idle engines.
+func (p *ExecutionEnginePool) Close() {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	for _, e := range p.idle {
+		e.Destroy()
+	}
+	p.idle = make([]*ExecutionEngine, 0)
+}
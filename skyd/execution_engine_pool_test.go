@@ -0,0 +1,79 @@
+package skyd
+
+import (
+	"sync/atomic"
+	"testing"
+)
+
+// Ensure that the pool reuses engines compiled from the same source.
+func TestExecutionEnginePoolReuse(t *testing.T) {
+	table := createTempTable(t)
+	table.Open()
+	defer table.Close()
+	table.CreateProperty("name", false, "string")
+
+	pool := NewExecutionEnginePool(2)
+	defer pool.Close()
+
+	e1, err := pool.Get(table, "function f(event) return event:name() end")
+	if err != nil {
+		t.Fatalf("Unable to get engine: %v", err)
+	}
+	pool.Put(e1)
+
+	// A late cancel of an idle engine doesn't carry over to the next query.
+	e1.Cancel()
+	if e2, _ := pool.Get(table, "function f(event) return event:name() end"); e2 != e1 {
+		t.Fatalf("Expected engine to be reused")
+	} else if atomic.LoadInt32(&e2.cancelled) != 0 {
+		t.Fatalf("Expected reused engine to not be cancelled")
+	} else {
+		pool.Put(e2)
+	}
+	if e3, _ := pool.Get(table, "function g(event) return event:name() end"); e3 == e1 {
+		t.Fatalf("Expected new engine for different source")
+	} else {
+		pool.Put(e3)
+	}
+	if pool.Len() != 2 {
+		t.Fatalf("Expected %v idle engines, got %v", 2, pool.Len())
+	}
+
+	// Putting a third engine evicts the least recently used.
+	e4, _ := NewExecutionEngine(table, "function h() end")
+	pool.Put(e4)
+	if pool.Len() != 2 {
+		t.Fatalf("Expected %v idle engines, got %v", 2, pool.Len())
+	}
+	if e5, _ := pool.Get(table, "function f(event) return event:name() end"); e5 == e1 {
+		t.Fatalf("Expected evicted engine to be recompiled")
+	} else {
+		pool.Put(e5)
+	}
+}
+
+// Ensure that the pool invalidates engines when the schema changes.
+func TestExecutionEnginePoolSchemaChange(t *testing.T) {
+	table := createTempTable(t)
+	table.Open()
+	defer table.Close()
+	table.CreateProperty("name", false, "string")
+
+	pool := NewExecutionEnginePool(DefaultExecutionEnginePoolSize)
+	defer pool.Close()
+
+	e1, err := pool.Get(table, "function f(event) return event:name() end")
+	if err != nil {
+		t.Fatalf("Unable to get engine: %v", err)
+	}
+	pool.Put(e1)
+	table.CreateProperty("salary", false, "float")
+	if e2, _ := pool.Get(table, "function f(event) return event:name() end"); e2 == e1 {
+		t.Fatalf("Expected engine to be invalidated")
+	} else {
+		pool.Put(e2)
+	}
+	if pool.Len() != 1 {
+		t.Fatalf("Expected %v idle engine, got %v", 1, pool.Len())
+	}
+}
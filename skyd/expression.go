@@ -0,0 +1,134 @@
+package skyd
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+//------------------------------------------------------------------------------
+//
+// Typedefs
+//
+//------------------------------------------------------------------------------
+
+// An Expression is a node in the abstract syntax tree of a query expression.
+type Expression interface {
+	String() string
+}
+
+// A BinaryExpression applies an operator to two expressions.
+type BinaryExpression struct {
+	Op  int
+	LHS Expression
+	RHS Expression
+}
+
+// A UnaryExpression applies an operator to a single expression.
+type UnaryExpression struct {
+	Op   int
+	Expr Expression
+}
+
+// An InExpression checks if an expression matches any value in a list.
+type InExpression struct {
+	Expr   Expression
+	Values []Expression
+}
+
+// A CallExpression is a function call such as an aggregate.
+type CallExpression struct {
+	Name string
+	Args []Expression
+}
+
+// A VarRef is a reference to a property on an event.
+type VarRef struct {
+	Name string
+}
+
+// A ParamRef is a placeholder for a value bound when the query is run.
+type ParamRef struct {
+	Name string
+}
+
+// A StringLiteral is a quoted string value.
+type StringLiteral struct {
+	Value string
+}
+
+// A NumberLiteral is an integer or floating point value.
+type NumberLiteral struct {
+	Value float64
+}
+
+// A BooleanLiteral is either true or false.
+type BooleanLiteral struct {
+	Value bool
+}
+
+//------------------------------------------------------------------------------
+//
+// Methods
+//
+//------------------------------------------------------------------------------
+
+//--------------------------------------
+// String Conversion
+//--------------------------------------
+
+// Converts the expression back into its textual form.
+func (e *BinaryExpression) String() string {
+	return fmt.Sprintf("(%s %s %s)", e.LHS.String(), tokenName(e.Op), e.RHS.String())
+}
+
+// Converts the expression back into its textual form.
+func (e *UnaryExpression) String() string {
+	if e.Op == tokenNot {
+		return fmt.Sprintf("(not %s)", e.Expr.String())
+	}
+	return fmt.Sprintf("(%s%s)", tokenName(e.Op), e.Expr.String())
+}
+
+// Converts the expression back into its textual form.
+func (e *InExpression) String() string {
+	values := []string{}
+	for _, value := range e.Values {
+		values = append(values, value.String())
+	}
+	return fmt.Sprintf("(%s in (%s))", e.Expr.String(), strings.Join(values, ", "))
+}
+
+// Converts the call back into its textual form.
+func (e *CallExpression) String() string {
+	args := []string{}
+	for _, arg := range e.Args {
+		args = append(args, arg.String())
+	}
+	return fmt.Sprintf("%s(%s)", e.Name, strings.Join(args, ", "))
+}
+
+// Converts the reference back into its textual form.
+func (r *VarRef) String() string {
+	return r.Name
+}
+
+// Converts the reference back into its textual form.
+func (r *ParamRef) String() string {
+	return "$" + r.Name
+}
+
+// Converts the literal back into its textual form.
+func (l *StringLiteral) String() string {
+	return strconv.Quote(l.Value)
+}
+
+// Converts the literal back into its textual form.
+func (l *NumberLiteral) String() string {
+	return strconv.FormatFloat(l.Value, 'f', -1, 64)
+}
+
+// Converts the literal back into its textual form.
+func (l *BooleanLiteral) String() string {
+	return strconv.FormatBool(l.Value)
+}
@@ -0,0 +1,426 @@
+package skyd
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+//------------------------------------------------------------------------------
+//
+// Constants
+//
+//------------------------------------------------------------------------------
+
+// The maximum number of factors that a prefix match on a factor property can
+// expand to.
+const MaxFactorPrefixMatches = 256
+
+//------------------------------------------------------------------------------
+//
+// Typedefs
+//
+//------------------------------------------------------------------------------
+
+// An ExpressionCompiler type checks an expression against the properties of a
+// table and generates the equivalent Lua code.
+type ExpressionCompiler struct {
+	table         *Table
+	factors       *Factors
+	ref           string
+	params        map[string]interface{}
+	permanentOnly bool
+}
+
+// The result of compiling part of an expression.
+type expressionValue struct {
+	code     string
+	dataType string
+	property *Property
+	literal  Expression
+}
+
+//------------------------------------------------------------------------------
+//
+// Constructors
+//
+//------------------------------------------------------------------------------
+
+// Creates a new compiler. The ref is the Lua variable that properties are
+// read from, such as "cursor.event".
+func NewExpressionCompiler(table *Table, factors *Factors, ref string) *ExpressionCompiler {
+	return &ExpressionCompiler{table: table, factors: factors, ref: ref}
+}
+
+//------------------------------------------------------------------------------
+//
+// Accessors
+//
+//------------------------------------------------------------------------------
+
+// Sets the values that parameter references are bound to.
+func (c *ExpressionCompiler) SetParams(params map[string]interface{}) {
+	c.params = params
+}
+
+// Restricts expressions to permanent properties. This is used where only the
+// object state is available, such as before an object's events are read.
+func (c *ExpressionCompiler) SetPermanentOnly(value bool) {
+	c.permanentOnly = value
+}
+
+//------------------------------------------------------------------------------
+//
+// Methods
+//
+//------------------------------------------------------------------------------
+
+//--------------------------------------
+// Compilation
+//--------------------------------------
+
+// Compiles an expression that must evaluate to a boolean.
+func (c *ExpressionCompiler) CompileCondition(expr Expression) (string, error) {
+	value, err := c.codegen(expr)
+	if err != nil {
+		return "", err
+	}
+	if value.dataType != BooleanDataType {
+		return "", fmt.Errorf("Expression must be a boolean: %s", expr.String())
+	}
+	return value.code, nil
+}
+
+// Compiles an expression that evaluates to a value and returns the code along
+// with the data type of the value.
+func (c *ExpressionCompiler) CompileValue(expr Expression) (string, string, error) {
+	value, err := c.codegen(expr)
+	if err != nil {
+		return "", "", err
+	}
+	return value.code, value.dataType, nil
+}
+
+// Generates the code for a single node and determines its type.
+func (c *ExpressionCompiler) codegen(expr Expression) (*expressionValue, error) {
+	switch expr := expr.(type) {
+	case *VarRef:
+		return c.codegenVarRef(expr)
+	case *ParamRef:
+		literal, err := c.bind(expr)
+		if err != nil {
+			return nil, err
+		}
+		return c.codegen(literal)
+	case *StringLiteral:
+		return &expressionValue{code: luaString(expr.Value), dataType: StringDataType, literal: expr}, nil
+	case *NumberLiteral:
+		return &expressionValue{code: expr.String(), dataType: FloatDataType, literal: expr}, nil
+	case *BooleanLiteral:
+		return &expressionValue{code: expr.String(), dataType: BooleanDataType, literal: expr}, nil
+	case *UnaryExpression:
+		return c.codegenUnaryExpression(expr)
+	case *BinaryExpression:
+		return c.codegenBinaryExpression(expr)
+	case *InExpression:
+		return c.codegenInExpression(expr)
+	case *CallExpression:
+		return nil, fmt.Errorf("Function not allowed here: %s", expr.String())
+	}
+	return nil, fmt.Errorf("Invalid expression: %v", expr)
+}
+
+// Generates a property accessor.
+func (c *ExpressionCompiler) codegenVarRef(expr *VarRef) (*expressionValue, error) {
+	if c.table == nil || c.table.propertyFile == nil {
+		return nil, errors.New("Table required to reference properties")
+	}
+	property := c.table.propertyFile.GetPropertyByName(expr.Name)
+	if property == nil {
+		return nil, fmt.Errorf("Property not found: %v", expr.Name)
+	}
+	if c.permanentOnly && property.Transient {
+		return nil, fmt.Errorf("Transient property not allowed: %v", expr.Name)
+	}
+	return &expressionValue{code: fmt.Sprintf("%s:%s()", c.ref, property.Name), dataType: property.DataType, property: property}, nil
+}
+
+// Generates a negation.
+func (c *ExpressionCompiler) codegenUnaryExpression(expr *UnaryExpression) (*expressionValue, error) {
+	value, err := c.codegen(expr.Expr)
+	if err != nil {
+		return nil, err
+	}
+	if expr.Op == tokenMinus {
+		if !isNumericDataType(value.dataType) {
+			return nil, fmt.Errorf("Operand of '-' must be numeric: %s", expr.String())
+		}
+		return &expressionValue{code: fmt.Sprintf("(-%s)", value.code), dataType: value.dataType}, nil
+	}
+	if value.dataType != BooleanDataType {
+		return nil, fmt.Errorf("Operand of 'not' must be a boolean: %s", expr.String())
+	}
+	return &expressionValue{code: fmt.Sprintf("(not %s)", value.code), dataType: BooleanDataType}, nil
+}
+
+// Generates a logical, arithmetic or comparison operation.
+func (c *ExpressionCompiler) codegenBinaryExpression(expr *BinaryExpression) (*expressionValue, error) {
+	switch expr.Op {
+	case tokenAnd, tokenOr:
+		lhs, err := c.codegen(expr.LHS)
+		if err != nil {
+			return nil, err
+		}
+		rhs, err := c.codegen(expr.RHS)
+		if err != nil {
+			return nil, err
+		}
+		if lhs.dataType != BooleanDataType || rhs.dataType != BooleanDataType {
+			return nil, fmt.Errorf("Operands of '%s' must be booleans: %s", tokenName(expr.Op), expr.String())
+		}
+		return &expressionValue{code: fmt.Sprintf("(%s %s %s)", lhs.code, tokenName(expr.Op), rhs.code), dataType: BooleanDataType}, nil
+
+	case tokenStartsWith:
+		return c.codegenStartsWith(expr)
+
+	case tokenPlus, tokenMinus, tokenMul, tokenDiv, tokenMod:
+		return c.codegenArithmetic(expr)
+	}
+
+	return c.codegenComparison(expr.Op, expr.LHS, expr.RHS)
+}
+
+// Generates an arithmetic operation on two numbers. Division and modulo by
+// zero evaluate to zero so that aggregates stay finite.
+func (c *ExpressionCompiler) codegenArithmetic(expr *BinaryExpression) (*expressionValue, error) {
+	lhs, err := c.codegen(expr.LHS)
+	if err != nil {
+		return nil, err
+	}
+	rhs, err := c.codegen(expr.RHS)
+	if err != nil {
+		return nil, err
+	}
+	if !isNumericDataType(lhs.dataType) || !isNumericDataType(rhs.dataType) {
+		return nil, fmt.Errorf("Operands of '%s' must be numeric: %s", tokenName(expr.Op), expr.String())
+	}
+
+	// Integer math stays integer except for division.
+	dataType := FloatDataType
+	if lhs.dataType == IntegerDataType && rhs.dataType == IntegerDataType && expr.Op != tokenDiv {
+		dataType = IntegerDataType
+	}
+
+	var code string
+	switch expr.Op {
+	case tokenDiv, tokenMod:
+		code = fmt.Sprintf("(%s == 0 and 0 or %s %s %s)", rhs.code, lhs.code, tokenName(expr.Op), rhs.code)
+	default:
+		code = fmt.Sprintf("(%s %s %s)", lhs.code, tokenName(expr.Op), rhs.code)
+	}
+	return &expressionValue{code: code, dataType: dataType}, nil
+}
+
+// Generates a comparison between two values.
+func (c *ExpressionCompiler) codegenComparison(op int, lhsExpr Expression, rhsExpr Expression) (*expressionValue, error) {
+	lhs, err := c.codegen(lhsExpr)
+	if err != nil {
+		return nil, err
+	}
+	rhs, err := c.codegen(rhsExpr)
+	if err != nil {
+		return nil, err
+	}
+	text := fmt.Sprintf("%s %s %s", lhsExpr.String(), tokenName(op), rhsExpr.String())
+
+	// Factors are compared by their sequence so literals need to be factorized.
+	if lhs.dataType == FactorDataType || rhs.dataType == FactorDataType {
+		if op != tokenEQ && op != tokenNE {
+			return nil, fmt.Errorf("Factor properties can only be compared for equality: %s", text)
+		}
+		if lhs.dataType != FactorDataType {
+			lhs, rhs = rhs, lhs
+		}
+		switch {
+		case rhs.dataType == FactorDataType:
+			if lhs.property.Name != rhs.property.Name {
+				return nil, fmt.Errorf("Cannot compare different factor properties: %s", text)
+			}
+		case rhs.dataType == StringDataType && rhs.literal != nil:
+			sequence, found, err := c.factorize(lhs.property, rhs.literal.(*StringLiteral).Value)
+			if err != nil {
+				return nil, err
+			}
+			// Values that have never been seen can never match.
+			if !found {
+				return &expressionValue{code: strconv.FormatBool(op == tokenNE), dataType: BooleanDataType}, nil
+			}
+			rhs = &expressionValue{code: strconv.FormatUint(sequence, 10), dataType: FactorDataType}
+		default:
+			return nil, fmt.Errorf("Factor properties can only be compared to string literals: %s", text)
+		}
+		return &expressionValue{code: fmt.Sprintf("(%s %s %s)", lhs.code, luaOperator(op), rhs.code), dataType: BooleanDataType}, nil
+	}
+
+	// Validate that the types are comparable.
+	switch {
+	case isNumericDataType(lhs.dataType) && isNumericDataType(rhs.dataType):
+	case lhs.dataType == StringDataType && rhs.dataType == StringDataType:
+	case lhs.dataType == BooleanDataType && rhs.dataType == BooleanDataType:
+		if op != tokenEQ && op != tokenNE {
+			return nil, fmt.Errorf("Booleans can only be compared for equality: %s", text)
+		}
+	default:
+		return nil, fmt.Errorf("Cannot compare %s to %s: %s", lhs.dataType, rhs.dataType, text)
+	}
+
+	return &expressionValue{code: fmt.Sprintf("(%s %s %s)", lhs.code, luaOperator(op), rhs.code), dataType: BooleanDataType}, nil
+}
+
+// Generates a check against a list of values.
+func (c *ExpressionCompiler) codegenInExpression(expr *InExpression) (*expressionValue, error) {
+	conditions := []string{}
+	for _, value := range expr.Values {
+		condition, err := c.codegenComparison(tokenEQ, expr.Expr, value)
+		if err != nil {
+			return nil, err
+		}
+		if condition.code != "false" {
+			conditions = append(conditions, condition.code)
+		}
+	}
+	if len(conditions) == 0 {
+		return &expressionValue{code: "false", dataType: BooleanDataType}, nil
+	}
+	return &expressionValue{code: "(" + strings.Join(conditions, " or ") + ")", dataType: BooleanDataType}, nil
+}
+
+// Generates a string prefix match.
+func (c *ExpressionCompiler) codegenStartsWith(expr *BinaryExpression) (*expressionValue, error) {
+	lhs, err := c.codegen(expr.LHS)
+	if err != nil {
+		return nil, err
+	}
+	rhs := expr.RHS
+	if ref, ok := rhs.(*ParamRef); ok {
+		if rhs, err = c.bind(ref); err != nil {
+			return nil, err
+		}
+	}
+	literal, ok := rhs.(*StringLiteral)
+	if !ok {
+		return nil, fmt.Errorf("Prefix must be a string literal: %s", expr.String())
+	}
+	if literal.Value == "" {
+		return &expressionValue{code: "true", dataType: BooleanDataType}, nil
+	}
+
+	switch lhs.dataType {
+	case StringDataType:
+		code := fmt.Sprintf("(string.sub(%s, 1, %d) == %s)", lhs.code, len(literal.Value), luaString(literal.Value))
+		return &expressionValue{code: code, dataType: BooleanDataType}, nil
+
+	case FactorDataType:
+		// Match against every factor that has the prefix. The number of
+		// factors is limited to keep the generated code small.
+		if c.factors == nil {
+			return nil, errors.New("Factors required to match factor prefix")
+		}
+		factors, err := c.factors.Find(c.table.Name, lhs.property.Name, literal.Value, "", MaxFactorPrefixMatches+1)
+		if err != nil {
+			return nil, err
+		}
+		if len(factors) > MaxFactorPrefixMatches {
+			return nil, fmt.Errorf("Prefix matches more than %d values: %s", MaxFactorPrefixMatches, expr.String())
+		}
+		conditions := []string{}
+		for _, factor := range factors {
+			conditions = append(conditions, fmt.Sprintf("%s == %d", lhs.code, factor.Id))
+		}
+		if len(conditions) == 0 {
+			return &expressionValue{code: "false", dataType: BooleanDataType}, nil
+		}
+		return &expressionValue{code: "(" + strings.Join(conditions, " or ") + ")", dataType: BooleanDataType}, nil
+	}
+
+	return nil, fmt.Errorf("Prefix matches require a string or factor property: %s", expr.String())
+}
+
+// Converts the value bound to a parameter into a literal. Factor values are
+// bound as strings so they are factorized like any other string literal.
+func (c *ExpressionCompiler) bind(ref *ParamRef) (Expression, error) {
+	value, ok := c.params[ref.Name]
+	if !ok {
+		return nil, fmt.Errorf("Unbound parameter: %s", ref.String())
+	}
+	switch value := value.(type) {
+	case string:
+		return &StringLiteral{Value: value}, nil
+	case float64:
+		return &NumberLiteral{Value: value}, nil
+	case int:
+		return &NumberLiteral{Value: float64(value)}, nil
+	case int64:
+		return &NumberLiteral{Value: float64(value)}, nil
+	case bool:
+		return &BooleanLiteral{Value: value}, nil
+	}
+	return nil, fmt.Errorf("Invalid value for parameter %s: %v", ref.String(), value)
+}
+
+// Factorizes a literal value for a property. Returns false if the value does
+// not exist.
+func (c *ExpressionCompiler) factorize(property *Property, value string) (uint64, bool, error) {
+	if c.factors == nil {
+		return 0, false, errors.New("Factors required to compare factor properties")
+	}
+	sequence, err := c.factors.Factorize(c.table.Name, property.Name, value, false)
+	if _, ok := err.(*FactorNotFound); ok {
+		return 0, false, nil
+	} else if err != nil {
+		return 0, false, err
+	}
+	return sequence, true, nil
+}
+
+//--------------------------------------
+// Utility
+//--------------------------------------
+
+// Checks if a data type is an integer or float.
+func isNumericDataType(dataType string) bool {
+	return dataType == IntegerDataType || dataType == FloatDataType
+}
+
+// Converts a comparison token to its Lua operator.
+func luaOperator(op int) string {
+	if op == tokenNE {
+		return "~="
+	}
+	return tokenName(op)
+}
+
+// Quotes a string as a Lua literal. Control characters are escaped as well as
+// anything that could be mistaken for an event property reference.
+func luaString(s string) string {
+	var buffer bytes.Buffer
+	buffer.WriteByte('"')
+	for i := 0; i < len(s); i++ {
+		ch := s[i]
+		switch {
+		case ch == '"' || ch == '\\':
+			buffer.WriteByte('\\')
+			buffer.WriteByte(ch)
+		case ch < 0x20 || ch == 0x7f:
+			fmt.Fprintf(&buffer, "\\%03d", ch)
+		case (ch == '.' || ch == ':') && strings.HasSuffix(s[:i], "event"):
+			fmt.Fprintf(&buffer, "\\%03d", ch)
+		default:
+			buffer.WriteByte(ch)
+		}
+	}
+	buffer.WriteByte('"')
+	return buffer.String()
+}
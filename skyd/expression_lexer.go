@@ -0,0 +1,323 @@
+package skyd
+
+import (
+	"bytes"
+	"strings"
+	"unicode"
+)
+
+//------------------------------------------------------------------------------
+//
+// Constants
+//
+//------------------------------------------------------------------------------
+
+const (
+	tokenIllegal = iota
+	tokenEOF
+	tokenIdent
+	tokenString
+	tokenNumber
+	tokenParam
+
+	tokenLParen
+	tokenRParen
+	tokenComma
+	tokenRange
+	tokenPlus
+	tokenMinus
+	tokenMul
+	tokenDiv
+	tokenMod
+
+	tokenEQ
+	tokenNE
+	tokenLT
+	tokenLTE
+	tokenGT
+	tokenGTE
+
+	tokenAnd
+	tokenOr
+	tokenNot
+	tokenIn
+	tokenStartsWith
+	tokenTrue
+	tokenFalse
+)
+
+var tokenStrings = map[int]string{
+	tokenIllegal:    "ILLEGAL",
+	tokenEOF:        "EOF",
+	tokenIdent:      "IDENT",
+	tokenString:     "STRING",
+	tokenNumber:     "NUMBER",
+	tokenParam:      "PARAM",
+	tokenLParen:     "(",
+	tokenRParen:     ")",
+	tokenComma:      ",",
+	tokenRange:      "..",
+	tokenPlus:       "+",
+	tokenMinus:      "-",
+	tokenMul:        "*",
+	tokenDiv:        "/",
+	tokenMod:        "%",
+	tokenEQ:         "==",
+	tokenNE:         "!=",
+	tokenLT:         "<",
+	tokenLTE:        "<=",
+	tokenGT:         ">",
+	tokenGTE:        ">=",
+	tokenAnd:        "and",
+	tokenOr:         "or",
+	tokenNot:        "not",
+	tokenIn:         "in",
+	tokenStartsWith: "startswith",
+	tokenTrue:       "true",
+	tokenFalse:      "false",
+}
+
+// Keywords are matched case insensitively.
+var keywords = map[string]int{
+	"and":        tokenAnd,
+	"or":         tokenOr,
+	"not":        tokenNot,
+	"in":         tokenIn,
+	"startswith": tokenStartsWith,
+	"true":       tokenTrue,
+	"false":      tokenFalse,
+}
+
+const eof = rune(0)
+
+//------------------------------------------------------------------------------
+//
+// Typedefs
+//
+//------------------------------------------------------------------------------
+
+// An expressionLexer breaks an expression string into tokens.
+type expressionLexer struct {
+	src []rune
+	pos int
+}
+
+//------------------------------------------------------------------------------
+//
+// Constructors
+//
+//------------------------------------------------------------------------------
+
+// Creates a new lexer for a source string.
+func newExpressionLexer(src string) *expressionLexer {
+	return &expressionLexer{src: []rune(src)}
+}
+
+//------------------------------------------------------------------------------
+//
+// Functions
+//
+//------------------------------------------------------------------------------
+
+// Returns the printable representation of a token.
+func tokenName(tok int) string {
+	return tokenStrings[tok]
+}
+
+//------------------------------------------------------------------------------
+//
+// Methods
+//
+//------------------------------------------------------------------------------
+
+// Returns the next token along with its starting position and literal text.
+func (l *expressionLexer) scan() (tok int, pos int, lit string) {
+	// Skip whitespace.
+	for unicode.IsSpace(l.peek()) {
+		l.pos++
+	}
+
+	pos = l.pos
+	ch := l.read()
+	switch {
+	case ch == eof:
+		return tokenEOF, pos, ""
+	case isIdentStart(ch):
+		l.unread()
+		return l.scanIdent()
+	case isDigit(ch):
+		l.unread()
+		return l.scanNumber()
+	case ch == '"' || ch == '\'':
+		return l.scanString(ch)
+	case ch == '$' && isIdentStart(l.peek()):
+		return l.scanParam()
+	}
+
+	switch ch {
+	case '(':
+		return tokenLParen, pos, "("
+	case ')':
+		return tokenRParen, pos, ")"
+	case ',':
+		return tokenComma, pos, ","
+	case '.':
+		if l.peek() == '.' {
+			l.read()
+			return tokenRange, pos, ".."
+		}
+	case '+':
+		return tokenPlus, pos, "+"
+	case '-':
+		return tokenMinus, pos, "-"
+	case '*':
+		return tokenMul, pos, "*"
+	case '/':
+		return tokenDiv, pos, "/"
+	case '%':
+		return tokenMod, pos, "%"
+	case '=':
+		if l.peek() == '=' {
+			l.read()
+			return tokenEQ, pos, "=="
+		}
+	case '!':
+		if l.peek() == '=' {
+			l.read()
+			return tokenNE, pos, "!="
+		}
+	case '<':
+		if l.peek() == '=' {
+			l.read()
+			return tokenLTE, pos, "<="
+		}
+		return tokenLT, pos, "<"
+	case '>':
+		if l.peek() == '=' {
+			l.read()
+			return tokenGTE, pos, ">="
+		}
+		return tokenGT, pos, ">"
+	}
+
+	return tokenIllegal, pos, string(ch)
+}
+
+// Scans an identifier or keyword.
+func (l *expressionLexer) scanIdent() (int, int, string) {
+	pos := l.pos
+	for isIdentChar(l.peek()) {
+		l.pos++
+	}
+	lit := string(l.src[pos:l.pos])
+	if tok, ok := keywords[strings.ToLower(lit)]; ok {
+		return tok, pos, lit
+	}
+	return tokenIdent, pos, lit
+}
+
+// Scans a parameter reference. The returned literal excludes the '$'.
+func (l *expressionLexer) scanParam() (int, int, string) {
+	pos := l.pos - 1
+	_, _, lit := l.scanIdent()
+	return tokenParam, pos, lit
+}
+
+// Scans an integer or decimal number.
+func (l *expressionLexer) scanNumber() (int, int, string) {
+	pos := l.pos
+	for isDigit(l.peek()) {
+		l.pos++
+	}
+	if l.peek() == '.' && l.peekAt(1) != '.' {
+		l.pos++
+		if !isDigit(l.peek()) {
+			return tokenIllegal, pos, string(l.src[pos:l.pos])
+		}
+		for isDigit(l.peek()) {
+			l.pos++
+		}
+	}
+	return tokenNumber, pos, string(l.src[pos:l.pos])
+}
+
+// Scans a single or double quoted string. The returned literal is unescaped.
+func (l *expressionLexer) scanString(quote rune) (int, int, string) {
+	pos := l.pos - 1
+	var buf bytes.Buffer
+	for {
+		ch := l.read()
+		switch ch {
+		case quote:
+			return tokenString, pos, buf.String()
+		case eof, '\n':
+			return tokenIllegal, pos, string(l.src[pos:l.pos])
+		case '\\':
+			switch next := l.read(); next {
+			case 'n':
+				buf.WriteRune('\n')
+			case 't':
+				buf.WriteRune('\t')
+			case '\\', '"', '\'':
+				buf.WriteRune(next)
+			default:
+				return tokenIllegal, pos, string(l.src[pos:l.pos])
+			}
+		default:
+			buf.WriteRune(ch)
+		}
+	}
+}
+
+// Reads the next rune from the source.
+func (l *expressionLexer) read() rune {
+	if l.pos >= len(l.src) {
+		return eof
+	}
+	ch := l.src[l.pos]
+	l.pos++
+	return ch
+}
+
+// Moves back to the previous rune.
+func (l *expressionLexer) unread() {
+	l.pos--
+}
+
+// Returns the next rune without consuming it.
+func (l *expressionLexer) peek() rune {
+	return l.peekAt(0)
+}
+
+// Returns the rune n places after the next rune without consuming anything.
+func (l *expressionLexer) peekAt(n int) rune {
+	if l.pos+n >= len(l.src) {
+		return eof
+	}
+	return l.src[l.pos+n]
+}
+
+// Checks if a string can be used as a parameter name.
+func isValidParamName(name string) bool {
+	if name == "" || !isIdentStart(rune(name[0])) {
+		return false
+	}
+	for _, ch := range name {
+		if !isIdentChar(ch) {
+			return false
+		}
+	}
+	return true
+}
+
+func isIdentStart(ch rune) bool {
+	return ch == '_' || (ch >= 'a' && ch <= 'z') || (ch >= 'A' && ch <= 'Z')
+}
+
+func isIdentChar(ch rune) bool {
+	return isIdentStart(ch) || isDigit(ch)
+}
+
+func isDigit(ch rune) bool {
+	return ch >= '0' && ch <= '9'
+}
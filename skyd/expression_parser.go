@@ -0,0 +1,330 @@
+package skyd
+
+import (
+	"fmt"
+	"strconv"
+)
+
+//------------------------------------------------------------------------------
+//
+// Typedefs
+//
+//------------------------------------------------------------------------------
+
+// An ExpressionParser converts the text of an expression into an AST.
+type ExpressionParser struct {
+	lexer *expressionLexer
+	buf   struct {
+		tok int
+		pos int
+		lit string
+		n   int
+	}
+}
+
+// An ExpressionError is a syntax or type error found at a position within an
+// expression.
+type ExpressionError struct {
+	Message string
+	Pos     int
+}
+
+//------------------------------------------------------------------------------
+//
+// Constructors
+//
+//------------------------------------------------------------------------------
+
+// Creates a new parser for an expression string.
+func NewExpressionParser(src string) *ExpressionParser {
+	return &ExpressionParser{lexer: newExpressionLexer(src)}
+}
+
+//------------------------------------------------------------------------------
+//
+// Functions
+//
+//------------------------------------------------------------------------------
+
+// Parses a complete expression string.
+func ParseExpression(src string) (Expression, error) {
+	p := NewExpressionParser(src)
+	expr, err := p.ParseExpression()
+	if err != nil {
+		return nil, err
+	}
+	if tok, pos, lit := p.scan(); tok == tokenIllegal {
+		return nil, newExpressionError(pos, "Invalid token %q", lit)
+	} else if tok != tokenEOF {
+		return nil, newExpressionError(pos, "Unexpected %q", lit)
+	}
+	return expr, nil
+}
+
+func newExpressionError(pos int, format string, v ...interface{}) error {
+	return &ExpressionError{Message: fmt.Sprintf(format, v...), Pos: pos}
+}
+
+//------------------------------------------------------------------------------
+//
+// Methods
+//
+//------------------------------------------------------------------------------
+
+//--------------------------------------
+// Errors
+//--------------------------------------
+
+func (e *ExpressionError) Error() string {
+	return fmt.Sprintf("%s at char %d", e.Message, e.Pos+1)
+}
+
+//--------------------------------------
+// Parsing
+//--------------------------------------
+
+// Parses an expression up to the first token that cannot continue it. The
+// remaining tokens are left for the caller.
+func (p *ExpressionParser) ParseExpression() (Expression, error) {
+	return p.parseOr()
+}
+
+// or := and ("or" and)*
+func (p *ExpressionParser) parseOr() (Expression, error) {
+	lhs, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		if tok, _, _ := p.scan(); tok != tokenOr {
+			p.unscan()
+			return lhs, nil
+		}
+		rhs, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		lhs = &BinaryExpression{Op: tokenOr, LHS: lhs, RHS: rhs}
+	}
+}
+
+// and := not ("and" not)*
+func (p *ExpressionParser) parseAnd() (Expression, error) {
+	lhs, err := p.parseNot()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		if tok, _, _ := p.scan(); tok != tokenAnd {
+			p.unscan()
+			return lhs, nil
+		}
+		rhs, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		lhs = &BinaryExpression{Op: tokenAnd, LHS: lhs, RHS: rhs}
+	}
+}
+
+// not := "not" not | comparison
+func (p *ExpressionParser) parseNot() (Expression, error) {
+	if tok, _, _ := p.scan(); tok == tokenNot {
+		expr, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		return &UnaryExpression{Op: tokenNot, Expr: expr}, nil
+	}
+	p.unscan()
+	return p.parseComparison()
+}
+
+// comparison := additive (compareOp additive | "in" "(" list ")" | "startswith" additive)?
+func (p *ExpressionParser) parseComparison() (Expression, error) {
+	lhs, err := p.parseAdditive()
+	if err != nil {
+		return nil, err
+	}
+
+	tok, _, _ := p.scan()
+	switch tok {
+	case tokenEQ, tokenNE, tokenLT, tokenLTE, tokenGT, tokenGTE, tokenStartsWith:
+		rhs, err := p.parseAdditive()
+		if err != nil {
+			return nil, err
+		}
+		return &BinaryExpression{Op: tok, LHS: lhs, RHS: rhs}, nil
+
+	case tokenIn:
+		if tok, pos, lit := p.scan(); tok != tokenLParen {
+			return nil, newExpressionError(pos, "Expected '(' after 'in', found %q", lit)
+		}
+		expr := &InExpression{Expr: lhs}
+		for {
+			value, err := p.parseAdditive()
+			if err != nil {
+				return nil, err
+			}
+			expr.Values = append(expr.Values, value)
+
+			tok, pos, lit := p.scan()
+			if tok == tokenRParen {
+				break
+			} else if tok != tokenComma {
+				return nil, newExpressionError(pos, "Expected ',' or ')', found %q", lit)
+			}
+		}
+		return expr, nil
+	}
+	p.unscan()
+
+	return lhs, nil
+}
+
+// additive := multiplicative (("+" | "-") multiplicative)*
+func (p *ExpressionParser) parseAdditive() (Expression, error) {
+	lhs, err := p.parseMultiplicative()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		tok, _, _ := p.scan()
+		if tok != tokenPlus && tok != tokenMinus {
+			p.unscan()
+			return lhs, nil
+		}
+		rhs, err := p.parseMultiplicative()
+		if err != nil {
+			return nil, err
+		}
+		lhs = &BinaryExpression{Op: tok, LHS: lhs, RHS: rhs}
+	}
+}
+
+// multiplicative := unary (("*" | "/" | "%") unary)*
+func (p *ExpressionParser) parseMultiplicative() (Expression, error) {
+	lhs, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		tok, _, _ := p.scan()
+		if tok != tokenMul && tok != tokenDiv && tok != tokenMod {
+			p.unscan()
+			return lhs, nil
+		}
+		rhs, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		lhs = &BinaryExpression{Op: tok, LHS: lhs, RHS: rhs}
+	}
+}
+
+// unary := "-" unary | operand
+func (p *ExpressionParser) parseUnary() (Expression, error) {
+	if tok, _, _ := p.scan(); tok != tokenMinus {
+		p.unscan()
+		return p.parseOperand()
+	}
+	expr, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+
+	// Fold negative numbers into the literal.
+	if literal, ok := expr.(*NumberLiteral); ok {
+		return &NumberLiteral{Value: -literal.Value}, nil
+	}
+	return &UnaryExpression{Op: tokenMinus, Expr: expr}, nil
+}
+
+// operand := IDENT | call | PARAM | STRING | NUMBER | "true" | "false" | "(" expr ")"
+func (p *ExpressionParser) parseOperand() (Expression, error) {
+	tok, pos, lit := p.scan()
+	switch tok {
+	case tokenIdent:
+		if tok, _, _ := p.scan(); tok == tokenLParen {
+			return p.parseCall(lit)
+		}
+		p.unscan()
+		return &VarRef{Name: lit}, nil
+	case tokenParam:
+		return &ParamRef{Name: lit}, nil
+	case tokenString:
+		return &StringLiteral{Value: lit}, nil
+	case tokenTrue:
+		return &BooleanLiteral{Value: true}, nil
+	case tokenFalse:
+		return &BooleanLiteral{Value: false}, nil
+	case tokenNumber:
+		return p.parseNumber(pos, lit)
+	case tokenLParen:
+		expr, err := p.ParseExpression()
+		if err != nil {
+			return nil, err
+		}
+		if tok, pos, lit := p.scan(); tok != tokenRParen {
+			return nil, newExpressionError(pos, "Expected ')', found %q", lit)
+		}
+		return expr, nil
+	case tokenEOF:
+		return nil, newExpressionError(pos, "Unexpected end of expression")
+	case tokenIllegal:
+		return nil, newExpressionError(pos, "Invalid token %q", lit)
+	}
+	return nil, newExpressionError(pos, "Unexpected %q", lit)
+}
+
+// call := IDENT "(" (expr ("," expr)*)? ")"
+func (p *ExpressionParser) parseCall(name string) (Expression, error) {
+	call := &CallExpression{Name: name}
+	if tok, _, _ := p.scan(); tok == tokenRParen {
+		return call, nil
+	}
+	p.unscan()
+
+	for {
+		arg, err := p.ParseExpression()
+		if err != nil {
+			return nil, err
+		}
+		call.Args = append(call.Args, arg)
+
+		tok, pos, lit := p.scan()
+		if tok == tokenRParen {
+			return call, nil
+		} else if tok != tokenComma {
+			return nil, newExpressionError(pos, "Expected ',' or ')', found %q", lit)
+		}
+	}
+}
+
+// Converts a number token to a literal.
+func (p *ExpressionParser) parseNumber(pos int, lit string) (Expression, error) {
+	value, err := strconv.ParseFloat(lit, 64)
+	if err != nil {
+		return nil, newExpressionError(pos, "Invalid number %q", lit)
+	}
+	return &NumberLiteral{Value: value}, nil
+}
+
+//--------------------------------------
+// Scanning
+//--------------------------------------
+
+// Returns the next token. If a token was unscanned then it is returned instead.
+func (p *ExpressionParser) scan() (int, int, string) {
+	if p.buf.n != 0 {
+		p.buf.n = 0
+		return p.buf.tok, p.buf.pos, p.buf.lit
+	}
+	p.buf.tok, p.buf.pos, p.buf.lit = p.lexer.scan()
+	return p.buf.tok, p.buf.pos, p.buf.lit
+}
+
+// Pushes the last token back so the next scan() returns it again.
+func (p *ExpressionParser) unscan() {
+	p.buf.n = 1
+}
@@ -0,0 +1,59 @@
+package skyd
+
+import (
+	"testing"
+)
+
+// Ensure that we can parse expressions into an AST.
+func TestParseExpression(t *testing.T) {
+	tests := []struct {
+		src string
+		exp string
+	}{
+		{`true`, `true`},
+		{`action == 'A0'`, `(action == "A0")`},
+		{`price >= 10.5 AND price < -2`, `((price >= 10.5) and (price < -2))`},
+		{`a == 1 or b == 2 and not c`, `((a == 1) or ((b == 2) and (not c)))`},
+		{`(a == 1 or b == 2) and c != "x\"y"`, `(((a == 1) or (b == 2)) and (c != "x\"y"))`},
+		{`state in ("NY", 'CA')`, `(state in ("NY", "CA"))`},
+		{`path startswith "/blog"`, `(path startswith "/blog")`},
+		{`price * quantity + 1 > 10`, `(((price * quantity) + 1) > 10)`},
+		{`a - b - c / 2 % 3`, `((a - b) - ((c / 2) % 3))`},
+		{`-(a + b) * -2`, `((-(a + b)) * -2)`},
+		{`sum(price * -quantity)`, `sum((price * (-quantity)))`},
+		{`price > $min and action in ($a, "b")`, `((price > $min) and (action in ($a, "b")))`},
+	}
+	for i, test := range tests {
+		expr, err := ParseExpression(test.src)
+		if err != nil {
+			t.Fatalf("[%d] Unable to parse %q: %v", i, test.src, err)
+		}
+		if expr.String() != test.exp {
+			t.Fatalf("[%d] Wrong parse of %q:\nexp: %s\ngot: %s", i, test.src, test.exp, expr.String())
+		}
+	}
+}
+
+// Ensure that syntax errors report their position.
+func TestParseExpressionErrors(t *testing.T) {
+	tests := []struct {
+		src string
+		exp string
+	}{
+		{``, `Unexpected end of expression at char 1`},
+		{`a == `, `Unexpected end of expression at char 6`},
+		{`a = 1`, `Invalid token "=" at char 3`},
+		{`a == 'foo`, `Invalid token "'foo" at char 6`},
+		{`a in (1, 2`, `Expected ',' or ')', found "" at char 11`},
+		{`(a == 1`, `Expected ')', found "" at char 8`},
+		{`a == 1 b`, `Unexpected "b" at char 8`},
+		{`a * `, `Unexpected end of expression at char 5`},
+		{`a == $`, `Invalid token "$" at char 6`},
+	}
+	for i, test := range tests {
+		_, err := ParseExpression(test.src)
+		if err == nil || err.Error() != test.exp {
+			t.Fatalf("[%d] Wrong error for %q:\nexp: %s\ngot: %v", i, test.src, test.exp, err)
+		}
+	}
+}
@@ -0,0 +1,153 @@
+package skyd
+
+import (
+	"container/list"
+	"strings"
+	"sync"
+)
+
+//------------------------------------------------------------------------------
+//
+// Constants
+//
+//------------------------------------------------------------------------------
+
+// The default number of entries held in each direction of the factor cache.
+const DefaultFactorCacheSize = 10000
+
+//------------------------------------------------------------------------------
+//
+// Typedefs
+//
+//------------------------------------------------------------------------------
+
+// A factorCache is a bounded LRU cache of factor lookups keyed on the
+// factors database key.
+type factorCache struct {
+	size    int
+	items   map[string]*list.Element
+	lru     *list.List
+	version uint64
+	hits    uint64
+	misses  uint64
+	mutex   sync.Mutex
+}
+
+type factorCacheEntry struct {
+	key   string
+	value interface{}
+}
+
+// FactorCacheStats are the usage counters for the factor cache.
+type FactorCacheStats struct {
+	Hits   uint64 `json:"hits"`
+	Misses uint64 `json:"misses"`
+	Size   int    `json:"size"`
+}
+
+//------------------------------------------------------------------------------
+//
+// Constructors
+//
+//------------------------------------------------------------------------------
+
+// Creates a new cache that holds up to size entries.
+func newFactorCache(size int) *factorCache {
+	return &factorCache{
+		size:  size,
+		items: make(map[string]*list.Element),
+		lru:   list.New(),
+	}
+}
+
+//------------------------------------------------------------------------------
+//
+// Methods
+//
+//------------------------------------------------------------------------------
+
+// Retrieves a cached value and marks it as recently used.
+func (c *factorCache) get(key string) (interface{}, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if elem, ok := c.items[key]; ok {
+		c.hits++
+		c.lru.MoveToFront(elem)
+		return elem.Value.(*factorCacheEntry).value, true
+	}
+	c.misses++
+	return nil, false
+}
+
+// Returns the current version of the cache. The version changes every time
+// an entry is invalidated.
+func (c *factorCache) currentVersion() uint64 {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.version
+}
+
+// Adds a value to the cache as long as nothing has been invalidated since the
+// version was retrieved. This prevents a slow reader from caching a value that
+// was changed while it was reading from the database.
+func (c *factorCache) add(key string, value interface{}, version uint64) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.size <= 0 || version != c.version {
+		return
+	}
+
+	if elem, ok := c.items[key]; ok {
+		elem.Value.(*factorCacheEntry).value = value
+		c.lru.MoveToFront(elem)
+		return
+	}
+	c.items[key] = c.lru.PushFront(&factorCacheEntry{key: key, value: value})
+
+	// Evict the least recently used entry if we're over capacity.
+	if c.lru.Len() > c.size {
+		elem := c.lru.Back()
+		c.lru.Remove(elem)
+		delete(c.items, elem.Value.(*factorCacheEntry).key)
+	}
+}
+
+// Removes a single key from the cache.
+func (c *factorCache) remove(key string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.version++
+	if elem, ok := c.items[key]; ok {
+		c.lru.Remove(elem)
+		delete(c.items, key)
+	}
+}
+
+// Removes every key that starts with a given prefix.
+func (c *factorCache) removePrefix(prefix string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.version++
+	for key, elem := range c.items {
+		if strings.HasPrefix(key, prefix) {
+			c.lru.Remove(elem)
+			delete(c.items, key)
+		}
+	}
+}
+
+// Removes all entries from the cache.
+func (c *factorCache) purge() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.version++
+	c.items = make(map[string]*list.Element)
+	c.lru.Init()
+}
+
+// Retrieves the usage counters for the cache.
+func (c *factorCache) stats() FactorCacheStats {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return FactorCacheStats{Hits: c.hits, Misses: c.misses, Size: c.lru.Len()}
+}
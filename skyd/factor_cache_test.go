@@ -0,0 +1,35 @@
+package skyd
+
+import (
+	"testing"
+)
+
+// Ensure that the factor cache evicts the least recently used entry.
+func TestFactorCacheEviction(t *testing.T) {
+	c := newFactorCache(2)
+	c.add("a", uint64(1), c.currentVersion())
+	c.add("b", uint64(2), c.currentVersion())
+	c.get("a")
+	c.add("c", uint64(3), c.currentVersion())
+
+	if _, ok := c.get("b"); ok {
+		t.Fatalf("Expected 'b' to be evicted")
+	}
+	if v, ok := c.get("a"); !ok || v.(uint64) != 1 {
+		t.Fatalf("Wrong value for 'a': %v", v)
+	}
+	if stats := c.stats(); stats.Hits != 2 || stats.Misses != 1 || stats.Size != 2 {
+		t.Fatalf("Wrong cache stats: %v", stats)
+	}
+}
+
+// Ensure that values read before an invalidation are not cached.
+func TestFactorCacheStaleAdd(t *testing.T) {
+	c := newFactorCache(2)
+	version := c.currentVersion()
+	c.removePrefix("foo>")
+	c.add("foo>bar:baz", uint64(1), version)
+	if _, ok := c.get("foo>bar:baz"); ok {
+		t.Fatalf("Expected stale value not to be cached")
+	}
+}
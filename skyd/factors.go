@@ -1,10 +1,12 @@
 package skyd
 
 import (
+	"bytes"
 	"errors"
 	"fmt"
 	"github.com/jmhodges/levigo"
 	"strconv"
+	"strings"
 	"sync"
 )
 
@@ -16,11 +18,20 @@ import (
 
 // A Factors object manages the factorization and defactorization of values.
 type Factors struct {
-	db    *levigo.DB
-	ro    *levigo.ReadOptions
-	wo    *levigo.WriteOptions
-	path  string
-	mutex sync.Mutex
+	db          *levigo.DB
+	ro          *levigo.ReadOptions
+	wo          *levigo.WriteOptions
+	path        string
+	keyCache    *factorCache
+	revkeyCache *factorCache
+	mutex       sync.Mutex
+}
+
+// A Factor is a single value stored in the factors database along with its
+// sequence identifier.
+type Factor struct {
+	Id    uint64 `json:"id"`
+	Value string `json:"value"`
 }
 
 //------------------------------------------------------------------------------
@@ -53,7 +64,11 @@ func (e *FactorNotFound) Error() string {
 
 // NewFactors returns a new Factors object.
 func NewFactors(path string) *Factors {
-	return &Factors{path: path}
+	return &Factors{
+		path:        path,
+		keyCache:    newFactorCache(DefaultFactorCacheSize),
+		revkeyCache: newFactorCache(DefaultFactorCacheSize),
+	}
 }
 
 //------------------------------------------------------------------------------
@@ -67,6 +82,12 @@ func (f *Factors) Path() string {
 	return f.path
 }
 
+// The combined usage counters for the forward and reverse lookup caches.
+func (f *Factors) CacheStats() FactorCacheStats {
+	a, b := f.keyCache.stats(), f.revkeyCache.stats()
+	return FactorCacheStats{Hits: a.Hits + b.Hits, Misses: a.Misses + b.Misses, Size: a.Size + b.Size}
+}
+
 //------------------------------------------------------------------------------
 //
 // Methods
@@ -102,6 +123,8 @@ func (f *Factors) Open() error {
 
 // Closes the factors database.
 func (f *Factors) Close() {
+	f.keyCache.purge()
+	f.revkeyCache.purge()
 	if f.db != nil {
 		f.db.Close()
 	}
@@ -132,6 +155,11 @@ func (f *Factors) revkey(namespace string, id string, value uint64) string {
 	return fmt.Sprintf("%s>%s:%d", namespace, id, value)
 }
 
+// The key prefix shared by all forward and reverse keys for a namespace/id.
+func (f *Factors) prefix(namespace string, id string) string {
+	return fmt.Sprintf("%s>%s:", namespace, id)
+}
+
 // The sequence key for a given namespace/id.
 func (f *Factors) seqkey(namespace string, id string) string {
 	return fmt.Sprintf("%s>%s!", namespace, id)
@@ -148,14 +176,26 @@ func (f *Factors) Factorize(namespace string, id string, value string, createIfM
 		return 0, nil
 	}
 
+	// Check the cache first.
+	key := f.key(namespace, id, value)
+	if sequence, ok := f.keyCache.get(key); ok {
+		return sequence.(uint64), nil
+	}
+
 	// Otherwise find it in the LevelDB database.
-	data, err := f.db.Get(f.ro, []byte(f.key(namespace, id, value)))
+	version := f.keyCache.currentVersion()
+	data, err := f.db.Get(f.ro, []byte(key))
 	if err != nil {
 		return 0, err
 	}
-	// If key does exist then parse and return it.
+	// If key does exist then parse, cache and return it.
 	if data != nil {
-		return strconv.ParseUint(string(data), 10, 64)
+		sequence, err := strconv.ParseUint(string(data), 10, 64)
+		if err != nil {
+			return 0, err
+		}
+		f.keyCache.add(key, sequence, version)
+		return sequence, nil
 	}
 
 	// Create a new factor if requested.
@@ -163,7 +203,7 @@ func (f *Factors) Factorize(namespace string, id string, value string, createIfM
 		return f.add(namespace, id, value)
 	}
 
-	err = NewFactorNotFound(fmt.Sprintf("skyd.Factors: Factor not found: %v", f.key(namespace, id, value)))
+	err = NewFactorNotFound(fmt.Sprintf("skyd.Factors: Factor not found: %v", key))
 	return 0, err
 }
 
@@ -188,15 +228,21 @@ func (f *Factors) add(namespace string, id string, value string) (uint64, error)
 	}
 
 	// Save lookup and reverse lookup.
-	err = f.db.Put(f.wo, []byte(f.key(namespace, id, value)), []byte(strconv.FormatUint(sequence, 10)))
+	key, revkey := f.key(namespace, id, value), f.revkey(namespace, id, sequence)
+	err = f.db.Put(f.wo, []byte(key), []byte(strconv.FormatUint(sequence, 10)))
 	if err != nil {
 		return 0, err
 	}
-	err = f.db.Put(f.wo, []byte(f.revkey(namespace, id, sequence)), []byte(value))
+	err = f.db.Put(f.wo, []byte(revkey), []byte(value))
 	if err != nil {
 		return 0, err
 	}
 
+	// Invalidate after writing so that concurrent readers can't cache a value
+	// read before the write.
+	f.keyCache.remove(key)
+	f.revkeyCache.remove(revkey)
+
 	return sequence, nil
 }
 
@@ -207,14 +253,22 @@ func (f *Factors) Defactorize(namespace string, id string, value uint64) (string
 		return "", nil
 	}
 
+	// Check the cache first.
+	revkey := f.revkey(namespace, id, value)
+	if str, ok := f.revkeyCache.get(revkey); ok {
+		return str.(string), nil
+	}
+
 	// Find it in LevelDB.
-	data, err := f.db.Get(f.ro, []byte(f.revkey(namespace, id, value)))
+	version := f.revkeyCache.currentVersion()
+	data, err := f.db.Get(f.ro, []byte(revkey))
 	if err != nil {
 		return "", err
 	}
 	if data == nil {
-		return "", fmt.Errorf("skyd.Factors: Value does not exist: %v", f.revkey(namespace, id, value))
+		return "", fmt.Errorf("skyd.Factors: Value does not exist: %v", revkey)
 	}
+	f.revkeyCache.add(revkey, string(data), version)
 	return string(data), nil
 }
 
@@ -248,3 +302,132 @@ func (f *Factors) inc(namespace string, id string) (uint64, error) {
 	}
 	return sequence, nil
 }
+
+//--------------------------------------
+// Enumeration
+//--------------------------------------
+
+// Returns the number of distinct values that have been factorized for an id.
+func (f *Factors) Count(namespace string, id string) (uint64, error) {
+	data, err := f.db.Get(f.ro, []byte(f.seqkey(namespace, id)))
+	if err != nil {
+		return 0, err
+	}
+	if data == nil {
+		return 0, nil
+	}
+	return strconv.ParseUint(string(data), 10, 64)
+}
+
+// Retrieves a sorted page of factors for an id. Only values starting with
+// prefix are returned and the page begins after the value "after". A limit of
+// zero returns all matching factors.
+func (f *Factors) Find(namespace string, id string, prefix string, after string, limit int) ([]*Factor, error) {
+	factors := make([]*Factor, 0)
+	keyPrefix := f.prefix(namespace, id)
+
+	// Start at the search prefix or just after the last value of the previous page.
+	start := []byte(keyPrefix + prefix)
+	if after != "" && after >= prefix {
+		start = append([]byte(f.key(namespace, id, after)), 0)
+	}
+
+	iterator := f.db.NewIterator(f.ro)
+	defer iterator.Close()
+	for iterator.Seek(start); iterator.Valid(); iterator.Next() {
+		key := string(iterator.Key())
+		if !strings.HasPrefix(key, keyPrefix+prefix) {
+			break
+		}
+
+		// Forward and reverse keys share the same range so only keep the
+		// entries whose reverse lookup points back to the same value.
+		value := key[len(keyPrefix):]
+		sequence, err := strconv.ParseUint(string(iterator.Value()), 10, 64)
+		if err != nil {
+			continue
+		}
+		data, err := f.db.Get(f.ro, []byte(f.revkey(namespace, id, sequence)))
+		if err != nil {
+			return nil, err
+		}
+		if string(data) != value {
+			continue
+		}
+
+		factors = append(factors, &Factor{Id: sequence, Value: value})
+		if limit > 0 && len(factors) >= limit {
+			break
+		}
+	}
+
+	return factors, nil
+}
+
+//--------------------------------------
+// Deletion
+//--------------------------------------
+
+// Removes every factor and sequence within a namespace.
+func (f *Factors) DeleteNamespace(namespace string) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	prefix := []byte(namespace + ">")
+	wb := levigo.NewWriteBatch()
+	defer wb.Close()
+
+	iterator := f.db.NewIterator(f.ro)
+	defer iterator.Close()
+	for iterator.Seek(prefix); iterator.Valid(); iterator.Next() {
+		key := iterator.Key()
+		if !bytes.HasPrefix(key, prefix) {
+			break
+		}
+		wb.Delete(key)
+	}
+	err := f.db.Write(f.wo, wb)
+
+	f.keyCache.removePrefix(string(prefix))
+	f.revkeyCache.removePrefix(string(prefix))
+	return err
+}
+
+//--------------------------------------
+// Rename
+//--------------------------------------
+
+// Changes the value of an existing factor while keeping its sequence. The
+// forward and reverse keys are rewritten in a single batch.
+func (f *Factors) Rename(namespace string, id string, oldValue string, newValue string) error {
+	if oldValue == "" || newValue == "" {
+		return errors.New("skyd.Factors: Cannot rename blank factor.")
+	}
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	// Find the existing sequence and make sure the new value isn't taken.
+	sequence, err := f.Factorize(namespace, id, oldValue, false)
+	if err != nil {
+		return err
+	}
+	if _, err = f.Factorize(namespace, id, newValue, false); err == nil {
+		return fmt.Errorf("skyd.Factors: Factor already exists: %v", f.key(namespace, id, newValue))
+	} else if _, ok := err.(*FactorNotFound); !ok {
+		return err
+	}
+
+	// Swap the lookup and update the reverse lookup atomically.
+	wb := levigo.NewWriteBatch()
+	defer wb.Close()
+	wb.Delete([]byte(f.key(namespace, id, oldValue)))
+	wb.Put([]byte(f.key(namespace, id, newValue)), []byte(strconv.FormatUint(sequence, 10)))
+	wb.Put([]byte(f.revkey(namespace, id, sequence)), []byte(newValue))
+	err = f.db.Write(f.wo, wb)
+
+	f.keyCache.remove(f.key(namespace, id, oldValue))
+	f.keyCache.remove(f.key(namespace, id, newValue))
+	f.revkeyCache.remove(f.revkey(namespace, id, sequence))
+	return err
+}
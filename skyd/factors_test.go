@@ -38,3 +38,136 @@ func TestFactorization(t *testing.T) {
 		t.Fatalf("Wrong defactorization: exp: %v, got: %v (%v)", "/about.html", str, err)
 	}
 }
+
+// Ensure that we can page through factors with a prefix.
+func TestFactorsFind(t *testing.T) {
+	path, err := ioutil.TempDir("", "")
+	defer os.RemoveAll(path)
+	path = fmt.Sprintf("%v/factors", path)
+
+	factors := NewFactors(path)
+	defer factors.Close()
+	err = factors.Open()
+	if err != nil {
+		t.Fatalf("Unable to create factors: %v", err)
+	}
+	for _, value := range []string{"/index.html", "/about.html", "/about/team.html", "/contact.html"} {
+		factors.Factorize("foo", "bar", value, true)
+	}
+	factors.Factorize("foo", "baz", "/about.html", true)
+
+	count, err := factors.Count("foo", "bar")
+	if err != nil || count != 4 {
+		t.Fatalf("Wrong count: exp: %v, got: %v (%v)", 4, count, err)
+	}
+
+	list, err := factors.Find("foo", "bar", "/about", "", 0)
+	if err != nil || len(list) != 2 || list[0].Value != "/about.html" || list[0].Id != 2 || list[1].Value != "/about/team.html" {
+		t.Fatalf("Wrong prefix search: %v (%v)", list, err)
+	}
+	list, err = factors.Find("foo", "bar", "", "", 2)
+	if err != nil || len(list) != 2 || list[0].Value != "/about.html" || list[1].Value != "/about/team.html" {
+		t.Fatalf("Wrong first page: %v (%v)", list, err)
+	}
+	list, err = factors.Find("foo", "bar", "", "/about/team.html", 2)
+	if err != nil || len(list) != 2 || list[0].Value != "/contact.html" || list[0].Id != 4 || list[1].Value != "/index.html" {
+		t.Fatalf("Wrong second page: %v (%v)", list, err)
+	}
+}
+
+// Ensure that we can rename a factor.
+func TestFactorsRename(t *testing.T) {
+	path, err := ioutil.TempDir("", "")
+	defer os.RemoveAll(path)
+	path = fmt.Sprintf("%v/factors", path)
+
+	factors := NewFactors(path)
+	defer factors.Close()
+	err = factors.Open()
+	if err != nil {
+		t.Fatalf("Unable to create factors: %v", err)
+	}
+	factors.Factorize("foo", "bar", "/indx.html", true)
+	factors.Factorize("foo", "bar", "/about.html", true)
+
+	if err = factors.Rename("foo", "bar", "/indx.html", "/about.html"); err == nil {
+		t.Fatalf("Expected rename to existing value to fail")
+	}
+	if err = factors.Rename("foo", "bar", "/indx.html", "/index.html"); err != nil {
+		t.Fatalf("Unable to rename factor: %v", err)
+	}
+	num, err := factors.Factorize("foo", "bar", "/index.html", false)
+	if err != nil || num != 1 {
+		t.Fatalf("Wrong factorization: exp: %v, got: %v (%v)", 1, num, err)
+	}
+	if _, err = factors.Factorize("foo", "bar", "/indx.html", false); err == nil {
+		t.Fatalf("Expected old factor to be removed")
+	}
+	str, err := factors.Defactorize("foo", "bar", 1)
+	if err != nil || str != "/index.html" {
+		t.Fatalf("Wrong defactorization: exp: %v, got: %v (%v)", "/index.html", str, err)
+	}
+}
+
+// Ensure that we can delete all factors in a namespace.
+func TestFactorsDeleteNamespace(t *testing.T) {
+	path, err := ioutil.TempDir("", "")
+	defer os.RemoveAll(path)
+	path = fmt.Sprintf("%v/factors", path)
+
+	factors := NewFactors(path)
+	defer factors.Close()
+	err = factors.Open()
+	if err != nil {
+		t.Fatalf("Unable to create factors: %v", err)
+	}
+	factors.Factorize("foo", "bar", "/index.html", true)
+	factors.Factorize("foobar", "bar", "/index.html", true)
+
+	if err = factors.DeleteNamespace("foo"); err != nil {
+		t.Fatalf("Unable to delete namespace: %v", err)
+	}
+	if count, _ := factors.Count("foo", "bar"); count != 0 {
+		t.Fatalf("Wrong count after delete: exp: %v, got: %v", 0, count)
+	}
+	num, err := factors.Factorize("foo", "bar", "/about.html", true)
+	if err != nil || num != 1 {
+		t.Fatalf("Wrong factorization: exp: %v, got: %v (%v)", 1, num, err)
+	}
+	num, err = factors.Factorize("foobar", "bar", "/index.html", false)
+	if err != nil || num != 1 {
+		t.Fatalf("Wrong factorization in other namespace: exp: %v, got: %v (%v)", 1, num, err)
+	}
+}
+
+// Ensure that factor lookups are cached and invalidated on rename.
+func TestFactorsCache(t *testing.T) {
+	path, err := ioutil.TempDir("", "")
+	defer os.RemoveAll(path)
+	path = fmt.Sprintf("%v/factors", path)
+
+	factors := NewFactors(path)
+	defer factors.Close()
+	err = factors.Open()
+	if err != nil {
+		t.Fatalf("Unable to create factors: %v", err)
+	}
+	factors.Factorize("foo", "bar", "/indx.html", true)
+
+	factors.Factorize("foo", "bar", "/indx.html", false)
+	factors.Factorize("foo", "bar", "/indx.html", false)
+	factors.Defactorize("foo", "bar", 1)
+	factors.Defactorize("foo", "bar", 1)
+	if stats := factors.CacheStats(); stats.Hits != 2 || stats.Size != 2 {
+		t.Fatalf("Wrong cache stats: %v", stats)
+	}
+
+	factors.Rename("foo", "bar", "/indx.html", "/index.html")
+	if _, err = factors.Factorize("foo", "bar", "/indx.html", false); err == nil {
+		t.Fatalf("Expected renamed factor to be removed from cache")
+	}
+	str, err := factors.Defactorize("foo", "bar", 1)
+	if err != nil || str != "/index.html" {
+		t.Fatalf("Wrong defactorization: exp: %v, got: %v (%v)", "/index.html", str, err)
+	}
+}
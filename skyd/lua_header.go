@@ -25,6 +25,7 @@ bool sky_cursor_eos(sky_cursor_t *);
 bool sky_lua_cursor_next_event(sky_cursor_t *);
 bool sky_lua_cursor_next_session(sky_cursor_t *);
 bool sky_cursor_set_session_idle(sky_cursor_t *, uint32_t);
+bool sky_cursor_read_state(sky_cursor_t *, sky_lua_event_t *);
 ]])
 ffi.metatype('sky_cursor_t', {
   __index = {
@@ -41,6 +42,7 @@ ffi.metatype('sky_cursor_t', {
     next = function(cursor) return ffi.C.sky_lua_cursor_next_event(cursor) end,
     next_session = function(cursor) return ffi.C.sky_lua_cursor_next_session(cursor) end,
     set_session_idle = function(cursor, seconds) return ffi.C.sky_cursor_set_session_idle(cursor, seconds) end,
+    read_state = function(cursor, event) return ffi.C.sky_cursor_read_state(cursor, event) end,
   }
 })
 ffi.metatype('sky_lua_event_t', {
@@ -62,12 +64,24 @@ end
 function sky_aggregate(_cursor)
   cursor = ffi.cast('sky_cursor_t*', _cursor)
   data = {}
+  sky_object_index = 0
   while cursor:nextObject() do
-    aggregate(cursor, data)
+    if filter == nil or filter(cursor) then
+      sky_object_index = sky_object_index + 1
+      aggregate(cursor, data)
+    end
   end
   return data
 end
 
+-- Returns the current state of the object as an event. Only permanent
+-- properties are available. The same event is reused for every object.
+function sky_object_state(cursor)
+  if sky_state == nil then sky_state = ffi.new('sky_lua_event_t') end
+  cursor:read_state(sky_state)
+  return sky_state
+end
+
 -- The wrapper for the merge.
 function sky_merge(results, data)
   if data ~= nil then
@@ -75,5 +89,116 @@ function sky_merge(results, data)
   end
   return results
 end
+
+-- Returns the UTC offset of a timestamp within a time zone generated by the
+-- query. Zones list the times that the offset changes in ascending order.
+function sky_timezone_offset(zone, timestamp)
+  local times = zone.times
+  if #times == 0 or timestamp < times[1] then return zone.offset end
+  local lo, hi = 1, #times
+  while lo < hi do
+    local mid = math.floor((lo + hi + 1) / 2)
+    if times[mid] <= timestamp then lo = mid else hi = mid - 1 end
+  end
+  return zone.offsets[lo]
+end
+
+-- Groups a timestamp into a calendar unit. Days, hours and weeks return the
+-- local start time of the bucket and weeks start on Monday. Days of the week
+-- start at zero on Sunday.
+function sky_time_bucket(timestamp, unit, zone)
+  if zone ~= nil then timestamp = timestamp + sky_timezone_offset(zone, timestamp) end
+  local days = math.floor(timestamp / 86400)
+  if unit == "day" then return days * 86400
+  elseif unit == "hour" then return math.floor(timestamp / 3600) * 3600
+  elseif unit == "week" then return (days - (days + 3) % 7) * 86400
+  elseif unit == "dow" then return (days + 4) % 7
+  elseif unit == "hod" then return math.floor(timestamp / 3600) % 24
+  end
+end
+
+-- Returns the number of bucket boundaries that a value is greater than or
+-- equal to. Boundaries are in ascending order.
+function sky_bucket(value, bounds)
+  local index = 0
+  for i = 1, #bounds do
+    if value < bounds[i] then break end
+    index = i
+  end
+  return index
+end
+
+-- Returns the child of a path trie node for a value and increments its count.
+-- Children are created as they are needed.
+function sky_path_child(node, value)
+  if node.children == nil then node.children = {} end
+  local child = node.children[value]
+  if child == nil then
+    child = {count=0}
+    node.children[value] = child
+  end
+  child.count = child.count + 1
+  return child
+end
+
+-- A mergeable t-digest sketch used by percentile() and histogram(). Values
+-- are buffered and periodically compressed into weighted centroids.
+SKY_TDIGEST_COMPRESSION = 100
+
+function sky_tdigest_new()
+  return {n=0, centroids={}, buffer={}}
+end
+
+function sky_tdigest_add(digest, value)
+  if digest.n == 0 or value < digest.min then digest.min = value end
+  if digest.n == 0 or value > digest.max then digest.max = value end
+  digest.n = digest.n + 1
+  digest.buffer[#digest.buffer+1] = value
+  if #digest.buffer >= SKY_TDIGEST_COMPRESSION * 5 then
+    sky_tdigest_compress(digest)
+  end
+end
+
+function sky_tdigest_compress(digest)
+  local items = {}
+  for _, c in ipairs(digest.centroids) do items[#items+1] = c end
+  for _, v in ipairs(digest.buffer) do items[#items+1] = {v, 1} end
+  digest.buffer = {}
+  if #items == 0 then return end
+  table.sort(items, function(a, b) return a[1] < b[1] end)
+
+  local total = 0
+  for _, c in ipairs(items) do total = total + c[2] end
+
+  local centroids = {}
+  local current = {items[1][1], items[1][2]}
+  local sofar = 0
+  for i = 2, #items do
+    local item = items[i]
+    local q = (sofar + (current[2] + item[2]) / 2) / total
+    if current[2] + item[2] <= 4 * total * q * (1 - q) / SKY_TDIGEST_COMPRESSION then
+      current[1] = current[1] + (item[1] - current[1]) * item[2] / (current[2] + item[2])
+      current[2] = current[2] + item[2]
+    else
+      sofar = sofar + current[2]
+      centroids[#centroids+1] = current
+      current = {item[1], item[2]}
+    end
+  end
+  centroids[#centroids+1] = current
+  digest.centroids = centroids
+end
+
+function sky_tdigest_merge(a, b)
+  if a == nil or a.n == 0 then return b end
+  if b == nil or b.n == 0 then return a end
+  if b.min < a.min then a.min = b.min end
+  if b.max > a.max then a.max = b.max end
+  a.n = a.n + b.n
+  for _, c in ipairs(b.centroids) do a.centroids[#a.centroids+1] = c end
+  for _, v in ipairs(b.buffer) do a.buffer[#a.buffer+1] = v end
+  sky_tdigest_compress(a)
+  return a
+end
 -- SKY GENERATED CODE END --
 `
@@ -8,6 +8,7 @@ import (
 	"io"
 	"os"
 	"sort"
+	"sync/atomic"
 )
 
 //------------------------------------------------------------------------------
@@ -22,6 +23,7 @@ type PropertyFile struct {
 	path             string
 	properties       map[int64]*Property
 	propertiesByName map[string]*Property
+	version          int64
 }
 
 //------------------------------------------------------------------------------
@@ -58,6 +60,12 @@ func (p *PropertyFile) DbPath() string {
 	return ""
 }
 
+// The schema version. This changes whenever properties are added, removed
+// or saved so that compiled queries can be invalidated.
+func (p *PropertyFile) Version() int64 {
+	return atomic.LoadInt64(&p.version)
+}
+
 //------------------------------------------------------------------------------
 //
 // Methods
@@ -90,6 +98,7 @@ func (p *PropertyFile) CreateProperty(name string, transient bool, dataType stri
 	// Add to the list.
 	p.properties[property.Id] = property
 	p.propertiesByName[property.Name] = property
+	atomic.AddInt64(&p.version, 1)
 
 	return property, nil
 }
@@ -129,6 +138,7 @@ func (p *PropertyFile) DeleteProperty(property *Property) {
 	if property != nil && property.Name != "" {
 		delete(p.properties, property.Id)
 		delete(p.propertiesByName, property.Name)
+		atomic.AddInt64(&p.version, 1)
 	}
 }
 
@@ -136,6 +146,7 @@ func (p *PropertyFile) DeleteProperty(property *Property) {
 func (p *PropertyFile) Reset() {
 	p.properties = make(map[int64]*Property)
 	p.propertiesByName = make(map[string]*Property)
+	atomic.AddInt64(&p.version, 1)
 }
 
 //--------------------------------------
@@ -224,6 +235,8 @@ func (p *PropertyFile) IsOpen() bool {
 
 // Saves the property file to disk.
 func (p *PropertyFile) Save() error {
+	atomic.AddInt64(&p.version, 1)
+
 	// Open the file for writing.
 	file, err := os.Create(p.path)
 	if err != nil {
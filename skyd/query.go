@@ -4,7 +4,11 @@ import (
 	"bytes"
 	"encoding/json"
 	"fmt"
+	"hash/fnv"
 	"io"
+	"math"
+	"strings"
+	"time"
 )
 
 //------------------------------------------------------------------------------
@@ -18,8 +22,18 @@ type Query struct {
 	table           *Table
 	factors         *Factors
 	sequence        int
+	Id              string
 	Steps           QueryStepList
 	SessionIdleTime int
+	StartTime       time.Time
+	EndTime         time.Time
+	Filter          string
+	Sample          float64
+	Timeout         float64
+	MaxStaleness    float64
+	Params          map[string]interface{}
+	startTimeParam  string
+	endTimeParam    string
 }
 
 //------------------------------------------------------------------------------
@@ -34,6 +48,7 @@ func NewQuery(table *Table, factors *Factors) *Query {
 		table:   table,
 		factors: factors,
 		Steps:   make(QueryStepList, 0),
+		Sample:  1,
 	}
 }
 
@@ -69,6 +84,34 @@ func (q *Query) Serialize() map[string]interface{} {
 		"sessionIdleTime": q.SessionIdleTime,
 		"steps":           q.Steps.Serialize(),
 	}
+	if q.startTimeParam != "" {
+		obj["startTime"] = "$" + q.startTimeParam
+	} else if !q.StartTime.IsZero() {
+		obj["startTime"] = q.StartTime.UTC().Format(time.RFC3339)
+	}
+	if q.endTimeParam != "" {
+		obj["endTime"] = "$" + q.endTimeParam
+	} else if !q.EndTime.IsZero() {
+		obj["endTime"] = q.EndTime.UTC().Format(time.RFC3339)
+	}
+	if q.Filter != "" {
+		obj["filter"] = q.Filter
+	}
+	if q.Sample < 1 {
+		obj["sample"] = q.Sample
+	}
+	if q.Id != "" {
+		obj["id"] = q.Id
+	}
+	if q.Timeout > 0 {
+		obj["timeout"] = q.Timeout
+	}
+	if q.MaxStaleness > 0 {
+		obj["maxStaleness"] = q.MaxStaleness
+	}
+	if len(q.Params) > 0 {
+		obj["params"] = q.Params
+	}
 	return obj
 }
 
@@ -83,6 +126,71 @@ func (q *Query) Deserialize(obj map[string]interface{}) error {
 		return fmt.Errorf("Invalid 'sessionIdleTime': %v", obj["sessionIdleTime"])
 	}
 
+	// Deserialize "params".
+	if params, ok := obj["params"].(map[string]interface{}); ok || obj["params"] == nil {
+		for name, value := range params {
+			switch value.(type) {
+			case string, float64, bool:
+			default:
+				return fmt.Errorf("Invalid value for parameter $%s: %v", name, value)
+			}
+		}
+		q.Params = params
+	} else {
+		return fmt.Errorf("Invalid 'params': %v", obj["params"])
+	}
+
+	// Deserialize the time range. Parameters are bound now if they have a
+	// value and are otherwise left unbound until the query is run.
+	if q.StartTime, q.startTimeParam, err = q.deserializeTime(obj, "startTime"); err != nil {
+		return err
+	}
+	if q.EndTime, q.endTimeParam, err = q.deserializeTime(obj, "endTime"); err != nil {
+		return err
+	}
+	if !q.StartTime.IsZero() && !q.EndTime.IsZero() && !q.StartTime.Before(q.EndTime) {
+		return fmt.Errorf("Invalid time range: 'startTime' must be before 'endTime'")
+	}
+
+	// Deserialize "filter".
+	if filter, ok := obj["filter"].(string); ok || obj["filter"] == nil {
+		q.Filter = filter
+	} else {
+		return fmt.Errorf("Invalid 'filter': %v", obj["filter"])
+	}
+
+	// Deserialize "sample".
+	if sample, ok := obj["sample"].(float64); ok && sample > 0 && sample <= 1 {
+		q.Sample = sample
+	} else if obj["sample"] == nil {
+		q.Sample = 1
+	} else {
+		return fmt.Errorf("Invalid 'sample': %v", obj["sample"])
+	}
+
+	// Deserialize "id" and "timeout".
+	if id, ok := obj["id"].(string); ok || obj["id"] == nil {
+		q.Id = id
+	} else {
+		return fmt.Errorf("Invalid 'id': %v", obj["id"])
+	}
+	if timeout, ok := obj["timeout"].(float64); ok && timeout >= 0 {
+		q.Timeout = timeout
+	} else if obj["timeout"] == nil {
+		q.Timeout = 0
+	} else {
+		return fmt.Errorf("Invalid 'timeout': %v", obj["timeout"])
+	}
+
+	// Deserialize "maxStaleness".
+	if maxStaleness, ok := obj["maxStaleness"].(float64); ok && maxStaleness >= 0 {
+		q.MaxStaleness = maxStaleness
+	} else if obj["maxStaleness"] == nil {
+		q.MaxStaleness = 0
+	} else {
+		return fmt.Errorf("Invalid 'maxStaleness': %v", obj["maxStaleness"])
+	}
+
 	q.Steps, err = DeserializeQueryStepList(obj["steps"], q)
 	if err != nil {
 		return err
@@ -90,6 +198,51 @@ func (q *Query) Deserialize(obj map[string]interface{}) error {
 	return nil
 }
 
+// Decodes an optional RFC3339 time or time parameter from an untyped map.
+// Returns the parameter name if the time is a parameter reference.
+func (q *Query) deserializeTime(obj map[string]interface{}, key string) (time.Time, string, error) {
+	str, ok := obj[key].(string)
+	if !ok || !strings.HasPrefix(str, "$") {
+		t, err := deserializeQueryTime(obj, key)
+		return t, "", err
+	}
+
+	name := str[1:]
+	if !isValidParamName(name) {
+		return time.Time{}, "", fmt.Errorf("Invalid '%s': %v", key, str)
+	}
+	t, err := q.bindTimeParam(name)
+	return t, name, err
+}
+
+// Retrieves the time bound to a parameter. Returns a zero time if the
+// parameter is unbound.
+func (q *Query) bindTimeParam(name string) (time.Time, error) {
+	value, ok := q.Params[name]
+	if !ok {
+		return time.Time{}, nil
+	}
+	if str, ok := value.(string); ok {
+		if t, err := time.Parse(time.RFC3339, str); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("Invalid value for parameter $%s: %v", name, value)
+}
+
+// Decodes an optional RFC3339 time from an untyped map.
+func deserializeQueryTime(obj map[string]interface{}, key string) (time.Time, error) {
+	if obj[key] == nil {
+		return time.Time{}, nil
+	}
+	if str, ok := obj[key].(string); ok {
+		if t, err := time.Parse(time.RFC3339, str); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("Invalid '%s': %v", key, obj[key])
+}
+
 //--------------------------------------
 // Encoding
 //--------------------------------------
@@ -123,12 +276,25 @@ func (q *Query) Decode(reader io.Reader) error {
 func (q *Query) Codegen() (string, error) {
 	buffer := new(bytes.Buffer)
 
+	// Time ranges are applied outside of Lua but must be bound before running.
+	if q.startTimeParam != "" && q.StartTime.IsZero() {
+		return "", fmt.Errorf("skyd.Query: Unbound parameter: $%s", q.startTimeParam)
+	}
+	if q.endTimeParam != "" && q.EndTime.IsZero() {
+		return "", fmt.Errorf("skyd.Query: Unbound parameter: $%s", q.endTimeParam)
+	}
+
 	// Generate aggregation functions.
 	str, err := q.Steps.CodegenAggregateFunctions()
 	if err != nil {
 		return "", err
 	}
 	buffer.WriteString(str)
+	str, err = q.CodegenFilterFunction()
+	if err != nil {
+		return "", err
+	}
+	buffer.WriteString(str)
 	buffer.WriteString(q.CodegenAggregateFunction())
 
 	// Generate merge functions.
@@ -173,6 +339,42 @@ func (q *Query) CodegenAggregateFunction() string {
 	return buffer.String()
 }
 
+// Generates the 'filter()' function which checks the object's current state.
+// Returns a blank string if the query has no filter. Objects that don't match
+// are skipped before aggregate() is called so none of their events are
+// decoded. They are still read from the table and their state is decoded to
+// evaluate the filter.
+func (q *Query) CodegenFilterFunction() (string, error) {
+	if q.Filter == "" {
+		return "", nil
+	}
+
+	expr, err := ParseExpression(q.Filter)
+	if err != nil {
+		return "", fmt.Errorf("skyd.Query: Invalid filter: %v", err)
+	}
+	compiler := q.newExpressionCompiler("event")
+	compiler.SetPermanentOnly(true)
+	code, err := compiler.CompileCondition(expr)
+	if err != nil {
+		return "", fmt.Errorf("skyd.Query: %v", err)
+	}
+
+	buffer := new(bytes.Buffer)
+	fmt.Fprintln(buffer, "function filter(cursor)")
+	fmt.Fprintln(buffer, "  local event = sky_object_state(cursor)")
+	fmt.Fprintf(buffer, "  return %s\n", code)
+	fmt.Fprint(buffer, "end\n\n")
+	return buffer.String(), nil
+}
+
+// Creates an expression compiler for the query with its parameters bound.
+func (q *Query) newExpressionCompiler(ref string) *ExpressionCompiler {
+	compiler := NewExpressionCompiler(q.table, q.factors, ref)
+	compiler.SetParams(q.Params)
+	return compiler
+}
+
 // Generates the 'merge()' function.
 func (q *Query) CodegenMergeFunction() string {
 	buffer := new(bytes.Buffer)
@@ -195,6 +397,31 @@ func (q *Query) NextIdentifier() int {
 	return q.sequence
 }
 
+//--------------------------------------
+// Merging
+//--------------------------------------
+
+// Returns whether the aggregate results of the query can be merged in Go
+// instead of through the Lua merge function.
+func (q *Query) NativeMergeable() bool {
+	return q.Steps.NativeMergeable()
+}
+
+// Merges aggregate results in Go. Results are merged into the result map
+// which is returned.
+func (q *Query) Merge(result interface{}, data interface{}) (interface{}, error) {
+	r, ok := result.(map[interface{}]interface{})
+	if !ok {
+		return result, nil
+	}
+	d, ok := data.(map[interface{}]interface{})
+	if !ok {
+		return result, nil
+	}
+	err := q.Steps.MergeNative(r, d)
+	return r, err
+}
+
 //--------------------------------------
 // Factorization
 //--------------------------------------
@@ -204,3 +431,38 @@ func (q *Query) NextIdentifier() int {
 func (q *Query) Defactorize(data interface{}) error {
 	return q.Steps.Defactorize(data)
 }
+
+//--------------------------------------
+// Finalization
+//--------------------------------------
+
+// Converts intermediate aggregate state in the merged results into final
+// values.
+func (q *Query) Finalize(data interface{}) error {
+	return q.Steps.Finalize(data)
+}
+
+//--------------------------------------
+// Sampling
+//--------------------------------------
+
+// Determines if an object is included in a sample. The decision is based on a
+// hash of the encoded object identifier without the table prefix so the same
+// objects are always chosen for a given rate, regardless of the table.
+func sampleObject(objectId []byte, rate float64) bool {
+	if rate >= 1 {
+		return true
+	}
+	h := fnv.New64a()
+	h.Write(objectId)
+
+	// Mix the bits so that similar keys are spread across the range.
+	x := h.Sum64()
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb9fe1a85ec53
+	x ^= x >> 33
+
+	return float64(x) < rate*math.MaxUint64
+}
@@ -0,0 +1,182 @@
+package skyd
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+)
+
+//------------------------------------------------------------------------------
+//
+// Constants
+//
+//------------------------------------------------------------------------------
+
+// The number of query results kept by the cache by default.
+const DefaultQueryCacheSize = 128
+
+//------------------------------------------------------------------------------
+//
+// Typedefs
+//
+//------------------------------------------------------------------------------
+
+// A QueryCache holds the results of recent queries. Results are keyed on the
+// table and the serialized query. A result is fresh until the table is
+// written to and is never used after the table's schema changes. Results are
+// stored encoded as JSON so that callers can't share or modify them.
+type QueryCache struct {
+	mutex   sync.Mutex
+	size    int
+	entries map[string]*queryCacheEntry
+}
+
+// A QueryCacheStamp records the state of a table when a query started.
+type QueryCacheStamp struct {
+	writeVersion  int64
+	schemaVersion int64
+	time          time.Time
+}
+
+type queryCacheEntry struct {
+	table  *Table
+	stamp  QueryCacheStamp
+	result json.RawMessage
+}
+
+//------------------------------------------------------------------------------
+//
+// Constructors
+//
+//------------------------------------------------------------------------------
+
+// NewQueryCache returns a new cache that holds up to size results.
+func NewQueryCache(size int) *QueryCache {
+	return &QueryCache{
+		size:    size,
+		entries: make(map[string]*queryCacheEntry),
+	}
+}
+
+//------------------------------------------------------------------------------
+//
+// Accessors
+//
+//------------------------------------------------------------------------------
+
+// The number of results in the cache.
+func (c *QueryCache) Len() int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return len(c.entries)
+}
+
+//------------------------------------------------------------------------------
+//
+// Methods
+//
+//------------------------------------------------------------------------------
+
+// Records the current state of a table. This should be taken before a query
+// runs so that writes made while it runs invalidate its result.
+func (c *QueryCache) Stamp(table *Table) QueryCacheStamp {
+	return QueryCacheStamp{
+		writeVersion:  table.WriteVersion(),
+		schemaVersion: table.propertyFile.Version(),
+		time:          time.Now(),
+	}
+}
+
+// Retrieves the encoded result of a query. Results for tables that have been
+// written to are returned if they are no older than the query's maximum
+// staleness and are otherwise removed.
+func (c *QueryCache) Get(table *Table, query *Query) (interface{}, bool) {
+	key, err := queryCacheKey(table, query)
+	if err != nil {
+		return nil, false
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	entry := c.entries[key]
+	if entry == nil {
+		return nil, false
+	}
+	if entry.table != table || entry.stamp.schemaVersion != table.propertyFile.Version() {
+		delete(c.entries, key)
+		return nil, false
+	}
+	if entry.stamp.writeVersion != table.WriteVersion() {
+		maxStaleness := time.Duration(query.MaxStaleness * float64(time.Second))
+		if time.Since(entry.stamp.time) > maxStaleness {
+			delete(c.entries, key)
+			return nil, false
+		}
+	}
+	return entry.result, true
+}
+
+// Adds the result of a query to the cache. The oldest result is removed if
+// the cache is full.
+func (c *QueryCache) Put(table *Table, query *Query, stamp QueryCacheStamp, result interface{}) {
+	key, err := queryCacheKey(table, query)
+	if err != nil {
+		return
+	}
+	b, err := json.Marshal(ConvertToStringKeys(result))
+	if err != nil {
+		return
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	// Don't replace a result with an older one.
+	if entry := c.entries[key]; entry != nil && entry.table == table && entry.stamp.time.After(stamp.time) {
+		return
+	}
+	c.entries[key] = &queryCacheEntry{table: table, stamp: stamp, result: json.RawMessage(b)}
+
+	for len(c.entries) > c.size {
+		var oldest string
+		for k, entry := range c.entries {
+			if oldest == "" || entry.stamp.time.Before(c.entries[oldest].stamp.time) {
+				oldest = k
+			}
+		}
+		delete(c.entries, oldest)
+	}
+}
+
+// Removes all results for a table.
+func (c *QueryCache) Purge(tableName string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	for k, entry := range c.entries {
+		if entry.table.Name == tableName {
+			delete(c.entries, k)
+		}
+	}
+}
+
+//------------------------------------------------------------------------------
+//
+// Functions
+//
+//------------------------------------------------------------------------------
+
+// Generates the cache key for a query. Options that don't change the result
+// of the query are left out.
+func queryCacheKey(table *Table, query *Query) (string, error) {
+	obj := query.Serialize()
+	delete(obj, "id")
+	delete(obj, "timeout")
+	delete(obj, "maxStaleness")
+	b, err := json.Marshal(obj)
+	if err != nil {
+		return "", err
+	}
+	return table.Name + "\x00" + string(b), nil
+}
@@ -0,0 +1,99 @@
+package skyd
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+// Ensure that cached results are invalidated by writes and schema changes.
+func TestQueryCacheInvalidation(t *testing.T) {
+	table := createTempTable(t)
+	table.Open()
+	defer table.Close()
+	table.CreateProperty("fruit", false, "string")
+
+	cache := NewQueryCache(DefaultQueryCacheSize)
+	query := NewQuery(table, nil)
+	query.Steps = append(query.Steps, NewQuerySelection(query))
+	if _, ok := cache.Get(table, query); ok {
+		t.Fatalf("Expected cache miss")
+	}
+
+	// Cache a result. Ids and timeouts don't change the key.
+	cache.Put(table, query, cache.Stamp(table), "foo")
+	query.Id, query.Timeout = "q1", 10
+	if result, ok := cache.Get(table, query); !ok || string(result.(json.RawMessage)) != `"foo"` {
+		t.Fatalf("Expected cache hit: %v", result)
+	}
+
+	// Writes make the result stale unless staleness is allowed. Stale
+	// results are removed.
+	table.touch()
+	query.MaxStaleness = 60
+	if result, ok := cache.Get(table, query); !ok || string(result.(json.RawMessage)) != `"foo"` {
+		t.Fatalf("Expected stale cache hit: %v", result)
+	}
+	query.MaxStaleness = 0
+	if _, ok := cache.Get(table, query); ok {
+		t.Fatalf("Expected cache miss after write")
+	}
+	if cache.Len() != 0 {
+		t.Fatalf("Expected stale result to be removed: %v", cache.Len())
+	}
+
+	// Schema changes always invalidate.
+	cache.Put(table, query, cache.Stamp(table), "foo")
+	table.CreateProperty("price", false, "float")
+	if _, ok := cache.Get(table, query); ok {
+		t.Fatalf("Expected cache miss after schema change")
+	}
+	if cache.Len() != 0 {
+		t.Fatalf("Expected empty cache: %v", cache.Len())
+	}
+}
+
+// Ensure that the cache removes the oldest results when full.
+func TestQueryCacheEviction(t *testing.T) {
+	table := createTempTable(t)
+	table.Open()
+	defer table.Close()
+
+	cache := NewQueryCache(2)
+	queries := []*Query{}
+	for i := 0; i < 3; i++ {
+		query := NewQuery(table, nil)
+		query.SessionIdleTime = i
+		queries = append(queries, query)
+		cache.Put(table, query, cache.Stamp(table), i)
+	}
+	if cache.Len() != 2 {
+		t.Fatalf("Expected %v results, got %v", 2, cache.Len())
+	}
+	if _, ok := cache.Get(table, queries[0]); ok {
+		t.Fatalf("Expected oldest result to be evicted")
+	}
+	if result, ok := cache.Get(table, queries[2]); !ok || string(result.(json.RawMessage)) != "2" {
+		t.Fatalf("Expected cache hit: %v", result)
+	}
+
+	cache.Purge(table.Name)
+	if cache.Len() != 0 {
+		t.Fatalf("Expected empty cache: %v", cache.Len())
+	}
+}
+
+// Ensure that callers can't modify cached results.
+func TestQueryCacheCopy(t *testing.T) {
+	table := createTempTable(t)
+	table.Open()
+	defer table.Close()
+
+	cache := NewQueryCache(DefaultQueryCacheSize)
+	query := NewQuery(table, nil)
+	result := map[interface{}]interface{}{"count": 1}
+	cache.Put(table, query, cache.Stamp(table), result)
+	result["count"] = 2
+	if cached, ok := cache.Get(table, query); !ok || string(cached.(json.RawMessage)) != `{"count":1}` {
+		t.Fatalf("Unexpected cached result: %s", cached)
+	}
+}
@@ -4,8 +4,6 @@ import (
 	"bytes"
 	"errors"
 	"fmt"
-	"regexp"
-	"strconv"
 )
 
 //------------------------------------------------------------------------------
@@ -189,39 +187,29 @@ func (c *QueryCondition) CodegenAggregateFunction() (string, error) {
 	}
 	buffer.WriteString(str)
 
-	// Generate main function.
-	fmt.Fprintf(buffer, "function %s(cursor, data)\n", c.FunctionName())
-	if c.WithinRangeStart > 0 {
-		fmt.Fprintf(buffer, "  if cursor:eos() or cursor:eof() then return false end\n")
-	}
-	if c.WithinUnits == QueryConditionUnitSteps {
-		fmt.Fprintf(buffer, "  index = 0\n")
-	}
-	fmt.Fprintf(buffer, "  repeat\n")
-	if c.WithinUnits == QueryConditionUnitSteps {
-		fmt.Fprintf(buffer, "    if index >= %d and index <= %d then\n", c.WithinRangeStart, c.WithinRangeEnd)
-	}
-
-	// Generate conditional expression.
+	// Generate the code that runs when the current event matches.
 	expressionCode, err := c.CodegenExpression()
 	if err != nil {
 		return "", err
 	}
-	fmt.Fprintf(buffer, "      if %s then\n", expressionCode)
-
-	// Call each step function.
+	match := new(bytes.Buffer)
+	fmt.Fprintf(match, "      if %s then\n", expressionCode)
 	for _, step := range c.Steps {
-		fmt.Fprintf(buffer, "        %s(cursor, data)\n", step.FunctionName())
+		fmt.Fprintf(match, "        %s(cursor, data)\n", step.FunctionName())
 	}
+	fmt.Fprintf(match, "        return true\n")
+	fmt.Fprintf(match, "      end\n")
 
-	fmt.Fprintf(buffer, "        return true\n")
-	fmt.Fprintf(buffer, "      end\n")
-	fmt.Fprintf(buffer, "    end\n")
-	if c.WithinUnits == QueryConditionUnitSteps {
-		fmt.Fprintf(buffer, "    if index >= %d then break end\n", c.WithinRangeEnd)
-		fmt.Fprintf(buffer, "    index = index + 1\n")
+	// Generate main function.
+	fmt.Fprintf(buffer, "function %s(cursor, data)\n", c.FunctionName())
+	switch c.WithinUnits {
+	case QueryConditionUnitSessions:
+		c.codegenWithinSessions(buffer, match.String())
+	case QueryConditionUnitSeconds:
+		c.codegenWithinSeconds(buffer, match.String())
+	default:
+		c.codegenWithinSteps(buffer, match.String())
 	}
-	fmt.Fprintf(buffer, "  until not cursor:next()\n")
 	fmt.Fprintf(buffer, "  return false\n")
 
 	// End function definition.
@@ -230,6 +218,56 @@ func (c *QueryCondition) CodegenAggregateFunction() (string, error) {
 	return buffer.String(), nil
 }
 
+// Generates a search over the current event and the following events in the
+// session. The range is the number of events from the current event.
+func (c *QueryCondition) codegenWithinSteps(buffer *bytes.Buffer, match string) {
+	if c.WithinRangeStart > 0 {
+		fmt.Fprintf(buffer, "  if cursor:eos() or cursor:eof() then return false end\n")
+	}
+	fmt.Fprintf(buffer, "  local index = 0\n")
+	fmt.Fprintf(buffer, "  repeat\n")
+	fmt.Fprintf(buffer, "    if index >= %d and index <= %d then\n", c.WithinRangeStart, c.WithinRangeEnd)
+	buffer.WriteString(match)
+	fmt.Fprintf(buffer, "    end\n")
+	fmt.Fprintf(buffer, "    if index >= %d then break end\n", c.WithinRangeEnd)
+	fmt.Fprintf(buffer, "    index = index + 1\n")
+	fmt.Fprintf(buffer, "  until not cursor:next()\n")
+}
+
+// Generates a search over the events in the session that occur within a number
+// of seconds of the current event.
+func (c *QueryCondition) codegenWithinSeconds(buffer *bytes.Buffer, match string) {
+	if c.WithinRangeStart > 0 {
+		fmt.Fprintf(buffer, "  if cursor:eos() or cursor:eof() then return false end\n")
+	}
+	fmt.Fprintf(buffer, "  local start_timestamp = cursor.event.timestamp\n")
+	fmt.Fprintf(buffer, "  repeat\n")
+	fmt.Fprintf(buffer, "    local elapsed = cursor.event.timestamp - start_timestamp\n")
+	fmt.Fprintf(buffer, "    if elapsed > %d then break end\n", c.WithinRangeEnd)
+	fmt.Fprintf(buffer, "    if elapsed >= %d then\n", c.WithinRangeStart)
+	buffer.WriteString(match)
+	fmt.Fprintf(buffer, "    end\n")
+	fmt.Fprintf(buffer, "  until not cursor:next()\n")
+}
+
+// Generates a search that continues across session boundaries. The range is
+// the number of sessions after the current session.
+func (c *QueryCondition) codegenWithinSessions(buffer *bytes.Buffer, match string) {
+	fmt.Fprintf(buffer, "  if cursor:eof() then return false end\n")
+	fmt.Fprintf(buffer, "  local session = 0\n")
+	fmt.Fprintf(buffer, "  while true do\n")
+	fmt.Fprintf(buffer, "    if session >= %d and not cursor:eos() then\n", c.WithinRangeStart)
+	buffer.WriteString(match)
+	fmt.Fprintf(buffer, "    end\n")
+	fmt.Fprintf(buffer, "    if not cursor:next() then\n")
+	fmt.Fprintf(buffer, "      if cursor:eof() or session >= %d then break end\n", c.WithinRangeEnd)
+	fmt.Fprintf(buffer, "      cursor:next_session()\n")
+	fmt.Fprintf(buffer, "      session = session + 1\n")
+	fmt.Fprintf(buffer, "      if not cursor:next() then break end\n")
+	fmt.Fprintf(buffer, "    end\n")
+	fmt.Fprintf(buffer, "  end\n")
+}
+
 // Generates Lua code for the query.
 func (c *QueryCondition) CodegenMergeFunction() (string, error) {
 	buffer := new(bytes.Buffer)
@@ -246,64 +284,30 @@ func (c *QueryCondition) CodegenMergeFunction() (string, error) {
 
 // Generates Lua code for the expression.
 func (c *QueryCondition) CodegenExpression() (string, error) {
-	// Do not transform simple booleans.
-	if c.Expression == "true" || c.Expression == "false" {
-		return c.Expression, nil
-	}
-
-	// Full expressions should be prepended with cursor's event reference.
-	r, _ := regexp.Compile(`^ *(\w+) *(==) *(?:"([^"]*)"|'([^']*)'|(\d+(?:\.\d+)?)|(true|false)) *$`)
-	m := r.FindSubmatch([]byte(c.Expression))
-	if m == nil {
-		return "", fmt.Errorf("skyd.QueryCondition: Invalid expression: %v", c.Expression)
+	expr, err := ParseExpression(c.Expression)
+	if err != nil {
+		return "", fmt.Errorf("skyd.QueryCondition: Invalid expression: %v", err)
 	}
 
-	// Find the property.
-	property := c.query.table.propertyFile.GetPropertyByName(string(m[1]))
-	if property == nil {
-		return "", fmt.Errorf("skyd.QueryCondition: Property not found: %v", string(m[1]))
+	code, err := c.query.newExpressionCompiler("cursor.event").CompileCondition(expr)
+	if err != nil {
+		return "", fmt.Errorf("skyd.QueryCondition: %v", err)
 	}
+	return code, nil
+}
 
-	// Validate the expression value.
-	var value string
-	switch property.DataType {
-	case FactorDataType, StringDataType:
-		// Validate string value.
-		var stringValue string
-		if m[3] != nil {
-			stringValue = string(m[3])
-		} else if m[4] != nil {
-			stringValue = string(m[4])
-		} else {
-			return "", fmt.Errorf("skyd.QueryCondition: Expression value must be a string literal for string and factor properties: %v", c.Expression)
-		}
-
-		// Convert factors.
-		if property.DataType == FactorDataType {
-			sequence, err := c.query.factors.Factorize(c.query.table.Name, property.Name, stringValue, false)
-			if err != nil {
-				return "", err
-			} else {
-				value = strconv.FormatUint(sequence, 10)
-			}
-		} else {
-			value = fmt.Sprintf(`"%s"`, stringValue)
-		}
-
-	case IntegerDataType, FloatDataType:
-		if m[5] == nil {
-			return "", fmt.Errorf("skyd.QueryCondition: Expression value must be a numeric literal for integer and float properties: %v", c.Expression)
-		}
-		value = string(m[5])
+//--------------------------------------
+// Merging
+//--------------------------------------
 
-	case BooleanDataType:
-		if m[6] == nil {
-			return "", fmt.Errorf("skyd.QueryCondition: Expression value must be a boolean literal for boolean properties: %v", c.Expression)
-		}
-		value = string(m[6])
-	}
+// Returns whether the child steps can be merged in Go.
+func (c *QueryCondition) NativeMergeable() bool {
+	return c.Steps.NativeMergeable()
+}
 
-	return fmt.Sprintf("cursor.event:%s() %s %s", m[1], m[2], value), nil
+// Merges the aggregate results of child steps in Go.
+func (c *QueryCondition) MergeNative(result map[interface{}]interface{}, data map[interface{}]interface{}) error {
+	return c.Steps.MergeNative(result, data)
 }
 
 //--------------------------------------
@@ -314,3 +318,12 @@ func (c *QueryCondition) CodegenExpression() (string, error) {
 func (c *QueryCondition) Defactorize(data interface{}) error {
 	return c.Steps.Defactorize(data)
 }
+
+//--------------------------------------
+// Finalization
+//--------------------------------------
+
+// Finalizes the merged results of child steps.
+func (c *QueryCondition) Finalize(data interface{}) error {
+	return c.Steps.Finalize(data)
+}
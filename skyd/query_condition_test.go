@@ -0,0 +1,157 @@
+package skyd
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+// Ensure that condition expressions are type checked and compiled to Lua.
+func TestQueryConditionCodegenExpression(t *testing.T) {
+	table := createTempTable(t)
+	table.Open()
+	defer table.Close()
+	table.CreateProperty("action", false, FactorDataType)
+	table.CreateProperty("path", true, StringDataType)
+	table.CreateProperty("price", true, FloatDataType)
+	table.CreateProperty("member", false, BooleanDataType)
+
+	path, _ := ioutil.TempDir("", "")
+	defer os.RemoveAll(path)
+	factors := NewFactors(fmt.Sprintf("%v/factors", path))
+	factors.Open()
+	defer factors.Close()
+	factors.Factorize("test", "action", "checkout", true)
+	factors.Factorize("test", "action", "signup", true)
+	factors.Factorize("test", "action", "search", true)
+
+	tests := []struct {
+		expression string
+		exp        string
+	}{
+		{`true`, `true`},
+		{`action == 'signup'`, `(cursor.event:action() == 2)`},
+		{`'signup' != action`, `(cursor.event:action() ~= 2)`},
+		{`action == 'unknown'`, `false`},
+		{`action in ('checkout', 'unknown', 'search')`, `((cursor.event:action() == 1) or (cursor.event:action() == 3))`},
+		{`action startswith 's'`, `(cursor.event:action() == 3 or cursor.event:action() == 2)`},
+		{`path startswith "/a\"b"`, `(string.sub(cursor.event:path(), 1, 4) == "/a\"b")`},
+		{`price >= 10 and not member`, `((cursor.event:price() >= 10) and (not cursor.event:member()))`},
+		{`path == "event:price"`, `(cursor.event:path() == "event\058price")`},
+	}
+	for i, test := range tests {
+		q := NewQuery(table, factors)
+		c := NewQueryCondition(q)
+		c.Expression = test.expression
+		code, err := c.CodegenExpression()
+		if err != nil {
+			t.Fatalf("[%d] Unable to codegen %q: %v", i, test.expression, err)
+		}
+		if code != test.exp {
+			t.Fatalf("[%d] Wrong codegen for %q:\nexp: %s\ngot: %s", i, test.expression, test.exp, code)
+		}
+	}
+}
+
+// Ensure that invalid condition expressions are rejected.
+func TestQueryConditionCodegenExpressionErrors(t *testing.T) {
+	table := createTempTable(t)
+	table.Open()
+	defer table.Close()
+	table.CreateProperty("action", false, FactorDataType)
+	table.CreateProperty("price", true, FloatDataType)
+
+	tests := []struct {
+		expression string
+		exp        string
+	}{
+		{`foo == 1`, `skyd.QueryCondition: Property not found: foo`},
+		{`price == 'cheap'`, `skyd.QueryCondition: Cannot compare float to string: price == "cheap"`},
+		{`action < 'x'`, `skyd.QueryCondition: Factor properties can only be compared for equality: action < "x"`},
+		{`price`, `skyd.QueryCondition: Expression must be a boolean: price`},
+		{`price ==`, `skyd.QueryCondition: Invalid expression: Unexpected end of expression at char 9`},
+	}
+	for i, test := range tests {
+		q := NewQuery(table, nil)
+		c := NewQueryCondition(q)
+		c.Expression = test.expression
+		_, err := c.CodegenExpression()
+		if err == nil || err.Error() != test.exp {
+			t.Fatalf("[%d] Wrong error for %q:\nexp: %s\ngot: %v", i, test.expression, test.exp, err)
+		}
+	}
+}
+
+// Ensure that parameters are bound and type checked when compiled.
+func TestQueryConditionCodegenParams(t *testing.T) {
+	table := createTempTable(t)
+	table.Open()
+	defer table.Close()
+	table.CreateProperty("action", false, FactorDataType)
+	table.CreateProperty("path", true, StringDataType)
+	table.CreateProperty("price", true, FloatDataType)
+
+	path, _ := ioutil.TempDir("", "")
+	defer os.RemoveAll(path)
+	factors := NewFactors(fmt.Sprintf("%v/factors", path))
+	factors.Open()
+	defer factors.Close()
+	factors.Factorize("test", "action", "checkout", true)
+	factors.Factorize("test", "action", "signup", true)
+
+	params := map[string]interface{}{"action": "signup", "min": float64(10), "prefix": "/blog", "other": "unknown"}
+	tests := []struct {
+		expression string
+		exp        string
+	}{
+		{`action == $action and price >= $min`, `((cursor.event:action() == 2) and (cursor.event:price() >= 10))`},
+		{`action in ($action, $other)`, `((cursor.event:action() == 2))`},
+		{`path startswith $prefix`, `(string.sub(cursor.event:path(), 1, 5) == "/blog")`},
+		{`price == $action`, `skyd.QueryCondition: Cannot compare float to string: price == $action`},
+		{`action == $min`, `skyd.QueryCondition: Factor properties can only be compared to string literals: action == $min`},
+		{`price > $max`, `skyd.QueryCondition: Unbound parameter: $max`},
+	}
+	for i, test := range tests {
+		q := NewQuery(table, factors)
+		q.Params = params
+		c := NewQueryCondition(q)
+		c.Expression = test.expression
+		code, err := c.CodegenExpression()
+		if err != nil {
+			code = err.Error()
+		}
+		if code != test.exp {
+			t.Fatalf("[%d] Wrong codegen for %q:\nexp: %s\ngot: %s", i, test.expression, test.exp, code)
+		}
+	}
+}
+
+// Ensure that prefix matches on factors are limited.
+func TestQueryConditionCodegenFactorPrefixLimit(t *testing.T) {
+	table := createTempTable(t)
+	table.Open()
+	defer table.Close()
+	table.CreateProperty("action", false, FactorDataType)
+
+	path, _ := ioutil.TempDir("", "")
+	defer os.RemoveAll(path)
+	factors := NewFactors(fmt.Sprintf("%v/factors", path))
+	factors.Open()
+	defer factors.Close()
+	for i := 0; i < MaxFactorPrefixMatches; i++ {
+		factors.Factorize("test", "action", fmt.Sprintf("a%d", i), true)
+	}
+
+	c := NewQueryCondition(NewQuery(table, factors))
+	c.Expression = `action startswith 'a'`
+	if _, err := c.CodegenExpression(); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	factors.Factorize("test", "action", "b", true)
+	factors.Factorize("test", "action", "a_overflow", true)
+	exp := fmt.Sprintf(`skyd.QueryCondition: Prefix matches more than %d values: (action startswith "a")`, MaxFactorPrefixMatches)
+	if _, err := c.CodegenExpression(); err == nil || err.Error() != exp {
+		t.Fatalf("Wrong error:\nexp: %s\ngot: %v", exp, err)
+	}
+}
@@ -0,0 +1,359 @@
+package skyd
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+//------------------------------------------------------------------------------
+//
+// Constants
+//
+//------------------------------------------------------------------------------
+
+// The pseudo-property used to group by the event timestamp.
+const QueryDimensionTimestamp = "@timestamp"
+
+// Units available to timestamp dimensions.
+const (
+	QueryDimensionDay       = "day"
+	QueryDimensionHour      = "hour"
+	QueryDimensionWeek      = "week"
+	QueryDimensionDayOfWeek = "dow"
+	QueryDimensionHourOfDay = "hod"
+)
+
+// Modifiers available to numeric property dimensions.
+const (
+	QueryDimensionBin    = "bin"
+	QueryDimensionBucket = "bucket"
+)
+
+// The range of time zone transitions that are generated for queries.
+const (
+	timezoneTransitionsStart = 0
+	timezoneTransitionsEnd   = 4102444800 // 2100-01-01
+)
+
+// Time zone transitions that have already been found, keyed by location name.
+var timezoneTransitionsCache = struct {
+	sync.Mutex
+	m map[string]*timezoneTransitionSet
+}{m: make(map[string]*timezoneTransitionSet)}
+
+//------------------------------------------------------------------------------
+//
+// Typedefs
+//
+//------------------------------------------------------------------------------
+
+// A timezoneTransitionSet holds the UTC offset of a location at the start of
+// the transition range and each change to it after that.
+type timezoneTransitionSet struct {
+	base    int
+	times   []int64
+	offsets []int
+}
+
+// A queryDimension is a parsed selection dimension. Dimensions are either a
+// property name or a property followed by a modifier and its arguments, such
+// as "@timestamp:day(America/New_York)" or "price:bin(10)".
+type queryDimension struct {
+	text     string
+	name     string
+	modifier string
+	args     []string
+	property *Property
+	location *time.Location
+	width    float64
+	bounds   []float64
+}
+
+//------------------------------------------------------------------------------
+//
+// Functions
+//
+//------------------------------------------------------------------------------
+
+// Parses a dimension and validates it against the table's properties.
+func parseQueryDimension(table *Table, text string) (*queryDimension, error) {
+	d := &queryDimension{text: text, name: text}
+
+	// Split off the modifier and its arguments.
+	if index := strings.Index(text, ":"); index != -1 {
+		d.name, d.modifier = text[:index], text[index+1:]
+		if index := strings.Index(d.modifier, "("); index != -1 {
+			if !strings.HasSuffix(d.modifier, ")") {
+				return nil, fmt.Errorf("skyd.QuerySelection: Invalid dimension: %s", text)
+			}
+			for _, arg := range strings.Split(d.modifier[index+1:len(d.modifier)-1], ",") {
+				d.args = append(d.args, strings.TrimSpace(arg))
+			}
+			d.modifier = d.modifier[:index]
+		}
+	}
+
+	if d.name == QueryDimensionTimestamp {
+		return d, d.parseTimestamp()
+	}
+
+	// Look up the property.
+	if table != nil && table.propertyFile != nil {
+		if d.property = table.propertyFile.GetPropertyByName(d.name); d.property == nil {
+			return nil, fmt.Errorf("skyd.QuerySelection: Property not found: %s", d.name)
+		}
+	}
+	switch d.modifier {
+	case "":
+	case QueryDimensionBin, QueryDimensionBucket:
+		return d, d.parseNumeric()
+	default:
+		return nil, fmt.Errorf("skyd.QuerySelection: Invalid dimension modifier: %s", text)
+	}
+
+	return d, nil
+}
+
+// Finds the times that the UTC offset of a location changes. Results are
+// cached by location name since finding them requires a full scan. The
+// returned slices must not be modified.
+func timezoneTransitions(loc *time.Location) (int, []int64, []int) {
+	timezoneTransitionsCache.Lock()
+	defer timezoneTransitionsCache.Unlock()
+
+	name := loc.String()
+	if t, ok := timezoneTransitionsCache.m[name]; ok {
+		return t.base, t.times, t.offsets
+	}
+	base, times, offsets := findTimezoneTransitions(loc)
+	timezoneTransitionsCache.m[name] = &timezoneTransitionSet{base: base, times: times, offsets: offsets}
+	return base, times, offsets
+}
+
+// Scans every day for changes in the UTC offset of a location and then finds
+// the exact second of each change with a binary search.
+func findTimezoneTransitions(loc *time.Location) (int, []int64, []int) {
+	offsetAt := func(t int64) int {
+		_, offset := time.Unix(t, 0).In(loc).Zone()
+		return offset
+	}
+
+	base := offsetAt(timezoneTransitionsStart)
+	times, offsets := []int64{}, []int{}
+	offset := base
+	for t := int64(timezoneTransitionsStart); t < timezoneTransitionsEnd; t += 86400 {
+		next := offsetAt(t + 86400)
+		if next == offset {
+			continue
+		}
+		lo, hi := t, t+86400
+		for hi-lo > 1 {
+			if mid := (lo + hi) / 2; offsetAt(mid) == offset {
+				lo = mid
+			} else {
+				hi = mid
+			}
+		}
+		times, offsets = append(times, hi), append(offsets, next)
+		offset = next
+	}
+
+	return base, times, offsets
+}
+
+//------------------------------------------------------------------------------
+//
+// Methods
+//
+//------------------------------------------------------------------------------
+
+//--------------------------------------
+// Parsing
+//--------------------------------------
+
+// Validates the unit and optional time zone of a timestamp dimension.
+func (d *queryDimension) parseTimestamp() error {
+	switch d.modifier {
+	case QueryDimensionDay, QueryDimensionHour, QueryDimensionWeek, QueryDimensionDayOfWeek, QueryDimensionHourOfDay:
+	default:
+		return fmt.Errorf("skyd.QuerySelection: Invalid timestamp unit: %s", d.text)
+	}
+
+	switch len(d.args) {
+	case 0:
+	case 1:
+		location, err := time.LoadLocation(d.args[0])
+		if err != nil {
+			return fmt.Errorf("skyd.QuerySelection: Invalid time zone: %s", d.args[0])
+		}
+		d.location = location
+	default:
+		return fmt.Errorf("skyd.QuerySelection: Invalid dimension: %s", d.text)
+	}
+	return nil
+}
+
+// Validates the width of a bin or the boundaries of buckets. Boundaries must
+// be in ascending order.
+func (d *queryDimension) parseNumeric() error {
+	if d.property != nil && !isNumericDataType(d.property.DataType) {
+		return fmt.Errorf("skyd.QuerySelection: Numeric property required: %s", d.text)
+	}
+
+	values := []float64{}
+	for _, arg := range d.args {
+		value, err := strconv.ParseFloat(arg, 64)
+		if err != nil {
+			return fmt.Errorf("skyd.QuerySelection: Invalid dimension: %s", d.text)
+		}
+		values = append(values, value)
+	}
+
+	switch d.modifier {
+	case QueryDimensionBin:
+		if len(values) != 1 || values[0] <= 0 {
+			return fmt.Errorf("skyd.QuerySelection: Invalid bin width: %s", d.text)
+		}
+		d.width = values[0]
+	case QueryDimensionBucket:
+		for i := range values {
+			if i > 0 && values[i] <= values[i-1] {
+				return fmt.Errorf("skyd.QuerySelection: Bucket boundaries must be ascending: %s", d.text)
+			}
+		}
+		if len(values) == 0 {
+			return fmt.Errorf("skyd.QuerySelection: Invalid dimension: %s", d.text)
+		}
+		d.bounds = values
+	}
+	return nil
+}
+
+//--------------------------------------
+// Code Generation
+//--------------------------------------
+
+// Generates a Lua table of constants used by the dimension, such as a time
+// zone or bucket boundaries. Returns a blank string if none are needed.
+func (d *queryDimension) codegenTable() string {
+	if d.bounds != nil {
+		values := []string{}
+		for _, bound := range d.bounds {
+			values = append(values, formatFloat(bound))
+		}
+		return "{" + strings.Join(values, ",") + "}"
+	}
+	if d.location == nil {
+		return ""
+	}
+
+	base, times, offsets := timezoneTransitions(d.location)
+	buffer := new(bytes.Buffer)
+	fmt.Fprintf(buffer, "{offset=%d, times={", base)
+	for i, t := range times {
+		if i > 0 {
+			buffer.WriteString(",")
+		}
+		fmt.Fprintf(buffer, "%d", t)
+	}
+	buffer.WriteString("}, offsets={")
+	for i, offset := range offsets {
+		if i > 0 {
+			buffer.WriteString(",")
+		}
+		fmt.Fprintf(buffer, "%d", offset)
+	}
+	buffer.WriteString("}}")
+	return buffer.String()
+}
+
+// Generates the Lua expression for the dimension's value. The table is the
+// name of the variable holding the dimension's constants, if any.
+func (d *queryDimension) codegenExpression(table string) string {
+	if d.name == QueryDimensionTimestamp {
+		if table == "" {
+			table = "nil"
+		}
+		return fmt.Sprintf("sky_time_bucket(cursor.event.timestamp, %s, %s)", luaString(d.modifier), table)
+	}
+
+	value := fmt.Sprintf("cursor.event:%s()", d.name)
+	switch d.modifier {
+	case QueryDimensionBin:
+		return fmt.Sprintf("(math.floor(%s / %s) * %s)", value, formatFloat(d.width), formatFloat(d.width))
+	case QueryDimensionBucket:
+		return fmt.Sprintf("sky_bucket(%s, %s)", value, table)
+	}
+	return value
+}
+
+// Generates the Lua table index for the dimension, such as ".state" or
+// "[\"@timestamp:day\"]".
+func (d *queryDimension) codegenIndex() string {
+	if d.text == d.name && d.name != QueryDimensionTimestamp {
+		return "." + d.name
+	}
+	return "[" + luaString(d.text) + "]"
+}
+
+//--------------------------------------
+// Labels
+//--------------------------------------
+
+// Converts a bucket key generated by Lua into a readable label. Day and week
+// buckets are labeled by date and hour buckets by date and hour. Numeric
+// buckets are labeled by their range, such as "[10,20)" or "[100,inf)".
+func (d *queryDimension) label(key interface{}) interface{} {
+	value, ok := castFloat64(key)
+	if !ok {
+		return key
+	}
+
+	switch d.modifier {
+	case QueryDimensionBin:
+		return fmt.Sprintf("[%s,%s)", formatFloat(value), formatFloat(value+d.width))
+	case QueryDimensionBucket:
+		index := int(value)
+		switch {
+		case index <= 0:
+			return fmt.Sprintf("[-inf,%s)", formatFloat(d.bounds[0]))
+		case index >= len(d.bounds):
+			return fmt.Sprintf("[%s,inf)", formatFloat(d.bounds[len(d.bounds)-1]))
+		}
+		return fmt.Sprintf("[%s,%s)", formatFloat(d.bounds[index-1]), formatFloat(d.bounds[index]))
+	}
+	if d.name != QueryDimensionTimestamp {
+		return key
+	}
+
+	t := time.Unix(int64(value), 0).UTC()
+	switch d.modifier {
+	case QueryDimensionDay, QueryDimensionWeek:
+		return t.Format("2006-01-02")
+	case QueryDimensionHour:
+		return t.Format("2006-01-02T15:00")
+	}
+	return int64(value)
+}
+
+// Converts a key generated by Lua into its final form. Factor keys are
+// converted back to their strings and all other keys are labeled.
+func (d *queryDimension) defactorize(q *Query, key interface{}) (interface{}, error) {
+	if d.property == nil || d.property.DataType != FactorDataType {
+		return d.label(key), nil
+	}
+	sequence, ok := normalize(key).(int64)
+	if !ok {
+		return nil, fmt.Errorf("Invalid factor sequence: %v", key)
+	}
+	return q.factors.Defactorize(q.table.Name, d.property.Name, uint64(sequence))
+}
+
+// Formats a number without trailing zeros.
+func formatFloat(value float64) string {
+	return strconv.FormatFloat(value, 'f', -1, 64)
+}
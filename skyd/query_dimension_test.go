@@ -0,0 +1,66 @@
+package skyd
+
+import (
+	"testing"
+	"time"
+)
+
+// Ensure that invalid dimensions are rejected.
+func TestParseQueryDimensionErrors(t *testing.T) {
+	table := createTempTable(t)
+	table.Open()
+	defer table.Close()
+	table.CreateProperty("state", false, FactorDataType)
+	table.CreateProperty("price", true, FloatDataType)
+
+	tests := []struct {
+		text string
+		exp  string
+	}{
+		{`foo`, `skyd.QuerySelection: Property not found: foo`},
+		{`state:day`, `skyd.QuerySelection: Invalid dimension modifier: state:day`},
+		{`@timestamp`, `skyd.QuerySelection: Invalid timestamp unit: @timestamp`},
+		{`@timestamp:month`, `skyd.QuerySelection: Invalid timestamp unit: @timestamp:month`},
+		{`@timestamp:day(Mars/Olympus)`, `skyd.QuerySelection: Invalid time zone: Mars/Olympus`},
+		{`@timestamp:day(UTC`, `skyd.QuerySelection: Invalid dimension: @timestamp:day(UTC`},
+		{`state:bin(10)`, `skyd.QuerySelection: Numeric property required: state:bin(10)`},
+		{`price:bin(0)`, `skyd.QuerySelection: Invalid bin width: price:bin(0)`},
+		{`price:bin(x)`, `skyd.QuerySelection: Invalid dimension: price:bin(x)`},
+		{`price:bucket(10, 5)`, `skyd.QuerySelection: Bucket boundaries must be ascending: price:bucket(10, 5)`},
+	}
+	for i, test := range tests {
+		_, err := parseQueryDimension(table, test.text)
+		if err == nil || err.Error() != test.exp {
+			t.Fatalf("[%d] Wrong error for %q:\nexp: %s\ngot: %v", i, test.text, test.exp, err)
+		}
+	}
+}
+
+// Ensure that time zone transitions are found to the second.
+func TestTimezoneTransitions(t *testing.T) {
+	loc, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Skip("Time zone database not available")
+	}
+	base, times, offsets := timezoneTransitions(loc)
+	if base != -18000 {
+		t.Fatalf("Invalid base offset: %v", base)
+	}
+
+	// Transitions are cached for the location.
+	loc, _ = time.LoadLocation("America/New_York")
+	if _, cached, _ := timezoneTransitions(loc); len(cached) == 0 || &cached[0] != &times[0] {
+		t.Fatalf("Expected cached transitions")
+	}
+
+	// DST started at 2012-03-11 07:00 UTC.
+	for i, tm := range times {
+		if tm == 1331449200 {
+			if offsets[i] != -14400 {
+				t.Fatalf("Invalid offset: %v", offsets[i])
+			}
+			return
+		}
+	}
+	t.Fatalf("Transition not found")
+}
@@ -0,0 +1,351 @@
+package skyd
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+)
+
+//------------------------------------------------------------------------------
+//
+// Typedefs
+//
+//------------------------------------------------------------------------------
+
+// A funnel step counts the objects that reach each of an ordered list of
+// stages. Each stage is a condition expression that must match an event after
+// the event matched by the previous stage. If a window is set then every stage
+// must occur within that many seconds of the first stage.
+type QueryFunnel struct {
+	query             *Query
+	functionName      string
+	mergeFunctionName string
+	Name              string
+	Stages            []string
+	Within            int
+	Dimension         string
+}
+
+//------------------------------------------------------------------------------
+//
+// Constructors
+//
+//------------------------------------------------------------------------------
+
+// Creates a new funnel.
+func NewQueryFunnel(query *Query) *QueryFunnel {
+	id := query.NextIdentifier()
+	return &QueryFunnel{
+		query:             query,
+		functionName:      fmt.Sprintf("a%d", id),
+		mergeFunctionName: fmt.Sprintf("m%d", id),
+	}
+}
+
+//------------------------------------------------------------------------------
+//
+// Accessors
+//
+//------------------------------------------------------------------------------
+
+// Retrieves the query this funnel is associated with.
+func (f *QueryFunnel) Query() *Query {
+	return f.query
+}
+
+// Retrieves the function name used during codegen.
+func (f *QueryFunnel) FunctionName() string {
+	return f.functionName
+}
+
+// Retrieves the merge function name used during codegen.
+func (f *QueryFunnel) MergeFunctionName() string {
+	return f.mergeFunctionName
+}
+
+// Retrieves the child steps.
+func (f *QueryFunnel) GetSteps() QueryStepList {
+	return []QueryStep{}
+}
+
+//------------------------------------------------------------------------------
+//
+// Methods
+//
+//------------------------------------------------------------------------------
+
+//--------------------------------------
+// Serialization
+//--------------------------------------
+
+// Encodes a query funnel into an untyped map.
+func (f *QueryFunnel) Serialize() map[string]interface{} {
+	return map[string]interface{}{
+		"type":      QueryStepTypeFunnel,
+		"name":      f.Name,
+		"stages":    f.Stages,
+		"within":    f.Within,
+		"dimension": f.Dimension,
+	}
+}
+
+// Decodes a query funnel from an untyped map.
+func (f *QueryFunnel) Deserialize(obj map[string]interface{}) error {
+	if obj == nil {
+		return errors.New("skyd.QueryFunnel: Unable to deserialize nil.")
+	}
+	if obj["type"] != QueryStepTypeFunnel {
+		return fmt.Errorf("skyd.QueryFunnel: Invalid step type: %v", obj["type"])
+	}
+
+	// Deserialize "name".
+	if name, ok := obj["name"].(string); ok && name != "" {
+		f.Name = name
+	} else {
+		return fmt.Errorf("skyd.QueryFunnel: Invalid name: %v", obj["name"])
+	}
+
+	// Deserialize "stages".
+	if stages, ok := obj["stages"].([]interface{}); ok && len(stages) > 0 {
+		f.Stages = []string{}
+		for _, stage := range stages {
+			if str, ok := stage.(string); ok {
+				f.Stages = append(f.Stages, str)
+			} else {
+				return fmt.Errorf("skyd.QueryFunnel: Invalid stage: %v", stage)
+			}
+		}
+	} else {
+		return fmt.Errorf("skyd.QueryFunnel: Invalid stages: %v", obj["stages"])
+	}
+
+	// Deserialize "within".
+	if within, ok := obj["within"].(float64); ok && within >= 0 {
+		f.Within = int(within)
+	} else if obj["within"] == nil {
+		f.Within = 0
+	} else {
+		return fmt.Errorf("skyd.QueryFunnel: Invalid 'within': %v", obj["within"])
+	}
+
+	// Deserialize "dimension".
+	if dimension, ok := obj["dimension"].(string); ok {
+		f.Dimension = dimension
+	} else if obj["dimension"] == nil {
+		f.Dimension = ""
+	} else {
+		return fmt.Errorf("skyd.QueryFunnel: Invalid dimension: %v", obj["dimension"])
+	}
+
+	return nil
+}
+
+// Parses the dimension of the funnel. Returns nil if there is no dimension.
+func (f *QueryFunnel) parseDimension() (*queryDimension, error) {
+	if f.Dimension == "" {
+		return nil, nil
+	}
+	return parseQueryDimension(f.query.table, f.Dimension)
+}
+
+//--------------------------------------
+// Code Generation
+//--------------------------------------
+
+// Generates Lua code for the funnel aggregation. The funnel reads the rest of
+// the object's events and tracks the latest start time of a chain that has
+// reached each stage. Stages are checked in reverse so a single event cannot
+// advance a chain more than one stage.
+func (f *QueryFunnel) CodegenAggregateFunction() (string, error) {
+	buffer := new(bytes.Buffer)
+
+	dimension, err := f.parseDimension()
+	if err != nil {
+		return "", err
+	}
+
+	// Compile stage expressions.
+	compiler := f.query.newExpressionCompiler("cursor.event")
+	conditions := []string{}
+	for _, stage := range f.Stages {
+		expr, err := ParseExpression(stage)
+		if err != nil {
+			return "", fmt.Errorf("skyd.QueryFunnel: Invalid expression: %v", err)
+		}
+		code, err := compiler.CompileCondition(expr)
+		if err != nil {
+			return "", fmt.Errorf("skyd.QueryFunnel: %v", err)
+		}
+		conditions = append(conditions, code)
+	}
+
+	// Generate constant table used by the dimension.
+	dimensionCode := "true"
+	if dimension != nil {
+		table := ""
+		if code := dimension.codegenTable(); code != "" {
+			table = fmt.Sprintf("%s_d0", f.FunctionName())
+			fmt.Fprintf(buffer, "local %s = %s\n", table, code)
+		}
+		dimensionCode = dimension.codegenExpression(table)
+	}
+
+	// Generate main function.
+	fmt.Fprintf(buffer, "function %s(cursor, data)\n", f.FunctionName())
+	fmt.Fprintf(buffer, "  local starts, dimensions = {}, {}\n")
+	fmt.Fprintf(buffer, "  repeat\n")
+	fmt.Fprintf(buffer, "    repeat\n")
+	fmt.Fprintf(buffer, "      local timestamp = cursor.event.timestamp\n")
+	for i := len(conditions) - 1; i > 0; i-- {
+		within := ""
+		if f.Within > 0 {
+			within = fmt.Sprintf(" and timestamp - starts[%d] <= %d", i, f.Within)
+		}
+		fmt.Fprintf(buffer, "      if starts[%d] ~= nil%s and %s then\n", i, within, conditions[i])
+		fmt.Fprintf(buffer, "        starts[%d], dimensions[%d] = starts[%d], dimensions[%d]\n", i+1, i+1, i, i)
+		fmt.Fprintf(buffer, "      end\n")
+	}
+	fmt.Fprintf(buffer, "      if %s then\n", conditions[0])
+	fmt.Fprintf(buffer, "        starts[1], dimensions[1] = timestamp, %s\n", dimensionCode)
+	fmt.Fprintf(buffer, "      end\n")
+	fmt.Fprintf(buffer, "    until not cursor:next()\n")
+	fmt.Fprintf(buffer, "    if cursor:eof() then break end\n")
+	fmt.Fprintf(buffer, "    cursor:next_session()\n")
+	fmt.Fprintf(buffer, "  until not cursor:next()\n\n")
+
+	// Find the furthest stage reached.
+	fmt.Fprintf(buffer, "  local reached = %d\n", len(conditions))
+	fmt.Fprintf(buffer, "  while reached > 0 and starts[reached] == nil do reached = reached - 1 end\n")
+	fmt.Fprintf(buffer, "  if reached == 0 then return end\n\n")
+
+	// Count the object in every stage it reached.
+	fmt.Fprintf(buffer, "  if data[%s] == nil then data[%s] = {} end\n", luaString(f.Name), luaString(f.Name))
+	fmt.Fprintf(buffer, "  data = data[%s]\n", luaString(f.Name))
+	if dimension != nil {
+		index := dimension.codegenIndex()
+		fmt.Fprintf(buffer, "  if data%s == nil then data%s = {} end\n", index, index)
+		fmt.Fprintf(buffer, "  if data%s[dimensions[reached]] == nil then data%s[dimensions[reached]] = {} end\n", index, index)
+		fmt.Fprintf(buffer, "  data = data%s[dimensions[reached]]\n", index)
+	}
+	fmt.Fprintf(buffer, "  for i = 1, reached do data[i] = (data[i] or 0) + 1 end\n")
+
+	// End function definition.
+	fmt.Fprintln(buffer, "end")
+
+	return buffer.String(), nil
+}
+
+// Generates Lua code for the funnel merge.
+func (f *QueryFunnel) CodegenMergeFunction() (string, error) {
+	buffer := new(bytes.Buffer)
+
+	dimension, err := f.parseDimension()
+	if err != nil {
+		return "", err
+	}
+
+	// Generate the merge of the counts of a single funnel.
+	fmt.Fprintf(buffer, "function %sn0(result, data)\n", f.MergeFunctionName())
+	fmt.Fprintf(buffer, "  for i,v in pairs(data) do result[i] = (result[i] or 0) + v end\n")
+	fmt.Fprintf(buffer, "end\n\n")
+
+	// Generate main function.
+	name := luaString(f.Name)
+	fmt.Fprintf(buffer, "function %s(result, data)\n", f.MergeFunctionName())
+	fmt.Fprintf(buffer, "  if data[%s] == nil then return end\n", name)
+	fmt.Fprintf(buffer, "  if result[%s] == nil then result[%s] = {} end\n", name, name)
+	if dimension != nil {
+		index := dimension.codegenIndex()
+		fmt.Fprintf(buffer, "  result, data = result[%s], data[%s]\n", name, name)
+		fmt.Fprintf(buffer, "  if data%s == nil then return end\n", index)
+		fmt.Fprintf(buffer, "  if result%s == nil then result%s = {} end\n", index, index)
+		fmt.Fprintf(buffer, "  for k,v in pairs(data%s) do\n", index)
+		fmt.Fprintf(buffer, "    if result%s[k] == nil then result%s[k] = {} end\n", index, index)
+		fmt.Fprintf(buffer, "    %sn0(result%s[k], v)\n", f.MergeFunctionName(), index)
+		fmt.Fprintf(buffer, "  end\n")
+	} else {
+		fmt.Fprintf(buffer, "  %sn0(result[%s], data[%s])\n", f.MergeFunctionName(), name, name)
+	}
+	fmt.Fprintf(buffer, "end\n")
+
+	return buffer.String(), nil
+}
+
+//--------------------------------------
+// Factorization
+//--------------------------------------
+
+// Converts factorized dimension values back to their original strings.
+func (f *QueryFunnel) Defactorize(data interface{}) error {
+	dimension, err := f.parseDimension()
+	if dimension == nil || err != nil {
+		return err
+	}
+
+	m, ok := data.(map[interface{}]interface{})
+	if !ok {
+		return nil
+	}
+	m, ok = m[f.Name].(map[interface{}]interface{})
+	if !ok {
+		return nil
+	}
+	if outer, ok := m[dimension.text].(map[interface{}]interface{}); ok {
+		copy := map[interface{}]interface{}{}
+		for k, v := range outer {
+			key, err := dimension.defactorize(f.query, k)
+			if err != nil {
+				return err
+			}
+			copy[key] = v
+		}
+		m[dimension.text] = copy
+	}
+	return nil
+}
+
+//--------------------------------------
+// Finalization
+//--------------------------------------
+
+// Converts the stage counts into a list with one count per stage.
+func (f *QueryFunnel) Finalize(data interface{}) error {
+	m, ok := data.(map[interface{}]interface{})
+	if !ok {
+		return nil
+	}
+
+	// Funnels without a dimension are stored directly under the name.
+	if f.Dimension == "" {
+		if counts, ok := m[f.Name].(map[interface{}]interface{}); ok {
+			m[f.Name] = f.counts(counts)
+		}
+		return nil
+	}
+
+	if m, ok := m[f.Name].(map[interface{}]interface{}); ok {
+		if outer, ok := m[f.Dimension].(map[interface{}]interface{}); ok {
+			for k, v := range outer {
+				if counts, ok := v.(map[interface{}]interface{}); ok {
+					outer[k] = f.counts(counts)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// Converts a Lua table of counts keyed by stage number into a list.
+func (f *QueryFunnel) counts(data map[interface{}]interface{}) []int64 {
+	counts := make([]int64, len(f.Stages))
+	for k, v := range data {
+		index, ok := normalize(k).(int64)
+		if !ok || index < 1 || int(index) > len(counts) {
+			continue
+		}
+		if count, ok := castFloat64(v); ok {
+			counts[index-1] = int64(count)
+		}
+	}
+	return counts
+}
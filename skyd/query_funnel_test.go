@@ -0,0 +1,44 @@
+package skyd
+
+import (
+	"bytes"
+	"testing"
+)
+
+// Ensure that funnels can be encoded and decoded.
+func TestQueryFunnelEncodeDecode(t *testing.T) {
+	table := createTempTable(t)
+	table.Open()
+	defer table.Close()
+
+	json := `{"sessionIdleTime":0,"steps":[{"dimension":"plan","name":"checkout","stages":["action == 'home'","action == 'purchase'"],"type":"funnel","within":3600}]}` + "\n"
+	q := NewQuery(table, nil)
+	if err := q.Decode(bytes.NewBufferString(json)); err != nil {
+		t.Fatalf("Query decoding error: %v", err)
+	}
+	buffer := new(bytes.Buffer)
+	q.Encode(buffer)
+	if buffer.String() != json {
+		t.Fatalf("Query encoding error:\nexp: %s\ngot: %s", json, buffer.String())
+	}
+}
+
+// Ensure that invalid funnels are rejected.
+func TestQueryFunnelDeserializeErrors(t *testing.T) {
+	tests := []struct {
+		obj map[string]interface{}
+		exp string
+	}{
+		{map[string]interface{}{"type": "funnel", "stages": []interface{}{"true"}}, `skyd.QueryFunnel: Invalid name: <nil>`},
+		{map[string]interface{}{"type": "funnel", "name": "x"}, `skyd.QueryFunnel: Invalid stages: <nil>`},
+		{map[string]interface{}{"type": "funnel", "name": "x", "stages": []interface{}{}}, `skyd.QueryFunnel: Invalid stages: []`},
+		{map[string]interface{}{"type": "funnel", "name": "x", "stages": []interface{}{"true", 1.0}}, `skyd.QueryFunnel: Invalid stage: 1`},
+		{map[string]interface{}{"type": "funnel", "name": "x", "stages": []interface{}{"true"}, "within": -1.0}, `skyd.QueryFunnel: Invalid 'within': -1`},
+	}
+	for i, test := range tests {
+		err := NewQueryFunnel(NewQuery(nil, nil)).Deserialize(test.obj)
+		if err == nil || err.Error() != test.exp {
+			t.Fatalf("[%d] Expected error %q, got %v", i, test.exp, err)
+		}
+	}
+}
@@ -0,0 +1,508 @@
+package skyd
+
+import (
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+//------------------------------------------------------------------------------
+//
+// Constants
+//
+//------------------------------------------------------------------------------
+
+// The session idle time, in seconds, used by "FOR EACH SESSION" when no idle
+// time is given.
+const DefaultQuerySessionIdleTime = 1800
+
+//------------------------------------------------------------------------------
+//
+// Typedefs
+//
+//------------------------------------------------------------------------------
+
+// A QueryParser converts the text form of a query into query steps. The
+// grammar is:
+//
+//	query     := options step+
+//	options   := ("FOR" "EACH" ("OBJECT" | "SESSION" ("IDLE" duration)?))?
+//	             ("FROM" time)? ("TO" time)? ("WHERE" expr)? ("SAMPLE" NUMBER)?
+//	step      := condition | selection
+//	condition := "WHEN" expr ("WITHIN" NUMBER ".." NUMBER unit)? "THEN" block
+//	block     := step | "(" step+ ")"
+//	selection := "SELECT" field ("," field)* ("GROUP" "BY" dimension ("," dimension)*)? ("INTO" name)?
+//	field     := expr ("AS" name)?
+//	dimension := DIMENSION | STRING
+//	time      := STRING | PARAM
+//
+// A DIMENSION is written the same way as in a JSON query, such as "channel",
+// "price:bin(10)" or "@timestamp:day(America/New_York)", and ends at the
+// first space, comma or unmatched parenthesis. Keywords are case insensitive
+// and are only reserved where they are expected so they can still be used as
+// property names.
+type QueryParser struct {
+	*ExpressionParser
+	query *Query
+}
+
+//------------------------------------------------------------------------------
+//
+// Constructors
+//
+//------------------------------------------------------------------------------
+
+// Creates a new parser for the text of a query.
+func NewQueryParser(src string) *QueryParser {
+	return &QueryParser{ExpressionParser: NewExpressionParser(src)}
+}
+
+//------------------------------------------------------------------------------
+//
+// Methods
+//
+//------------------------------------------------------------------------------
+
+//--------------------------------------
+// Parsing
+//--------------------------------------
+
+// Parses the complete text into a query. The query's options and steps are
+// replaced. Time parameters are bound from the query's existing parameters.
+func (p *QueryParser) Parse(q *Query) error {
+	p.query = q
+	q.Steps = make(QueryStepList, 0)
+	q.SessionIdleTime = 0
+	q.StartTime, q.EndTime = time.Time{}, time.Time{}
+	q.startTimeParam, q.endTimeParam = "", ""
+	q.Filter = ""
+	q.Sample = 1
+
+	if err := p.parseOptions(); err != nil {
+		return err
+	}
+
+	for {
+		tok, pos, lit := p.scan()
+		if tok == tokenEOF {
+			if len(q.Steps) == 0 {
+				return newExpressionError(pos, "Expected SELECT or WHEN, found %q", lit)
+			}
+			return nil
+		}
+		p.unscan()
+
+		step, err := p.parseStep()
+		if err != nil {
+			return err
+		}
+		q.Steps = append(q.Steps, step)
+	}
+}
+
+// Parses the options that apply to the whole query.
+func (p *QueryParser) parseOptions() error {
+	q := p.query
+
+	if p.scanKeyword("for") {
+		if err := p.expectKeyword("each"); err != nil {
+			return err
+		}
+		tok, pos, lit := p.scan()
+		switch {
+		case isKeyword(tok, lit, "object"):
+		case isKeyword(tok, lit, "session"):
+			q.SessionIdleTime = DefaultQuerySessionIdleTime
+			if p.scanKeyword("idle") {
+				seconds, err := p.parseDuration()
+				if err != nil {
+					return err
+				}
+				q.SessionIdleTime = seconds
+			}
+		default:
+			return newExpressionError(pos, "Expected OBJECT or SESSION, found %q", lit)
+		}
+	}
+
+	if p.scanKeyword("from") {
+		t, param, err := p.parseTime()
+		if err != nil {
+			return err
+		}
+		q.StartTime, q.startTimeParam = t, param
+	}
+	if p.scanKeyword("to") {
+		_, pos, _ := p.scan()
+		p.unscan()
+		t, param, err := p.parseTime()
+		if err != nil {
+			return err
+		}
+		q.EndTime, q.endTimeParam = t, param
+		if !q.StartTime.IsZero() && !q.EndTime.IsZero() && !q.StartTime.Before(q.EndTime) {
+			return newExpressionError(pos, "End time must be after start time")
+		}
+	}
+
+	if p.scanKeyword("where") {
+		filter, err := p.parseExpressionText()
+		if err != nil {
+			return err
+		}
+		q.Filter = filter
+	}
+
+	if p.scanKeyword("sample") {
+		tok, pos, lit := p.scan()
+		value, err := strconv.ParseFloat(lit, 64)
+		if tok != tokenNumber || err != nil || value <= 0 || value > 1 {
+			return newExpressionError(pos, "Expected sample rate between 0 and 1, found %q", lit)
+		}
+		q.Sample = value
+	}
+
+	return nil
+}
+
+// step := condition | selection
+func (p *QueryParser) parseStep() (QueryStep, error) {
+	tok, pos, lit := p.scan()
+	switch {
+	case isKeyword(tok, lit, "when"):
+		return p.parseCondition()
+	case isKeyword(tok, lit, "select"):
+		return p.parseSelection()
+	case tok == tokenIllegal:
+		return nil, newExpressionError(pos, "Invalid token %q", lit)
+	}
+	return nil, newExpressionError(pos, "Expected SELECT or WHEN, found %q", lit)
+}
+
+// condition := "WHEN" expr ("WITHIN" NUMBER ".." NUMBER unit)? "THEN" block
+func (p *QueryParser) parseCondition() (QueryStep, error) {
+	condition := NewQueryCondition(p.query)
+
+	expression, err := p.parseExpressionText()
+	if err != nil {
+		return nil, err
+	}
+	condition.Expression = expression
+
+	if p.scanKeyword("within") {
+		_, pos, _ := p.scan()
+		p.unscan()
+		start, err := p.parseInteger()
+		if err != nil {
+			return nil, err
+		}
+		if tok, pos, lit := p.scan(); tok != tokenRange {
+			return nil, newExpressionError(pos, "Expected '..', found %q", lit)
+		}
+		end, err := p.parseInteger()
+		if err != nil {
+			return nil, err
+		}
+		if start > end {
+			return nil, newExpressionError(pos, "Invalid range %d..%d", start, end)
+		}
+
+		tok, pos, lit := p.scan()
+		switch {
+		case isKeyword(tok, lit, "step", "steps"):
+			condition.WithinUnits = QueryConditionUnitSteps
+		case isKeyword(tok, lit, "session", "sessions"):
+			condition.WithinUnits = QueryConditionUnitSessions
+		default:
+			p.unscan()
+			multiplier, err := p.parseTimeUnit()
+			if err != nil {
+				return nil, err
+			}
+			condition.WithinUnits = QueryConditionUnitSeconds
+			start, end = start*multiplier, end*multiplier
+		}
+		condition.WithinRangeStart, condition.WithinRangeEnd = start, end
+	}
+
+	if err := p.expectKeyword("then"); err != nil {
+		return nil, err
+	}
+	if condition.Steps, err = p.parseBlock(); err != nil {
+		return nil, err
+	}
+	return condition, nil
+}
+
+// block := step | "(" step+ ")"
+func (p *QueryParser) parseBlock() (QueryStepList, error) {
+	steps := make(QueryStepList, 0)
+	if tok, _, _ := p.scan(); tok != tokenLParen {
+		p.unscan()
+		step, err := p.parseStep()
+		if err != nil {
+			return nil, err
+		}
+		return append(steps, step), nil
+	}
+
+	for {
+		if tok, _, _ := p.scan(); tok == tokenRParen && len(steps) > 0 {
+			return steps, nil
+		}
+		p.unscan()
+
+		step, err := p.parseStep()
+		if err != nil {
+			return nil, err
+		}
+		steps = append(steps, step)
+	}
+}
+
+// selection := "SELECT" field ("," field)* ("GROUP" "BY" dimension ("," dimension)*)? ("INTO" name)?
+func (p *QueryParser) parseSelection() (QueryStep, error) {
+	selection := NewQuerySelection(p.query)
+	selection.Dimensions = []string{}
+
+	names := map[string]bool{}
+	for {
+		_, pos, _ := p.scan()
+		p.unscan()
+		field, err := p.parseField()
+		if err != nil {
+			return nil, err
+		}
+		if names[field.Name] {
+			return nil, newExpressionError(pos, "Duplicate field name %q", field.Name)
+		}
+		names[field.Name] = true
+		selection.Fields = append(selection.Fields, field)
+
+		if tok, _, _ := p.scan(); tok != tokenComma {
+			p.unscan()
+			break
+		}
+	}
+
+	if p.scanKeyword("group") {
+		if err := p.expectKeyword("by"); err != nil {
+			return nil, err
+		}
+		for {
+			dimension, err := p.parseDimension()
+			if err != nil {
+				return nil, err
+			}
+			selection.Dimensions = append(selection.Dimensions, dimension)
+
+			if tok, _, _ := p.scan(); tok != tokenComma {
+				p.unscan()
+				break
+			}
+		}
+	}
+
+	if p.scanKeyword("into") {
+		name, err := p.parseName()
+		if err != nil {
+			return nil, err
+		}
+		selection.Name = name
+	}
+
+	return selection, nil
+}
+
+// field := expr ("AS" name)?
+// Fields without a name are named after their function or property.
+func (p *QueryParser) parseField() (*QuerySelectionField, error) {
+	_, pos, _ := p.scan()
+	p.unscan()
+	expr, text, err := p.parseExpression()
+	if err != nil {
+		return nil, err
+	}
+
+	field := NewQuerySelectionField("", text)
+	if p.scanKeyword("as") {
+		if field.Name, err = p.parseName(); err != nil {
+			return nil, err
+		}
+		return field, nil
+	}
+
+	switch expr := expr.(type) {
+	case *CallExpression:
+		field.Name = strings.ToLower(expr.Name)
+	case *VarRef:
+		field.Name = expr.Name
+	default:
+		return nil, newExpressionError(pos, "Field name required for %q", text)
+	}
+	return field, nil
+}
+
+// Parses an expression and returns it along with its source text.
+func (p *QueryParser) parseExpression() (Expression, string, error) {
+	_, start, _ := p.scan()
+	p.unscan()
+	expr, err := p.ParseExpression()
+	if err != nil {
+		return nil, "", err
+	}
+	_, end, _ := p.scan()
+	p.unscan()
+	return expr, strings.TrimSpace(string(p.lexer.src[start:end])), nil
+}
+
+// Parses an expression and returns only its source text.
+func (p *QueryParser) parseExpressionText() (string, error) {
+	_, text, err := p.parseExpression()
+	return text, err
+}
+
+// dimension := DIMENSION | STRING
+// Dimensions are read directly from the source since their modifiers aren't
+// expressions.
+func (p *QueryParser) parseDimension() (string, error) {
+	// Rewind to any token that was pushed back.
+	if p.buf.n != 0 {
+		p.lexer.pos, p.buf.n = p.buf.pos, 0
+	}
+	for unicode.IsSpace(p.lexer.peek()) {
+		p.lexer.pos++
+	}
+
+	pos := p.lexer.pos
+	if ch := p.lexer.peek(); ch == '"' || ch == '\'' {
+		_, _, lit := p.scan()
+		return lit, nil
+	} else if ch != '@' && !isIdentStart(ch) {
+		_, _, lit := p.scan()
+		return "", newExpressionError(pos, "Expected dimension, found %q", lit)
+	}
+
+	depth := 0
+	for {
+		ch := p.lexer.peek()
+		if ch == eof || unicode.IsSpace(ch) || ch == ',' || (ch == ')' && depth == 0) {
+			break
+		} else if ch == '(' {
+			depth++
+		} else if ch == ')' {
+			depth--
+		}
+		p.lexer.pos++
+	}
+	if depth != 0 {
+		return "", newExpressionError(pos, "Unmatched '(' in dimension %q", string(p.lexer.src[pos:p.lexer.pos]))
+	}
+	return string(p.lexer.src[pos:p.lexer.pos]), nil
+}
+
+// Parses a field or selection name. Names are identifiers or strings.
+func (p *QueryParser) parseName() (string, error) {
+	tok, pos, lit := p.scan()
+	if (tok != tokenIdent && tok != tokenString) || lit == "" {
+		return "", newExpressionError(pos, "Expected name, found %q", lit)
+	}
+	return lit, nil
+}
+
+// Parses a non-negative whole number.
+func (p *QueryParser) parseInteger() (int, error) {
+	tok, pos, lit := p.scan()
+	value, err := strconv.Atoi(lit)
+	if tok != tokenNumber || err != nil {
+		return 0, newExpressionError(pos, "Expected whole number, found %q", lit)
+	}
+	return value, nil
+}
+
+// duration := NUMBER unit
+// Returns the duration in seconds.
+func (p *QueryParser) parseDuration() (int, error) {
+	value, err := p.parseInteger()
+	if err != nil {
+		return 0, err
+	}
+	multiplier, err := p.parseTimeUnit()
+	if err != nil {
+		return 0, err
+	}
+	return value * multiplier, nil
+}
+
+// Parses a unit of time and returns the number of seconds in it.
+func (p *QueryParser) parseTimeUnit() (int, error) {
+	tok, pos, lit := p.scan()
+	switch {
+	case isKeyword(tok, lit, "second", "seconds"):
+		return 1, nil
+	case isKeyword(tok, lit, "minute", "minutes"):
+		return 60, nil
+	case isKeyword(tok, lit, "hour", "hours"):
+		return 3600, nil
+	case isKeyword(tok, lit, "day", "days"):
+		return 86400, nil
+	}
+	return 0, newExpressionError(pos, "Expected unit, found %q", lit)
+}
+
+// Parses an RFC3339 time string or a parameter reference. Returns the name
+// of the parameter if the time is a reference.
+func (p *QueryParser) parseTime() (time.Time, string, error) {
+	tok, pos, lit := p.scan()
+	switch tok {
+	case tokenParam:
+		t, err := p.query.bindTimeParam(lit)
+		if err != nil {
+			return time.Time{}, "", newExpressionError(pos, "%v", err)
+		}
+		return t, lit, nil
+	case tokenString:
+		if t, err := time.Parse(time.RFC3339, lit); err == nil {
+			return t, "", nil
+		}
+		return time.Time{}, "", newExpressionError(pos, "Invalid time %q", lit)
+	}
+	return time.Time{}, "", newExpressionError(pos, "Expected time, found %q", lit)
+}
+
+//--------------------------------------
+// Keywords
+//--------------------------------------
+
+// Consumes the next token if it is the given keyword.
+func (p *QueryParser) scanKeyword(keyword string) bool {
+	tok, _, lit := p.scan()
+	if isKeyword(tok, lit, keyword) {
+		return true
+	}
+	p.unscan()
+	return false
+}
+
+// Consumes the next token and returns an error if it is not the keyword.
+func (p *QueryParser) expectKeyword(keyword string) error {
+	tok, pos, lit := p.scan()
+	if !isKeyword(tok, lit, keyword) {
+		return newExpressionError(pos, "Expected %s, found %q", strings.ToUpper(keyword), lit)
+	}
+	return nil
+}
+
+// Checks if a token is an identifier matching one of the keywords.
+func isKeyword(tok int, lit string, keywords ...string) bool {
+	if tok != tokenIdent {
+		return false
+	}
+	for _, keyword := range keywords {
+		if strings.EqualFold(lit, keyword) {
+			return true
+		}
+	}
+	return false
+}
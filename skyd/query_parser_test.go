@@ -0,0 +1,60 @@
+package skyd
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+// Ensure that query text is parsed into query steps.
+func TestQueryParser(t *testing.T) {
+	tests := []struct {
+		src string
+		exp string
+	}{
+		{`SELECT count()`, `{"sessionIdleTime":0,"steps":[{"dimensions":[],"fields":[{"expression":"count()","name":"count"}],"name":"","type":"selection"}]}`},
+		{`select sum(price) as total, price group by channel, "@timestamp:day", price:bin(10) into xyz`, `{"sessionIdleTime":0,"steps":[{"dimensions":["channel","@timestamp:day","price:bin(10)"],"fields":[{"expression":"sum(price)","name":"total"},{"expression":"price","name":"price"}],"name":"xyz","type":"selection"}]}`},
+		{`FOR EACH SESSION WHEN action == "signup" WITHIN 1..5 STEPS THEN SELECT count() GROUP BY channel`, `{"sessionIdleTime":1800,"steps":[{"expression":"action == \"signup\"","steps":[{"dimensions":["channel"],"fields":[{"expression":"count()","name":"count"}],"name":"","type":"selection"}],"type":"condition","within":[1,5],"withinUnits":"steps"}]}`},
+		{`FOR EACH SESSION IDLE 10 MINUTES WHEN true WITHIN 0..2 hours THEN (SELECT count() SELECT sum(price) GROUP BY @timestamp:day(America/New_York)) SELECT count()`, `{"sessionIdleTime":600,"steps":[{"expression":"true","steps":[{"dimensions":[],"fields":[{"expression":"count()","name":"count"}],"name":"","type":"selection"},{"dimensions":["@timestamp:day(America/New_York)"],"fields":[{"expression":"sum(price)","name":"sum"}],"name":"","type":"selection"}],"type":"condition","within":[0,7200],"withinUnits":"seconds"},{"dimensions":[],"fields":[{"expression":"count()","name":"count"}],"name":"","type":"selection"}]}`},
+		{`FROM "2012-01-01T00:00:00Z" TO $to WHERE price > 10 and (session == 'x') SAMPLE 0.5 SELECT count()`, `{"endTime":"$to","filter":"price \u003e 10 and (session == 'x')","sample":0.5,"sessionIdleTime":0,"startTime":"2012-01-01T00:00:00Z","steps":[{"dimensions":[],"fields":[{"expression":"count()","name":"count"}],"name":"","type":"selection"}]}`},
+	}
+	for i, test := range tests {
+		q := NewQuery(nil, nil)
+		if err := NewQueryParser(test.src).Parse(q); err != nil {
+			t.Fatalf("[%d] Unable to parse %q: %v", i, test.src, err)
+		}
+		b, _ := json.Marshal(q.Serialize())
+		if string(b) != test.exp {
+			t.Fatalf("[%d] Wrong parse of %q:\nexp: %s\ngot: %s", i, test.src, test.exp, string(b))
+		}
+	}
+}
+
+// Ensure that query text errors report their position.
+func TestQueryParserErrors(t *testing.T) {
+	tests := []struct {
+		src string
+		exp string
+	}{
+		{``, `Expected SELECT or WHEN, found "" at char 1`},
+		{`SELECT`, `Unexpected end of expression at char 7`},
+		{`SELECT count() foo`, `Expected SELECT or WHEN, found "foo" at char 16`},
+		{`SELECT count(), count()`, `Duplicate field name "count" at char 17`},
+		{`SELECT price * 2`, `Field name required for "price * 2" at char 8`},
+		{`FOR SESSION SELECT count()`, `Expected EACH, found "SESSION" at char 5`},
+		{`WHEN a == 1 SELECT count()`, `Expected THEN, found "SELECT" at char 13`},
+		{`WHEN a == 1 WITHIN 1 5 STEPS THEN SELECT count()`, `Expected '..', found "5" at char 22`},
+		{`WHEN a == 1 WITHIN 5..1 STEPS THEN SELECT count()`, `Invalid range 5..1 at char 20`},
+		{`WHEN a == 1 WITHIN 1..5 WEEKS THEN SELECT count()`, `Expected unit, found "WEEKS" at char 25`},
+		{`WHEN a == 1 THEN (SELECT count()`, `Expected SELECT or WHEN, found "" at char 33`},
+		{`FROM "2012-01-01" SELECT count()`, `Invalid time "2012-01-01" at char 6`},
+		{`SAMPLE 2 SELECT count()`, `Expected sample rate between 0 and 1, found "2" at char 8`},
+		{`SELECT count() GROUP BY 1`, `Expected dimension, found "1" at char 25`},
+		{`SELECT count() GROUP BY price:bin(10`, `Unmatched '(' in dimension "price:bin(10" at char 25`},
+	}
+	for i, test := range tests {
+		err := NewQueryParser(test.src).Parse(NewQuery(nil, nil))
+		if err == nil || err.Error() != test.exp {
+			t.Fatalf("[%d] Wrong error for %q:\nexp: %s\ngot: %v", i, test.src, test.exp, err)
+		}
+	}
+}
@@ -0,0 +1,396 @@
+package skyd
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"sort"
+)
+
+//------------------------------------------------------------------------------
+//
+// Constants
+//
+//------------------------------------------------------------------------------
+
+// The directions that paths can be read from an anchor event.
+const (
+	QueryPathsNext     = "next"
+	QueryPathsPrevious = "previous"
+)
+
+// The default depth and number of children kept at each level of a path.
+const (
+	DefaultQueryPathsDepth = 3
+	DefaultQueryPathsLimit = 10
+)
+
+//------------------------------------------------------------------------------
+//
+// Typedefs
+//
+//------------------------------------------------------------------------------
+
+// A paths step records the values of a property on the events that follow or
+// precede each event matching an anchor expression. The values are counted in
+// a trie so that each level holds the paths taken from the level above it.
+type QueryPaths struct {
+	query             *Query
+	functionName      string
+	mergeFunctionName string
+	Name              string
+	Anchor            string
+	Property          string
+	Direction         string
+	Depth             int
+	Limit             int
+}
+
+// A PathNode is a single value within a path trie. The root node has no value
+// and its count is the number of anchor events.
+type PathNode struct {
+	Value    interface{} `json:"value,omitempty"`
+	Count    int64       `json:"count"`
+	Children []*PathNode `json:"children,omitempty"`
+}
+
+type pathNodes []*PathNode
+
+//------------------------------------------------------------------------------
+//
+// Constructors
+//
+//------------------------------------------------------------------------------
+
+// Creates a new paths step.
+func NewQueryPaths(query *Query) *QueryPaths {
+	id := query.NextIdentifier()
+	return &QueryPaths{
+		query:             query,
+		functionName:      fmt.Sprintf("a%d", id),
+		mergeFunctionName: fmt.Sprintf("m%d", id),
+		Direction:         QueryPathsNext,
+		Depth:             DefaultQueryPathsDepth,
+		Limit:             DefaultQueryPathsLimit,
+	}
+}
+
+//------------------------------------------------------------------------------
+//
+// Accessors
+//
+//------------------------------------------------------------------------------
+
+// Retrieves the query this paths step is associated with.
+func (p *QueryPaths) Query() *Query {
+	return p.query
+}
+
+// Retrieves the function name used during codegen.
+func (p *QueryPaths) FunctionName() string {
+	return p.functionName
+}
+
+// Retrieves the merge function name used during codegen.
+func (p *QueryPaths) MergeFunctionName() string {
+	return p.mergeFunctionName
+}
+
+// Retrieves the child steps.
+func (p *QueryPaths) GetSteps() QueryStepList {
+	return []QueryStep{}
+}
+
+//------------------------------------------------------------------------------
+//
+// Methods
+//
+//------------------------------------------------------------------------------
+
+//--------------------------------------
+// Serialization
+//--------------------------------------
+
+// Encodes a query paths step into an untyped map.
+func (p *QueryPaths) Serialize() map[string]interface{} {
+	return map[string]interface{}{
+		"type":      QueryStepTypePaths,
+		"name":      p.Name,
+		"anchor":    p.Anchor,
+		"property":  p.Property,
+		"direction": p.Direction,
+		"depth":     p.Depth,
+		"limit":     p.Limit,
+	}
+}
+
+// Decodes a query paths step from an untyped map.
+func (p *QueryPaths) Deserialize(obj map[string]interface{}) error {
+	if obj == nil {
+		return errors.New("skyd.QueryPaths: Unable to deserialize nil.")
+	}
+	if obj["type"] != QueryStepTypePaths {
+		return fmt.Errorf("skyd.QueryPaths: Invalid step type: %v", obj["type"])
+	}
+
+	// Deserialize "name".
+	if name, ok := obj["name"].(string); ok && name != "" {
+		p.Name = name
+	} else {
+		return fmt.Errorf("skyd.QueryPaths: Invalid name: %v", obj["name"])
+	}
+
+	// Deserialize "anchor".
+	if anchor, ok := obj["anchor"].(string); ok {
+		p.Anchor = anchor
+	} else if obj["anchor"] == nil {
+		p.Anchor = "true"
+	} else {
+		return fmt.Errorf("skyd.QueryPaths: Invalid 'anchor': %v", obj["anchor"])
+	}
+
+	// Deserialize "property".
+	if property, ok := obj["property"].(string); ok && property != "" {
+		p.Property = property
+	} else {
+		return fmt.Errorf("skyd.QueryPaths: Invalid 'property': %v", obj["property"])
+	}
+
+	// Deserialize "direction".
+	switch obj["direction"] {
+	case QueryPathsNext, QueryPathsPrevious:
+		p.Direction = obj["direction"].(string)
+	case nil:
+		p.Direction = QueryPathsNext
+	default:
+		return fmt.Errorf("skyd.QueryPaths: Invalid 'direction': %v", obj["direction"])
+	}
+
+	// Deserialize "depth".
+	if depth, ok := obj["depth"].(float64); ok && depth >= 1 && depth == float64(int(depth)) {
+		p.Depth = int(depth)
+	} else if obj["depth"] == nil {
+		p.Depth = DefaultQueryPathsDepth
+	} else {
+		return fmt.Errorf("skyd.QueryPaths: Invalid 'depth': %v", obj["depth"])
+	}
+
+	// Deserialize "limit". A limit of zero keeps every child.
+	if limit, ok := obj["limit"].(float64); ok && limit >= 0 && limit == float64(int(limit)) {
+		p.Limit = int(limit)
+	} else if obj["limit"] == nil {
+		p.Limit = DefaultQueryPathsLimit
+	} else {
+		return fmt.Errorf("skyd.QueryPaths: Invalid 'limit': %v", obj["limit"])
+	}
+
+	return nil
+}
+
+// Parses the property as a dimension so that its values can be bucketed
+// and defactorized.
+func (p *QueryPaths) parseProperty() (*queryDimension, error) {
+	return parseQueryDimension(p.query.table, p.Property)
+}
+
+//--------------------------------------
+// Code Generation
+//--------------------------------------
+
+// Generates Lua code for the paths aggregation. The step reads the rest of
+// the object's events. Paths after an anchor are extended as each following
+// event is read and paths before an anchor are read from a history of the
+// most recent values.
+func (p *QueryPaths) CodegenAggregateFunction() (string, error) {
+	buffer := new(bytes.Buffer)
+
+	dimension, err := p.parseProperty()
+	if err != nil {
+		return "", err
+	}
+	expr, err := ParseExpression(p.Anchor)
+	if err != nil {
+		return "", fmt.Errorf("skyd.QueryPaths: Invalid expression: %v", err)
+	}
+	anchor, err := p.query.newExpressionCompiler("cursor.event").CompileCondition(expr)
+	if err != nil {
+		return "", fmt.Errorf("skyd.QueryPaths: %v", err)
+	}
+
+	// Generate constant table used by the property.
+	table := ""
+	if code := dimension.codegenTable(); code != "" {
+		table = fmt.Sprintf("%s_d0", p.FunctionName())
+		fmt.Fprintf(buffer, "local %s = %s\n", table, code)
+	}
+
+	// Generate main function.
+	name := luaString(p.Name)
+	fmt.Fprintf(buffer, "function %s(cursor, data)\n", p.FunctionName())
+	fmt.Fprintf(buffer, "  if data[%s] == nil then data[%s] = {count=0} end\n", name, name)
+	fmt.Fprintf(buffer, "  local root = data[%s]\n", name)
+	fmt.Fprintf(buffer, "  local paths = {}\n")
+	fmt.Fprintf(buffer, "  repeat\n")
+	fmt.Fprintf(buffer, "    repeat\n")
+	fmt.Fprintf(buffer, "      local value = %s\n", dimension.codegenExpression(table))
+	if p.Direction == QueryPathsPrevious {
+		fmt.Fprintf(buffer, "      if %s then\n", anchor)
+		fmt.Fprintf(buffer, "        root.count = root.count + 1\n")
+		fmt.Fprintf(buffer, "        local node = root\n")
+		fmt.Fprintf(buffer, "        for i = #paths, 1, -1 do node = sky_path_child(node, paths[i]) end\n")
+		fmt.Fprintf(buffer, "      end\n")
+		fmt.Fprintf(buffer, "      paths[#paths+1] = value\n")
+		fmt.Fprintf(buffer, "      if #paths > %d then table.remove(paths, 1) end\n", p.Depth)
+	} else {
+		fmt.Fprintf(buffer, "      local n = 0\n")
+		fmt.Fprintf(buffer, "      for i = 1, #paths do\n")
+		fmt.Fprintf(buffer, "        local node = sky_path_child(paths[i].node, value)\n")
+		fmt.Fprintf(buffer, "        if paths[i].depth < %d then\n", p.Depth-1)
+		fmt.Fprintf(buffer, "          n = n + 1\n")
+		fmt.Fprintf(buffer, "          paths[n] = {node=node, depth=paths[i].depth+1}\n")
+		fmt.Fprintf(buffer, "        end\n")
+		fmt.Fprintf(buffer, "      end\n")
+		fmt.Fprintf(buffer, "      for i = #paths, n+1, -1 do paths[i] = nil end\n")
+		fmt.Fprintf(buffer, "      if %s then\n", anchor)
+		fmt.Fprintf(buffer, "        root.count = root.count + 1\n")
+		fmt.Fprintf(buffer, "        paths[n+1] = {node=root, depth=0}\n")
+		fmt.Fprintf(buffer, "      end\n")
+	}
+	fmt.Fprintf(buffer, "    until not cursor:next()\n")
+	fmt.Fprintf(buffer, "    if cursor:eof() then break end\n")
+	fmt.Fprintf(buffer, "    cursor:next_session()\n")
+	fmt.Fprintf(buffer, "  until not cursor:next()\n")
+
+	// End function definition.
+	fmt.Fprintln(buffer, "end")
+
+	return buffer.String(), nil
+}
+
+// Generates Lua code for the paths merge. Tries are merged recursively.
+func (p *QueryPaths) CodegenMergeFunction() (string, error) {
+	buffer := new(bytes.Buffer)
+
+	// Generate the recursive node merge.
+	fmt.Fprintf(buffer, "function %sn0(result, data)\n", p.MergeFunctionName())
+	fmt.Fprintf(buffer, "  result.count = (result.count or 0) + data.count\n")
+	fmt.Fprintf(buffer, "  if data.children == nil then return end\n")
+	fmt.Fprintf(buffer, "  if result.children == nil then result.children = {} end\n")
+	fmt.Fprintf(buffer, "  for k,v in pairs(data.children) do\n")
+	fmt.Fprintf(buffer, "    if result.children[k] == nil then result.children[k] = {} end\n")
+	fmt.Fprintf(buffer, "    %sn0(result.children[k], v)\n", p.MergeFunctionName())
+	fmt.Fprintf(buffer, "  end\n")
+	fmt.Fprintf(buffer, "end\n\n")
+
+	// Generate main function.
+	name := luaString(p.Name)
+	fmt.Fprintf(buffer, "function %s(result, data)\n", p.MergeFunctionName())
+	fmt.Fprintf(buffer, "  if data[%s] == nil then return end\n", name)
+	fmt.Fprintf(buffer, "  if result[%s] == nil then result[%s] = {} end\n", name, name)
+	fmt.Fprintf(buffer, "  %sn0(result[%s], data[%s])\n", p.MergeFunctionName(), name, name)
+	fmt.Fprintf(buffer, "end\n")
+
+	return buffer.String(), nil
+}
+
+//--------------------------------------
+// Factorization
+//--------------------------------------
+
+// Converts factorized values in the trie back to their original strings.
+func (p *QueryPaths) Defactorize(data interface{}) error {
+	m, ok := data.(map[interface{}]interface{})
+	if !ok {
+		return nil
+	}
+	dimension, err := p.parseProperty()
+	if err != nil {
+		return err
+	}
+	return p.defactorize(dimension, m[p.Name])
+}
+
+// Recursively defactorizes the children of a trie node.
+func (p *QueryPaths) defactorize(dimension *queryDimension, data interface{}) error {
+	node, ok := data.(map[interface{}]interface{})
+	if !ok {
+		return nil
+	}
+	children, ok := node["children"].(map[interface{}]interface{})
+	if !ok {
+		return nil
+	}
+
+	copy := map[interface{}]interface{}{}
+	for k, v := range children {
+		key, err := dimension.defactorize(p.query, k)
+		if err != nil {
+			return err
+		}
+		if err := p.defactorize(dimension, v); err != nil {
+			return err
+		}
+		copy[key] = v
+	}
+	node["children"] = copy
+	return nil
+}
+
+//--------------------------------------
+// Finalization
+//--------------------------------------
+
+// Converts the merged trie into path nodes. Only the most common children
+// are kept at each level. Pruning happens after every servlet's results are
+// merged so that counts are exact.
+func (p *QueryPaths) Finalize(data interface{}) error {
+	m, ok := data.(map[interface{}]interface{})
+	if !ok {
+		return nil
+	}
+	if node, ok := m[p.Name].(map[interface{}]interface{}); ok {
+		m[p.Name] = p.finalize(nil, node)
+	}
+	return nil
+}
+
+// Recursively converts a trie node and its children.
+func (p *QueryPaths) finalize(value interface{}, data map[interface{}]interface{}) *PathNode {
+	node := &PathNode{Value: value}
+	if count, ok := castFloat64(data["count"]); ok {
+		node.Count = int64(count)
+	}
+	if children, ok := data["children"].(map[interface{}]interface{}); ok {
+		for k, v := range children {
+			if child, ok := v.(map[interface{}]interface{}); ok {
+				node.Children = append(node.Children, p.finalize(k, child))
+			}
+		}
+	}
+
+	sort.Sort(pathNodes(node.Children))
+	if p.Limit > 0 && len(node.Children) > p.Limit {
+		node.Children = node.Children[:p.Limit]
+	}
+	return node
+}
+
+//--------------------------------------
+// Sorting
+//--------------------------------------
+
+// Nodes are sorted by descending count and then by value.
+func (s pathNodes) Len() int {
+	return len(s)
+}
+
+func (s pathNodes) Less(i, j int) bool {
+	if s[i].Count != s[j].Count {
+		return s[i].Count > s[j].Count
+	}
+	return fmt.Sprintf("%v", s[i].Value) < fmt.Sprintf("%v", s[j].Value)
+}
+
+func (s pathNodes) Swap(i, j int) {
+	s[i], s[j] = s[j], s[i]
+}
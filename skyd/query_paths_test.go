@@ -0,0 +1,48 @@
+package skyd
+
+import (
+	"testing"
+)
+
+// Ensure that invalid paths steps are rejected.
+func TestQueryPathsDeserializeErrors(t *testing.T) {
+	tests := []struct {
+		obj map[string]interface{}
+		exp string
+	}{
+		{map[string]interface{}{"type": "paths", "property": "action"}, `skyd.QueryPaths: Invalid name: <nil>`},
+		{map[string]interface{}{"type": "paths", "name": "x"}, `skyd.QueryPaths: Invalid 'property': <nil>`},
+		{map[string]interface{}{"type": "paths", "name": "x", "property": "action", "direction": "up"}, `skyd.QueryPaths: Invalid 'direction': up`},
+		{map[string]interface{}{"type": "paths", "name": "x", "property": "action", "depth": 0.0}, `skyd.QueryPaths: Invalid 'depth': 0`},
+		{map[string]interface{}{"type": "paths", "name": "x", "property": "action", "limit": -1.0}, `skyd.QueryPaths: Invalid 'limit': -1`},
+	}
+	for i, test := range tests {
+		err := NewQueryPaths(NewQuery(nil, nil)).Deserialize(test.obj)
+		if err == nil || err.Error() != test.exp {
+			t.Fatalf("[%d] Expected error %q, got %v", i, test.exp, err)
+		}
+	}
+}
+
+// Ensure that path tries are sorted and pruned when finalized.
+func TestQueryPathsFinalize(t *testing.T) {
+	p := NewQueryPaths(NewQuery(nil, nil))
+	p.Name, p.Limit = "x", 2
+	data := map[interface{}]interface{}{
+		"x": map[interface{}]interface{}{
+			"count": int64(6),
+			"children": map[interface{}]interface{}{
+				"a": map[interface{}]interface{}{"count": int64(1)},
+				"b": map[interface{}]interface{}{"count": int64(3)},
+				"c": map[interface{}]interface{}{"count": int64(2)},
+			},
+		},
+	}
+	if err := p.Finalize(data); err != nil {
+		t.Fatalf("Unable to finalize: %v", err)
+	}
+	root := data["x"].(*PathNode)
+	if root.Count != 6 || len(root.Children) != 2 || root.Children[0].Value != "b" || root.Children[1].Value != "c" {
+		t.Fatalf("Unexpected trie: %v", root)
+	}
+}
@@ -0,0 +1,331 @@
+package skyd
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+)
+
+//------------------------------------------------------------------------------
+//
+// Constants
+//
+//------------------------------------------------------------------------------
+
+// The number of periods after the cohort period that are counted by default.
+const DefaultQueryRetentionPeriods = 8
+
+// The maximum number of periods that can be counted.
+const MaxQueryRetentionPeriods = 1000
+
+//------------------------------------------------------------------------------
+//
+// Typedefs
+//
+//------------------------------------------------------------------------------
+
+// A retention step groups objects into cohorts by the day or week of their
+// first event that matches the cohort expression. It then counts the objects
+// in each cohort that have an event matching the return expression in each of
+// the following periods.
+type QueryRetention struct {
+	query             *Query
+	functionName      string
+	mergeFunctionName string
+	Name              string
+	Cohort            string
+	Return            string
+	Unit              string
+	Periods           int
+}
+
+// A RetentionCohort is the final result for a single cohort. Retention is the
+// share of the cohort's objects that returned in each period.
+type RetentionCohort struct {
+	Objects   int64     `json:"objects"`
+	Returned  []int64   `json:"returned"`
+	Retention []float64 `json:"retention"`
+}
+
+//------------------------------------------------------------------------------
+//
+// Constructors
+//
+//------------------------------------------------------------------------------
+
+// Creates a new retention step.
+func NewQueryRetention(query *Query) *QueryRetention {
+	id := query.NextIdentifier()
+	return &QueryRetention{
+		query:             query,
+		functionName:      fmt.Sprintf("a%d", id),
+		mergeFunctionName: fmt.Sprintf("m%d", id),
+		Unit:              QueryDimensionWeek,
+		Periods:           DefaultQueryRetentionPeriods,
+	}
+}
+
+//------------------------------------------------------------------------------
+//
+// Accessors
+//
+//------------------------------------------------------------------------------
+
+// Retrieves the query this retention step is associated with.
+func (r *QueryRetention) Query() *Query {
+	return r.query
+}
+
+// Retrieves the function name used during codegen.
+func (r *QueryRetention) FunctionName() string {
+	return r.functionName
+}
+
+// Retrieves the merge function name used during codegen.
+func (r *QueryRetention) MergeFunctionName() string {
+	return r.mergeFunctionName
+}
+
+// Retrieves the child steps.
+func (r *QueryRetention) GetSteps() QueryStepList {
+	return []QueryStep{}
+}
+
+//------------------------------------------------------------------------------
+//
+// Methods
+//
+//------------------------------------------------------------------------------
+
+//--------------------------------------
+// Serialization
+//--------------------------------------
+
+// Encodes a query retention step into an untyped map.
+func (r *QueryRetention) Serialize() map[string]interface{} {
+	return map[string]interface{}{
+		"type":    QueryStepTypeRetention,
+		"name":    r.Name,
+		"cohort":  r.Cohort,
+		"return":  r.Return,
+		"unit":    r.Unit,
+		"periods": r.Periods,
+	}
+}
+
+// Decodes a query retention step from an untyped map.
+func (r *QueryRetention) Deserialize(obj map[string]interface{}) error {
+	if obj == nil {
+		return errors.New("skyd.QueryRetention: Unable to deserialize nil.")
+	}
+	if obj["type"] != QueryStepTypeRetention {
+		return fmt.Errorf("skyd.QueryRetention: Invalid step type: %v", obj["type"])
+	}
+
+	// Deserialize "name".
+	if name, ok := obj["name"].(string); ok && name != "" {
+		r.Name = name
+	} else {
+		return fmt.Errorf("skyd.QueryRetention: Invalid name: %v", obj["name"])
+	}
+
+	// Deserialize "cohort" and "return" expressions.
+	if cohort, ok := obj["cohort"].(string); ok {
+		r.Cohort = cohort
+	} else if obj["cohort"] == nil {
+		r.Cohort = "true"
+	} else {
+		return fmt.Errorf("skyd.QueryRetention: Invalid 'cohort': %v", obj["cohort"])
+	}
+	if ret, ok := obj["return"].(string); ok {
+		r.Return = ret
+	} else if obj["return"] == nil {
+		r.Return = "true"
+	} else {
+		return fmt.Errorf("skyd.QueryRetention: Invalid 'return': %v", obj["return"])
+	}
+
+	// Deserialize "unit".
+	switch obj["unit"] {
+	case QueryDimensionDay, QueryDimensionWeek:
+		r.Unit = obj["unit"].(string)
+	case nil:
+		r.Unit = QueryDimensionWeek
+	default:
+		return fmt.Errorf("skyd.QueryRetention: Invalid 'unit': %v", obj["unit"])
+	}
+
+	// Deserialize "periods".
+	if periods, ok := obj["periods"].(float64); ok && periods >= 1 && periods <= MaxQueryRetentionPeriods && periods == float64(int(periods)) {
+		r.Periods = int(periods)
+	} else if obj["periods"] == nil {
+		r.Periods = DefaultQueryRetentionPeriods
+	} else {
+		return fmt.Errorf("skyd.QueryRetention: Invalid 'periods': %v", obj["periods"])
+	}
+
+	return nil
+}
+
+// Returns the timestamp dimension used to group events into periods.
+func (r *QueryRetention) dimension() *queryDimension {
+	d, _ := parseQueryDimension(r.query.table, QueryDimensionTimestamp+":"+r.Unit)
+	return d
+}
+
+// Returns the number of seconds in a period.
+func (r *QueryRetention) periodSeconds() int {
+	if r.Unit == QueryDimensionDay {
+		return 86400
+	}
+	return 604800
+}
+
+//--------------------------------------
+// Code Generation
+//--------------------------------------
+
+// Generates Lua code for the retention aggregation. The step reads the rest
+// of the object's events to find the cohort and the periods it returned in.
+func (r *QueryRetention) CodegenAggregateFunction() (string, error) {
+	buffer := new(bytes.Buffer)
+
+	cohort, err := r.codegenExpression(r.Cohort)
+	if err != nil {
+		return "", err
+	}
+	ret, err := r.codegenExpression(r.Return)
+	if err != nil {
+		return "", err
+	}
+	period := r.dimension().codegenExpression("")
+
+	// Generate main function.
+	fmt.Fprintf(buffer, "function %s(cursor, data)\n", r.FunctionName())
+	fmt.Fprintf(buffer, "  local cohort, returned = nil, {}\n")
+	fmt.Fprintf(buffer, "  repeat\n")
+	fmt.Fprintf(buffer, "    repeat\n")
+	fmt.Fprintf(buffer, "      if cohort == nil then\n")
+	fmt.Fprintf(buffer, "        if %s then cohort = %s end\n", cohort, period)
+	fmt.Fprintf(buffer, "      elseif %s then\n", ret)
+	fmt.Fprintf(buffer, "        local period = math.floor((%s - cohort) / %d)\n", period, r.periodSeconds())
+	fmt.Fprintf(buffer, "        if period >= 1 and period <= %d then returned[period] = true end\n", r.Periods)
+	fmt.Fprintf(buffer, "      end\n")
+	fmt.Fprintf(buffer, "    until not cursor:next()\n")
+	fmt.Fprintf(buffer, "    if cursor:eof() then break end\n")
+	fmt.Fprintf(buffer, "    cursor:next_session()\n")
+	fmt.Fprintf(buffer, "  until not cursor:next()\n")
+	fmt.Fprintf(buffer, "  if cohort == nil then return end\n\n")
+
+	// Add the object to its cohort.
+	name := luaString(r.Name)
+	fmt.Fprintf(buffer, "  if data[%s] == nil then data[%s] = {} end\n", name, name)
+	fmt.Fprintf(buffer, "  data = data[%s]\n", name)
+	fmt.Fprintf(buffer, "  if data[cohort] == nil then data[cohort] = {objects=0, periods={}} end\n")
+	fmt.Fprintf(buffer, "  data = data[cohort]\n")
+	fmt.Fprintf(buffer, "  data.objects = data.objects + 1\n")
+	fmt.Fprintf(buffer, "  for period in pairs(returned) do data.periods[period] = (data.periods[period] or 0) + 1 end\n")
+
+	// End function definition.
+	fmt.Fprintln(buffer, "end")
+
+	return buffer.String(), nil
+}
+
+// Generates Lua code for the retention merge.
+func (r *QueryRetention) CodegenMergeFunction() (string, error) {
+	buffer := new(bytes.Buffer)
+
+	name := luaString(r.Name)
+	fmt.Fprintf(buffer, "function %s(result, data)\n", r.MergeFunctionName())
+	fmt.Fprintf(buffer, "  if data[%s] == nil then return end\n", name)
+	fmt.Fprintf(buffer, "  if result[%s] == nil then result[%s] = {} end\n", name, name)
+	fmt.Fprintf(buffer, "  result, data = result[%s], data[%s]\n", name, name)
+	fmt.Fprintf(buffer, "  for k,v in pairs(data) do\n")
+	fmt.Fprintf(buffer, "    if result[k] == nil then result[k] = {objects=0, periods={}} end\n")
+	fmt.Fprintf(buffer, "    result[k].objects = result[k].objects + v.objects\n")
+	fmt.Fprintf(buffer, "    for period,count in pairs(v.periods) do result[k].periods[period] = (result[k].periods[period] or 0) + count end\n")
+	fmt.Fprintf(buffer, "  end\n")
+	fmt.Fprintf(buffer, "end\n")
+
+	return buffer.String(), nil
+}
+
+// Generates Lua code for a cohort or return expression.
+func (r *QueryRetention) codegenExpression(expression string) (string, error) {
+	expr, err := ParseExpression(expression)
+	if err != nil {
+		return "", fmt.Errorf("skyd.QueryRetention: Invalid expression: %v", err)
+	}
+	code, err := r.query.newExpressionCompiler("cursor.event").CompileCondition(expr)
+	if err != nil {
+		return "", fmt.Errorf("skyd.QueryRetention: %v", err)
+	}
+	return code, nil
+}
+
+//--------------------------------------
+// Factorization
+//--------------------------------------
+
+// Converts cohort timestamps into dates.
+func (r *QueryRetention) Defactorize(data interface{}) error {
+	m, ok := data.(map[interface{}]interface{})
+	if !ok {
+		return nil
+	}
+	if cohorts, ok := m[r.Name].(map[interface{}]interface{}); ok {
+		dimension := r.dimension()
+		copy := map[interface{}]interface{}{}
+		for k, v := range cohorts {
+			copy[dimension.label(k)] = v
+		}
+		m[r.Name] = copy
+	}
+	return nil
+}
+
+//--------------------------------------
+// Finalization
+//--------------------------------------
+
+// Converts each cohort's counts into a RetentionCohort.
+func (r *QueryRetention) Finalize(data interface{}) error {
+	m, ok := data.(map[interface{}]interface{})
+	if !ok {
+		return nil
+	}
+	cohorts, ok := m[r.Name].(map[interface{}]interface{})
+	if !ok {
+		return nil
+	}
+
+	for k, v := range cohorts {
+		state, ok := v.(map[interface{}]interface{})
+		if !ok {
+			continue
+		}
+		cohort := &RetentionCohort{Returned: make([]int64, r.Periods), Retention: make([]float64, r.Periods)}
+		if objects, ok := castFloat64(state["objects"]); ok {
+			cohort.Objects = int64(objects)
+		}
+		if periods, ok := state["periods"].(map[interface{}]interface{}); ok {
+			for period, count := range periods {
+				index, ok := normalize(period).(int64)
+				if !ok || index < 1 || int(index) > r.Periods {
+					continue
+				}
+				if count, ok := castFloat64(count); ok {
+					cohort.Returned[index-1] = int64(count)
+				}
+			}
+		}
+		if cohort.Objects > 0 {
+			for i, count := range cohort.Returned {
+				cohort.Retention[i] = float64(count) / float64(cohort.Objects)
+			}
+		}
+		cohorts[k] = cohort
+	}
+	return nil
+}
@@ -0,0 +1,26 @@
+package skyd
+
+import (
+	"testing"
+)
+
+// Ensure that invalid retention steps are rejected.
+func TestQueryRetentionDeserializeErrors(t *testing.T) {
+	tests := []struct {
+		obj map[string]interface{}
+		exp string
+	}{
+		{map[string]interface{}{"type": "retention"}, `skyd.QueryRetention: Invalid name: <nil>`},
+		{map[string]interface{}{"type": "retention", "name": "x", "cohort": 1.0}, `skyd.QueryRetention: Invalid 'cohort': 1`},
+		{map[string]interface{}{"type": "retention", "name": "x", "unit": "hour"}, `skyd.QueryRetention: Invalid 'unit': hour`},
+		{map[string]interface{}{"type": "retention", "name": "x", "periods": 0.0}, `skyd.QueryRetention: Invalid 'periods': 0`},
+		{map[string]interface{}{"type": "retention", "name": "x", "periods": 1.5}, `skyd.QueryRetention: Invalid 'periods': 1.5`},
+		{map[string]interface{}{"type": "retention", "name": "x", "periods": 1e9}, `skyd.QueryRetention: Invalid 'periods': 1e+09`},
+	}
+	for i, test := range tests {
+		err := NewQueryRetention(NewQuery(nil, nil)).Deserialize(test.obj)
+		if err == nil || err.Error() != test.exp {
+			t.Fatalf("[%d] Expected error %q, got %v", i, test.exp, err)
+		}
+	}
+}
@@ -132,7 +132,9 @@ func (s *QuerySelection) Deserialize(obj map[string]interface{}) error {
 		for _, field := range fields {
 			if fieldMap, ok := field.(map[string]interface{}); ok {
 				f := NewQuerySelectionField("", "")
-				f.Deserialize(fieldMap)
+				if err := f.Deserialize(fieldMap); err != nil {
+					return err
+				}
 				s.Fields = append(s.Fields, f)
 			} else {
 				return fmt.Errorf("skyd.QuerySelection: Invalid field: %v", field)
@@ -149,6 +151,23 @@ func (s *QuerySelection) Deserialize(obj map[string]interface{}) error {
 	return nil
 }
 
+//--------------------------------------
+// Dimensions
+//--------------------------------------
+
+// Parses each of the dimensions of the selection.
+func (s *QuerySelection) parseDimensions() ([]*queryDimension, error) {
+	dimensions := []*queryDimension{}
+	for _, text := range s.Dimensions {
+		dimension, err := parseQueryDimension(s.query.table, text)
+		if err != nil {
+			return nil, err
+		}
+		dimensions = append(dimensions, dimension)
+	}
+	return dimensions, nil
+}
+
 //--------------------------------------
 // Code Generation
 //--------------------------------------
@@ -157,6 +176,20 @@ func (s *QuerySelection) Deserialize(obj map[string]interface{}) error {
 func (s *QuerySelection) CodegenAggregateFunction() (string, error) {
 	buffer := new(bytes.Buffer)
 
+	dimensions, err := s.parseDimensions()
+	if err != nil {
+		return "", err
+	}
+
+	// Generate constant tables used by the dimensions.
+	tables := make([]string, len(dimensions))
+	for i, dimension := range dimensions {
+		if table := dimension.codegenTable(); table != "" {
+			tables[i] = fmt.Sprintf("%s_d%d", s.FunctionName(), i)
+			fmt.Fprintf(buffer, "local %s = %s\n", tables[i], table)
+		}
+	}
+
 	// Generate main function.
 	fmt.Fprintf(buffer, "function %s(cursor, data)\n", s.FunctionName())
 
@@ -167,16 +200,18 @@ func (s *QuerySelection) CodegenAggregateFunction() (string, error) {
 	}
 
 	// Group by dimension.
-	for _, dimension := range s.Dimensions {
-		fmt.Fprintf(buffer, "  dimension = cursor.event:%s()\n", dimension)
-		fmt.Fprintf(buffer, "  if data.%s == nil then data.%s = {} end\n", dimension, dimension)
-		fmt.Fprintf(buffer, "  if data.%s[dimension] == nil then data.%s[dimension] = {} end\n", dimension, dimension)
-		fmt.Fprintf(buffer, "  data = data.%s[dimension]\n\n", dimension)
+	for i, dimension := range dimensions {
+		index := dimension.codegenIndex()
+		fmt.Fprintf(buffer, "  dimension = %s\n", dimension.codegenExpression(tables[i]))
+		fmt.Fprintf(buffer, "  if data%s == nil then data%s = {} end\n", index, index)
+		fmt.Fprintf(buffer, "  if data%s[dimension] == nil then data%s[dimension] = {} end\n", index, index)
+		fmt.Fprintf(buffer, "  data = data%s[dimension]\n\n", index)
 	}
 
 	// Select fields.
+	compiler := s.query.newExpressionCompiler("cursor.event")
 	for _, field := range s.Fields {
-		exp, err := field.CodegenExpression()
+		exp, err := field.CodegenExpression(compiler)
 		if err != nil {
 			return "", err
 		}
@@ -230,16 +265,21 @@ func (s *QuerySelection) CodegenInnerMergeFunction(index int) (string, error) {
 	// the leaf merge.
 	fmt.Fprintf(buffer, "function %sn%d(result, data)\n", s.MergeFunctionName(), index)
 	if index < len(s.Dimensions) {
-		dimension := s.Dimensions[index]
-		fmt.Fprintf(buffer, "  if data ~= nil and data.%s ~= nil then\n", dimension)
-		fmt.Fprintf(buffer, "    if result.%s == nil then result.%s = {} end\n", dimension, dimension)
-		fmt.Fprintf(buffer, "    for k,v in pairs(data.%s) do\n", dimension)
-		fmt.Fprintf(buffer, "      if result.%s[k] == nil then result.%s[k] = {} end\n", dimension, dimension)
-		fmt.Fprintf(buffer, "      %sn%d(result.%s[k], v)\n", s.MergeFunctionName(), (index + 1), dimension)
+		dimension, err := parseQueryDimension(s.query.table, s.Dimensions[index])
+		if err != nil {
+			return "", err
+		}
+		i := dimension.codegenIndex()
+		fmt.Fprintf(buffer, "  if data ~= nil and data%s ~= nil then\n", i)
+		fmt.Fprintf(buffer, "    if result%s == nil then result%s = {} end\n", i, i)
+		fmt.Fprintf(buffer, "    for k,v in pairs(data%s) do\n", i)
+		fmt.Fprintf(buffer, "      if result%s[k] == nil then result%s[k] = {} end\n", i, i)
+		fmt.Fprintf(buffer, "      %sn%d(result%s[k], v)\n", s.MergeFunctionName(), (index + 1), i)
 		fmt.Fprintf(buffer, "    end\n")
 		fmt.Fprintf(buffer, "  end\n")
 	} else {
-		// Merge fields.
+		// Merge fields. Named selections may be missing from a servlet.
+		fmt.Fprintf(buffer, "  if data == nil then return end\n")
 		for _, field := range s.Fields {
 			exp, err := field.CodegenMergeExpression()
 			if err != nil {
@@ -253,6 +293,79 @@ func (s *QuerySelection) CodegenInnerMergeFunction(index int) (string, error) {
 	return buffer.String(), nil
 }
 
+//--------------------------------------
+// Merging
+//--------------------------------------
+
+// Returns whether the selection can be merged in Go. All built-in field
+// types support native merging.
+func (s *QuerySelection) NativeMergeable() bool {
+	for _, field := range s.Fields {
+		if _, _, err := field.parse(); err != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// Merges the aggregate results of the selection in Go.
+func (s *QuerySelection) MergeNative(result map[interface{}]interface{}, data map[interface{}]interface{}) error {
+	// If this is a named selection then drill in first.
+	if s.Name != "" {
+		inner, ok := data[s.Name].(map[interface{}]interface{})
+		if !ok {
+			return nil
+		}
+		outer, ok := result[s.Name].(map[interface{}]interface{})
+		if !ok {
+			outer = map[interface{}]interface{}{}
+			result[s.Name] = outer
+		}
+		result, data = outer, inner
+	}
+
+	return s.mergeNative(result, data, 0)
+}
+
+// Recursively merges dimensions and then fields.
+func (s *QuerySelection) mergeNative(result map[interface{}]interface{}, data map[interface{}]interface{}, index int) error {
+	if index >= len(s.Dimensions) {
+		for _, field := range s.Fields {
+			if err := field.Merge(result, data); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	dimension := s.Dimensions[index]
+	outer, ok := data[dimension].(map[interface{}]interface{})
+	if !ok {
+		return nil
+	}
+	target, ok := result[dimension].(map[interface{}]interface{})
+	if !ok {
+		target = map[interface{}]interface{}{}
+		result[dimension] = target
+	}
+	for k, v := range outer {
+		inner, ok := v.(map[interface{}]interface{})
+		if !ok {
+			continue
+		}
+		key := normalize(k)
+		m, ok := target[key].(map[interface{}]interface{})
+		if !ok {
+			m = map[interface{}]interface{}{}
+			target[key] = m
+		}
+		if err := s.mergeNative(m, inner, index+1); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 //--------------------------------------
 // Factorization
 //--------------------------------------
@@ -276,47 +389,105 @@ func (s *QuerySelection) Defactorize(data interface{}) error {
 	return nil
 }
 
-// Recursively defactorizes dimensions.
+// Recursively defactorizes dimensions and then fields.
 func (s *QuerySelection) defactorize(data interface{}, index int) error {
-	if index >= len(s.Dimensions) {
-		return nil
-	}
 	// Ignore any values that are nil or not maps.
 	inner, ok := data.(map[interface{}]interface{})
 	if !ok || data == nil {
 		return nil
 	}
+	if index >= len(s.Dimensions) {
+		return s.defactorizeFields(inner)
+	}
 
-	// Retrieve property.
-	dimension := s.Dimensions[index]
-	property := s.query.table.propertyFile.GetPropertyByName(dimension)
-	if property == nil {
-		return fmt.Errorf("skyd.QuerySelection: Property not found: %s", dimension)
+	// Retrieve dimension.
+	dimension, err := parseQueryDimension(s.query.table, s.Dimensions[index])
+	if err != nil {
+		return err
 	}
 
 	// Defactorize.
-	if outer, ok := inner[dimension].(map[interface{}]interface{}); ok {
+	if outer, ok := inner[dimension.text].(map[interface{}]interface{}); ok {
 		copy := map[interface{}]interface{}{}
 		for k, v := range outer {
-			if property.DataType == FactorDataType {
-				if sequence, ok := normalize(k).(int64); ok {
-					stringValue, err := s.query.factors.Defactorize(s.query.table.Name, dimension, uint64(sequence))
-					if err != nil {
-						return err
-					}
-					copy[stringValue] = v
-				} else {
-					return fmt.Errorf("Invalid factor sequence: %v", k)
+			key, err := dimension.defactorize(s.query, k)
+			if err != nil {
+				return err
+			}
+			copy[key] = v
+
+			// Defactorize next dimension.
+			if err := s.defactorize(v, index+1); err != nil {
+				return err
+			}
+		}
+		inner[dimension.text] = copy
+	}
+
+	return nil
+}
+
+// Defactorizes the values of fields that return factor properties.
+func (s *QuerySelection) defactorizeFields(data map[interface{}]interface{}) error {
+	for _, field := range s.Fields {
+		property := field.factorProperty(s.query.table)
+		if property == nil {
+			continue
+		}
+		if state, ok := data[field.Name].(map[interface{}]interface{}); ok {
+			if sequence, ok := normalize(state["value"]).(int64); ok {
+				stringValue, err := s.query.factors.Defactorize(s.query.table.Name, property.Name, uint64(sequence))
+				if err != nil {
+					return err
 				}
+				state["value"] = stringValue
+			}
+		}
+	}
+	return nil
+}
+
+//--------------------------------------
+// Finalization
+//--------------------------------------
+
+// Converts the intermediate state of aggregate fields into final values.
+func (s *QuerySelection) Finalize(data interface{}) error {
+	if m, ok := data.(map[interface{}]interface{}); ok {
+		if s.Name != "" {
+			if m2, ok := m[s.Name].(map[interface{}]interface{}); ok {
+				m = m2
 			} else {
-				copy[k] = v
+				return nil
 			}
+		}
+		return s.finalize(m, 0)
+	}
+	return nil
+}
 
-			// Defactorize next dimension.
-			s.defactorize(v, index+1)
+// Recursively walks dimensions and finalizes the fields at the leaves.
+func (s *QuerySelection) finalize(data interface{}, index int) error {
+	inner, ok := data.(map[interface{}]interface{})
+	if !ok {
+		return nil
+	}
+
+	if index >= len(s.Dimensions) {
+		for _, field := range s.Fields {
+			if err := field.Finalize(inner); err != nil {
+				return err
+			}
 		}
-		inner[dimension] = copy
+		return nil
 	}
 
+	if outer, ok := inner[s.Dimensions[index]].(map[interface{}]interface{}); ok {
+		for _, v := range outer {
+			if err := s.finalize(v, index+1); err != nil {
+				return err
+			}
+		}
+	}
 	return nil
 }
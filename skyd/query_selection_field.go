@@ -3,9 +3,36 @@ package skyd
 import (
 	"errors"
 	"fmt"
-	"regexp"
+	"math"
+	"strings"
 )
 
+//------------------------------------------------------------------------------
+//
+// Constants
+//
+//------------------------------------------------------------------------------
+
+// Aggregate functions available to selection fields. An empty function name
+// means the field is a plain assignment.
+const (
+	QuerySelectionFieldCount         = "count"
+	QuerySelectionFieldCountObjects  = "count_objects"
+	QuerySelectionFieldSum           = "sum"
+	QuerySelectionFieldMin           = "min"
+	QuerySelectionFieldMax           = "max"
+	QuerySelectionFieldAvg           = "avg"
+	QuerySelectionFieldFirst         = "first"
+	QuerySelectionFieldLast          = "last"
+	QuerySelectionFieldCountDistinct = "count_distinct"
+	QuerySelectionFieldStddev        = "stddev"
+	QuerySelectionFieldPercentile    = "percentile"
+	QuerySelectionFieldHistogram     = "histogram"
+)
+
+// The maximum number of buckets a histogram() field can return.
+const MaxQuerySelectionFieldHistogramBuckets = 1000
+
 //------------------------------------------------------------------------------
 //
 // Typedefs
@@ -25,7 +52,7 @@ type QuerySelectionField struct {
 
 // Creates a new selection field.
 func NewQuerySelectionField(name string, expression string) *QuerySelectionField {
-	return &QuerySelectionField{Name:name, Expression:expression}
+	return &QuerySelectionField{Name: name, Expression: expression}
 }
 
 //------------------------------------------------------------------------------
@@ -70,52 +97,408 @@ func (f *QuerySelectionField) Deserialize(obj map[string]interface{}) error {
 	return nil
 }
 
+//--------------------------------------
+// Parsing
+//--------------------------------------
+
+// Parses the expression into an aggregate function name and its arguments.
+// Plain property references return an empty function name.
+func (f *QuerySelectionField) parse() (string, []Expression, error) {
+	expr, err := ParseExpression(f.Expression)
+	if err != nil {
+		return "", nil, fmt.Errorf("skyd.QuerySelectionField: %v", err)
+	}
+
+	switch expr := expr.(type) {
+	case *VarRef:
+		return "", []Expression{expr}, nil
+	case *CallExpression:
+		fn := strings.ToLower(expr.Name)
+		argc := 1
+		switch fn {
+		case QuerySelectionFieldCount, QuerySelectionFieldCountObjects:
+			argc = 0
+		case QuerySelectionFieldPercentile, QuerySelectionFieldHistogram:
+			argc = 2
+		case QuerySelectionFieldSum, QuerySelectionFieldMin, QuerySelectionFieldMax,
+			QuerySelectionFieldAvg, QuerySelectionFieldFirst, QuerySelectionFieldLast,
+			QuerySelectionFieldCountDistinct, QuerySelectionFieldStddev:
+		default:
+			return "", nil, fmt.Errorf("skyd.QuerySelectionField: Unknown function: %s", expr.Name)
+		}
+		if len(expr.Args) != argc {
+			return "", nil, fmt.Errorf("skyd.QuerySelectionField: %s() expects %d argument(s): %q", fn, argc, f.Expression)
+		}
+		if argc == 2 {
+			if _, err := f.parameter(fn, expr.Args); err != nil {
+				return "", nil, err
+			}
+		}
+		return fn, expr.Args, nil
+	}
+
+	return "", nil, fmt.Errorf("skyd.QuerySelectionField: Invalid expression: %q", f.Expression)
+}
+
+// Retrieves the numeric second argument of percentile() and histogram().
+// Percentiles must be between 0 and 100 and bucket counts must be positive
+// integers no larger than the maximum.
+func (f *QuerySelectionField) parameter(fn string, args []Expression) (float64, error) {
+	literal, ok := args[1].(*NumberLiteral)
+	if ok {
+		switch fn {
+		case QuerySelectionFieldPercentile:
+			ok = literal.Value >= 0 && literal.Value <= 100
+		case QuerySelectionFieldHistogram:
+			ok = literal.Value >= 1 && literal.Value <= MaxQuerySelectionFieldHistogramBuckets && literal.Value == float64(int(literal.Value))
+		}
+	}
+	if !ok {
+		return 0, fmt.Errorf("skyd.QuerySelectionField: Invalid %s() parameter: %s", fn, args[1].String())
+	}
+	return literal.Value, nil
+}
+
+// Retrieves the factor property whose values are returned by the field, if
+// any. Only first() and last() return raw property values that need to be
+// defactorized.
+func (f *QuerySelectionField) factorProperty(table *Table) *Property {
+	fn, args, err := f.parse()
+	if err != nil || (fn != QuerySelectionFieldFirst && fn != QuerySelectionFieldLast) {
+		return nil
+	}
+	if ref, ok := args[0].(*VarRef); ok && table != nil && table.propertyFile != nil {
+		if property := table.propertyFile.GetPropertyByName(ref.Name); property != nil && property.DataType == FactorDataType {
+			return property
+		}
+	}
+	return nil
+}
+
 //--------------------------------------
 // Code Generation
 //--------------------------------------
 
 // Generates Lua code for the expression.
-func (f *QuerySelectionField) CodegenExpression() (string, error) {
-	r, _ := regexp.Compile(`^ *(?:count\(\)|(sum|min|max)\((\w+)\)|(\w+)) *$`)
-	if m := r.FindStringSubmatch(f.Expression); m != nil {
-		if len(m[1]) > 0 { // sum()/min()/max()
-			switch m[1] {
-			case "sum":
-				return fmt.Sprintf("data.%s = (data.%s or 0) + cursor.event:%s()", f.Name, f.Name, m[2]), nil
-			case "min":
-				return fmt.Sprintf("if(data.%s == nil or data.%s > cursor.event:%s()) then data.%s = cursor.event:%s() end", f.Name, f.Name, m[2], f.Name, m[2]), nil
-			case "max":
-				return fmt.Sprintf("if(data.%s == nil or data.%s < cursor.event:%s()) then data.%s = cursor.event:%s() end", f.Name, f.Name, m[2], f.Name, m[2]), nil
+func (f *QuerySelectionField) CodegenExpression(compiler *ExpressionCompiler) (string, error) {
+	fn, args, err := f.parse()
+	if err != nil {
+		return "", err
+	}
+
+	// Compile the argument and check that it makes sense for the function.
+	var value, dataType string
+	if len(args) > 0 {
+		if value, dataType, err = compiler.CompileValue(args[0]); err != nil {
+			return "", fmt.Errorf("skyd.QuerySelectionField: %v", err)
+		}
+		switch fn {
+		case QuerySelectionFieldSum, QuerySelectionFieldAvg, QuerySelectionFieldStddev,
+			QuerySelectionFieldPercentile, QuerySelectionFieldHistogram:
+			if !isNumericDataType(dataType) {
+				return "", fmt.Errorf("skyd.QuerySelectionField: %s() requires a numeric argument: %q", fn, f.Expression)
 			}
-		} else if len(m[3]) > 0 { // assignment
-			return fmt.Sprintf("data.%s = cursor.event:%s()", f.Name, m[3]), nil
-		} else { // count()
-			return fmt.Sprintf("data.%s = (data.%s or 0) + 1", f.Name, f.Name), nil
 		}
 	}
 
-	return "", fmt.Errorf("skyd.QuerySelectionField: Invalid expression: %q", f.Expression)
+	name := f.Name
+	switch fn {
+	case QuerySelectionFieldCount:
+		return fmt.Sprintf("data.%s = (data.%s or 0) + 1", name, name), nil
+	case QuerySelectionFieldCountObjects:
+		// Objects only live in one servlet so remembering the last object
+		// counted is enough to count each object once per bucket.
+		return fmt.Sprintf("if data.%s == nil then data.%s = {count=0, object=0} end\n"+
+			"  if data.%s.object ~= sky_object_index then\n"+
+			"    data.%s.object = sky_object_index\n"+
+			"    data.%s.count = data.%s.count + 1\n"+
+			"  end", name, name, name, name, name, name), nil
+	case QuerySelectionFieldSum:
+		return fmt.Sprintf("data.%s = (data.%s or 0) + %s", name, name, value), nil
+	case QuerySelectionFieldMin:
+		return fmt.Sprintf("if(data.%s == nil or data.%s > %s) then data.%s = %s end", name, name, value, name, value), nil
+	case QuerySelectionFieldMax:
+		return fmt.Sprintf("if(data.%s == nil or data.%s < %s) then data.%s = %s end", name, name, value, name, value), nil
+	case QuerySelectionFieldAvg:
+		return fmt.Sprintf("if data.%s == nil then data.%s = {sum=0, count=0} end\n"+
+			"  data.%s.sum = data.%s.sum + %s\n"+
+			"  data.%s.count = data.%s.count + 1", name, name, name, name, value, name, name), nil
+	case QuerySelectionFieldFirst:
+		return fmt.Sprintf("if data.%s == nil or cursor.event.timestamp < data.%s.timestamp then data.%s = {timestamp=cursor.event.timestamp, value=%s} end", name, name, name, value), nil
+	case QuerySelectionFieldLast:
+		return fmt.Sprintf("if data.%s == nil or cursor.event.timestamp >= data.%s.timestamp then data.%s = {timestamp=cursor.event.timestamp, value=%s} end", name, name, name, value), nil
+	case QuerySelectionFieldCountDistinct:
+		return fmt.Sprintf("if data.%s == nil then data.%s = {} end\n"+
+			"  data.%s[%s] = true", name, name, name, value), nil
+	case QuerySelectionFieldStddev:
+		// Welford's online algorithm keeps the running mean and the sum of
+		// squared differences so that partial results can be combined.
+		return fmt.Sprintf("if data.%s == nil then data.%s = {count=0, mean=0, m2=0} end\n"+
+			"  do\n"+
+			"    local value = %s\n"+
+			"    local delta = value - data.%s.mean\n"+
+			"    data.%s.count = data.%s.count + 1\n"+
+			"    data.%s.mean = data.%s.mean + delta / data.%s.count\n"+
+			"    data.%s.m2 = data.%s.m2 + delta * (value - data.%s.mean)\n"+
+			"  end", name, name, value, name, name, name, name, name, name, name, name, name), nil
+	case QuerySelectionFieldPercentile, QuerySelectionFieldHistogram:
+		return fmt.Sprintf("if data.%s == nil then data.%s = sky_tdigest_new() end\n"+
+			"  sky_tdigest_add(data.%s, %s)", name, name, name, value), nil
+	}
+
+	// Assignment.
+	return fmt.Sprintf("data.%s = %s", name, value), nil
 }
 
 // Generates Lua code for the merge expression.
 func (f *QuerySelectionField) CodegenMergeExpression() (string, error) {
-	r, _ := regexp.Compile(`^ *(?:count\(\)|(sum|min|max)\((\w+)\)|(\w+)) *$`)
-	if m := r.FindStringSubmatch(f.Expression); m != nil {
-		if len(m[1]) > 0 { // sum()/min()/max()
-			switch m[1] {
-			case "sum":
-				return fmt.Sprintf("result.%s = (result.%s or 0) + (data.%s or 0)", f.Name, f.Name, f.Name), nil
-			case "min":
-				return fmt.Sprintf("if(result.%s == nil or result.%s > data.%s) then result.%s = data.%s end", f.Name, f.Name, f.Name, f.Name, f.Name), nil
-			case "max":
-				return fmt.Sprintf("if(result.%s == nil or result.%s < data.%s) then result.%s = data.%s end", f.Name, f.Name, f.Name, f.Name, f.Name), nil
+	fn, _, err := f.parse()
+	if err != nil {
+		return "", err
+	}
+
+	name := f.Name
+	switch fn {
+	case QuerySelectionFieldCount, QuerySelectionFieldSum:
+		return fmt.Sprintf("result.%s = (result.%s or 0) + (data.%s or 0)", name, name, name), nil
+	case QuerySelectionFieldCountObjects:
+		return fmt.Sprintf("if data.%s ~= nil then\n"+
+			"    if result.%s == nil then result.%s = {count=0} end\n"+
+			"    result.%s.count = result.%s.count + data.%s.count\n"+
+			"  end", name, name, name, name, name, name), nil
+	case QuerySelectionFieldMin:
+		return fmt.Sprintf("if(result.%s == nil or result.%s > data.%s) then result.%s = data.%s end", name, name, name, name, name), nil
+	case QuerySelectionFieldMax:
+		return fmt.Sprintf("if(result.%s == nil or result.%s < data.%s) then result.%s = data.%s end", name, name, name, name, name), nil
+	case QuerySelectionFieldAvg:
+		return fmt.Sprintf("if data.%s ~= nil then\n"+
+			"    if result.%s == nil then result.%s = {sum=0, count=0} end\n"+
+			"    result.%s.sum = result.%s.sum + data.%s.sum\n"+
+			"    result.%s.count = result.%s.count + data.%s.count\n"+
+			"  end", name, name, name, name, name, name, name, name, name), nil
+	case QuerySelectionFieldFirst:
+		return fmt.Sprintf("if data.%s ~= nil and (result.%s == nil or data.%s.timestamp < result.%s.timestamp) then result.%s = data.%s end", name, name, name, name, name, name), nil
+	case QuerySelectionFieldLast:
+		return fmt.Sprintf("if data.%s ~= nil and (result.%s == nil or data.%s.timestamp > result.%s.timestamp) then result.%s = data.%s end", name, name, name, name, name, name), nil
+	case QuerySelectionFieldCountDistinct:
+		return fmt.Sprintf("if data.%s ~= nil then\n"+
+			"    if result.%s == nil then result.%s = {} end\n"+
+			"    for k in pairs(data.%s) do result.%s[k] = true end\n"+
+			"  end", name, name, name, name, name), nil
+	case QuerySelectionFieldStddev:
+		return fmt.Sprintf("if data.%s ~= nil then\n"+
+			"    if result.%s == nil or result.%s.count == 0 then\n"+
+			"      result.%s = data.%s\n"+
+			"    elseif data.%s.count > 0 then\n"+
+			"      local a, b = result.%s, data.%s\n"+
+			"      local count = a.count + b.count\n"+
+			"      local delta = b.mean - a.mean\n"+
+			"      a.mean = a.mean + delta * b.count / count\n"+
+			"      a.m2 = a.m2 + b.m2 + delta * delta * a.count * b.count / count\n"+
+			"      a.count = count\n"+
+			"    end\n"+
+			"  end", name, name, name, name, name, name, name, name), nil
+	case QuerySelectionFieldPercentile, QuerySelectionFieldHistogram:
+		return fmt.Sprintf("result.%s = sky_tdigest_merge(result.%s, data.%s)", name, name, name), nil
+	}
+
+	// Assignment.
+	return fmt.Sprintf("result.%s = data.%s", name, name), nil
+}
+
+//--------------------------------------
+// Merging
+//--------------------------------------
+
+// Merges the intermediate state of the field from one aggregate result into
+// another. This mirrors the merge expression without a round trip into Lua.
+func (f *QuerySelectionField) Merge(result map[interface{}]interface{}, data map[interface{}]interface{}) error {
+	fn, _, err := f.parse()
+	if err != nil {
+		return err
+	}
+
+	name := f.Name
+	value, ok := data[name]
+	if !ok || value == nil {
+		return nil
+	}
+	prev, exists := result[name]
+	if !exists || prev == nil {
+		result[name] = value
+		return nil
+	}
+
+	switch fn {
+	case QuerySelectionFieldCount, QuerySelectionFieldSum:
+		result[name] = addNumbers(prev, value)
+
+	case QuerySelectionFieldCountObjects:
+		a, _ := prev.(map[interface{}]interface{})
+		b, _ := value.(map[interface{}]interface{})
+		result[name] = map[interface{}]interface{}{"count": addNumbers(a["count"], b["count"])}
+
+	case QuerySelectionFieldMin, QuerySelectionFieldMax:
+		if (fn == QuerySelectionFieldMin && lessThan(value, prev)) || (fn == QuerySelectionFieldMax && lessThan(prev, value)) {
+			result[name] = value
+		}
+
+	case QuerySelectionFieldAvg:
+		a, _ := prev.(map[interface{}]interface{})
+		b, _ := value.(map[interface{}]interface{})
+		result[name] = map[interface{}]interface{}{
+			"sum":   addNumbers(a["sum"], b["sum"]),
+			"count": addNumbers(a["count"], b["count"]),
+		}
+
+	case QuerySelectionFieldFirst, QuerySelectionFieldLast:
+		a, _ := prev.(map[interface{}]interface{})
+		b, _ := value.(map[interface{}]interface{})
+		at, _ := castFloat64(a["timestamp"])
+		bt, _ := castFloat64(b["timestamp"])
+		if (fn == QuerySelectionFieldFirst && bt < at) || (fn == QuerySelectionFieldLast && bt > at) {
+			result[name] = value
+		}
+
+	case QuerySelectionFieldCountDistinct:
+		a, _ := prev.(map[interface{}]interface{})
+		b, _ := value.(map[interface{}]interface{})
+		set := map[interface{}]interface{}{}
+		for k := range a {
+			set[normalize(k)] = true
+		}
+		for k := range b {
+			set[normalize(k)] = true
+		}
+		result[name] = set
+
+	case QuerySelectionFieldStddev:
+		a, _ := prev.(map[interface{}]interface{})
+		b, _ := value.(map[interface{}]interface{})
+		ac, _ := castFloat64(a["count"])
+		bc, _ := castFloat64(b["count"])
+		if ac == 0 {
+			result[name] = value
+		} else if bc > 0 {
+			am, _ := castFloat64(a["mean"])
+			bm, _ := castFloat64(b["mean"])
+			am2, _ := castFloat64(a["m2"])
+			bm2, _ := castFloat64(b["m2"])
+			count := ac + bc
+			delta := bm - am
+			result[name] = map[interface{}]interface{}{
+				"count": count,
+				"mean":  am + delta*bc/count,
+				"m2":    am2 + bm2 + delta*delta*ac*bc/count,
 			}
-		} else if len(m[3]) > 0 { // assignment
-			return fmt.Sprintf("result.%s = data.%s", f.Name, f.Name), nil
-		} else { // count()
-			return fmt.Sprintf("result.%s = (result.%s or 0) + (data.%s or 0)", f.Name, f.Name, f.Name), nil
 		}
+
+	case QuerySelectionFieldPercentile, QuerySelectionFieldHistogram:
+		d := newTDigestFromState(prev)
+		d.merge(newTDigestFromState(value))
+		result[name] = d.state()
+
+	default:
+		// Assignment.
+		result[name] = value
+	}
+
+	return nil
+}
+
+//--------------------------------------
+// Finalization
+//--------------------------------------
+
+// Converts the intermediate state of the field into its final value after
+// all results have been merged.
+func (f *QuerySelectionField) Finalize(data map[interface{}]interface{}) error {
+	fn, args, err := f.parse()
+	if err != nil {
+		return err
+	}
+
+	value, ok := data[f.Name]
+	if !ok {
+		return nil
 	}
 
-	return "", fmt.Errorf("skyd.QuerySelectionField: Invalid merge expression: %q", f.Expression)
+	switch fn {
+	case QuerySelectionFieldCountObjects:
+		state, _ := value.(map[interface{}]interface{})
+		count, _ := castFloat64(state["count"])
+		data[f.Name] = int64(count)
+
+	case QuerySelectionFieldAvg:
+		state, _ := value.(map[interface{}]interface{})
+		sum, _ := castFloat64(state["sum"])
+		count, _ := castFloat64(state["count"])
+		if count > 0 {
+			data[f.Name] = sum / count
+		} else {
+			data[f.Name] = nil
+		}
+
+	case QuerySelectionFieldFirst, QuerySelectionFieldLast:
+		if state, ok := value.(map[interface{}]interface{}); ok {
+			data[f.Name] = state["value"]
+		}
+
+	case QuerySelectionFieldCountDistinct:
+		state, _ := value.(map[interface{}]interface{})
+		data[f.Name] = len(state)
+
+	case QuerySelectionFieldStddev:
+		// This is the population standard deviation since the selected
+		// events are treated as the whole population, not as a sample.
+		state, _ := value.(map[interface{}]interface{})
+		count, _ := castFloat64(state["count"])
+		m2, _ := castFloat64(state["m2"])
+		if count > 0 {
+			data[f.Name] = math.Sqrt(m2 / count)
+		} else {
+			data[f.Name] = nil
+		}
+
+	case QuerySelectionFieldPercentile:
+		p, _ := f.parameter(fn, args)
+		data[f.Name] = newTDigestFromState(value).quantile(p / 100)
+
+	case QuerySelectionFieldHistogram:
+		buckets, _ := f.parameter(fn, args)
+		data[f.Name] = newTDigestFromState(value).histogram(int(buckets))
+	}
+
+	return nil
+}
+
+//------------------------------------------------------------------------------
+//
+// Functions
+//
+//------------------------------------------------------------------------------
+
+// Compares two numbers or two strings. Strings are compared by byte value to
+// match Lua.
+func lessThan(a interface{}, b interface{}) bool {
+	if x, ok := castString(a); ok {
+		y, _ := castString(b)
+		return x < y
+	}
+	x, _ := castFloat64(a)
+	y, _ := castFloat64(b)
+	return x < y
+}
+
+// Adds two numbers. Integers stay integers unless either value is a float.
+func addNumbers(a interface{}, b interface{}) interface{} {
+	x, y := normalize(a), normalize(b)
+	if x, ok := x.(int64); ok {
+		if y, ok := y.(int64); ok {
+			return x + y
+		}
+	}
+	fx, _ := castFloat64(x)
+	fy, _ := castFloat64(y)
+	return fx + fy
 }
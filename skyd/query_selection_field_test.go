@@ -0,0 +1,62 @@
+package skyd
+
+import (
+	"fmt"
+	"testing"
+)
+
+// Ensure that invalid selection field expressions are rejected.
+func TestQuerySelectionFieldCodegenExpressionErrors(t *testing.T) {
+	table := createTempTable(t)
+	table.Open()
+	defer table.Close()
+	table.CreateProperty("state", false, FactorDataType)
+	table.CreateProperty("price", true, FloatDataType)
+
+	tests := []struct {
+		expression string
+		exp        string
+	}{
+		{`avg(state)`, `skyd.QuerySelectionField: avg() requires a numeric argument: "avg(state)"`},
+		{`median(price)`, `skyd.QuerySelectionField: Unknown function: median`},
+		{`count(price)`, `skyd.QuerySelectionField: count() expects 0 argument(s): "count(price)"`},
+		{`stddev(foo)`, `skyd.QuerySelectionField: Property not found: foo`},
+		{`price == 1`, `skyd.QuerySelectionField: Invalid expression: "price == 1"`},
+		{`sum(price * state)`, `skyd.QuerySelectionField: Operands of '*' must be numeric: (price * state)`},
+		{`sum(-state)`, `skyd.QuerySelectionField: Operand of '-' must be numeric: (-state)`},
+		{`histogram(price, 1000000000)`, `skyd.QuerySelectionField: Invalid histogram() parameter: 1000000000`},
+	}
+	for i, test := range tests {
+		f := NewQuerySelectionField("x", test.expression)
+		_, err := f.CodegenExpression(NewExpressionCompiler(table, nil, "cursor.event"))
+		if err == nil || err.Error() != test.exp {
+			t.Fatalf("[%d] Wrong error for %q:\nexp: %s\ngot: %v", i, test.expression, test.exp, err)
+		}
+	}
+}
+
+// Ensure that min() and max() merge strings as well as numbers.
+func TestQuerySelectionFieldMergeMinMax(t *testing.T) {
+	tests := []struct {
+		expression string
+		values     []interface{}
+		exp        interface{}
+	}{
+		{"min(fruit)", []interface{}{"pear", "apple", []byte("grape")}, "apple"},
+		{"max(fruit)", []interface{}{"grape", []byte("pear"), "apple"}, []byte("pear")},
+		{"min(price)", []interface{}{int64(3), 1.5, int64(2)}, 1.5},
+		{"max(price)", []interface{}{int64(3), 1.5, int64(4)}, int64(4)},
+	}
+	for i, test := range tests {
+		f := NewQuerySelectionField("x", test.expression)
+		result := map[interface{}]interface{}{}
+		for _, value := range test.values {
+			if err := f.Merge(result, map[interface{}]interface{}{"x": value}); err != nil {
+				t.Fatalf("[%d] Unable to merge: %v", i, err)
+			}
+		}
+		if fmt.Sprint(result["x"]) != fmt.Sprint(test.exp) {
+			t.Fatalf("[%d] Wrong merge for %s: exp %v, got %v", i, test.expression, test.exp, result["x"])
+		}
+	}
+}
@@ -2,6 +2,7 @@ package skyd
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 )
 
@@ -14,6 +15,9 @@ import (
 const (
 	QueryStepTypeCondition = "condition"
 	QueryStepTypeSelection = "selection"
+	QueryStepTypeFunnel    = "funnel"
+	QueryStepTypeRetention = "retention"
+	QueryStepTypePaths     = "paths"
 )
 
 //------------------------------------------------------------------------------
@@ -31,6 +35,15 @@ type QueryStep interface {
 	CodegenAggregateFunction() (string, error)
 	CodegenMergeFunction() (string, error)
 	Defactorize(data interface{}) error
+	Finalize(data interface{}) error
+}
+
+// A QueryNativeMergeStep is a step whose aggregate results can be merged in
+// Go instead of in Lua.
+type QueryNativeMergeStep interface {
+	QueryStep
+	NativeMergeable() bool
+	MergeNative(result map[interface{}]interface{}, data map[interface{}]interface{}) error
 }
 
 type QueryStepList []QueryStep
@@ -66,6 +79,12 @@ func DeserializeQueryStepList(obj interface{}, q *Query) (QueryStepList, error)
 					step = NewQueryCondition(q)
 				case QueryStepTypeSelection:
 					step = NewQuerySelection(q)
+				case QueryStepTypeFunnel:
+					step = NewQueryFunnel(q)
+				case QueryStepTypeRetention:
+					step = NewQueryRetention(q)
+				case QueryStepTypePaths:
+					step = NewQueryPaths(q)
 				default:
 					return nil, fmt.Errorf("Invalid query step type: %v", s["type"])
 				}
@@ -132,6 +151,34 @@ func (l QueryStepList) CodegenMergeInvoke() string {
 	return buffer.String()
 }
 
+//--------------------------------------
+// Merging
+//--------------------------------------
+
+// Returns whether every step can be merged in Go.
+func (l QueryStepList) NativeMergeable() bool {
+	for _, step := range l {
+		if step, ok := step.(QueryNativeMergeStep); !ok || !step.NativeMergeable() {
+			return false
+		}
+	}
+	return true
+}
+
+// Merges aggregate results in Go for all steps.
+func (l QueryStepList) MergeNative(result map[interface{}]interface{}, data map[interface{}]interface{}) error {
+	for _, step := range l {
+		step, ok := step.(QueryNativeMergeStep)
+		if !ok {
+			return errors.New("skyd.QueryStepList: Native merge not supported.")
+		}
+		if err := step.MergeNative(result, data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 //--------------------------------------
 // Factorization
 //--------------------------------------
@@ -146,3 +193,18 @@ func (l QueryStepList) Defactorize(data interface{}) error {
 	}
 	return nil
 }
+
+//--------------------------------------
+// Finalization
+//--------------------------------------
+
+// Finalizes merged results generated from the merge function.
+func (l QueryStepList) Finalize(data interface{}) error {
+	for _, step := range l {
+		err := step.Finalize(data)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
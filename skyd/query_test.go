@@ -2,7 +2,10 @@ package skyd
 
 import (
 	"bytes"
+	"encoding/json"
+	"fmt"
 	"testing"
+	"time"
 )
 
 // Ensure that we can encode queries.
@@ -28,3 +31,213 @@ func TestQueryEncodeDecode(t *testing.T) {
 		t.Fatalf("Query encoding error:\nexp: %s\ngot: %s", json, buffer.String())
 	}
 }
+
+// Ensure that queries with a time range can be encoded and decoded.
+func TestQueryEncodeDecodeTimeRange(t *testing.T) {
+	table := createTempTable(t)
+	table.Open()
+	defer table.Close()
+
+	json := `{"endTime":"2012-02-01T00:00:00Z","sessionIdleTime":0,"startTime":"2012-01-01T00:00:00Z","steps":[]}` + "\n"
+	q := NewQuery(table, nil)
+	if err := q.Decode(bytes.NewBufferString(json)); err != nil {
+		t.Fatalf("Query decoding error: %v", err)
+	}
+	buffer := new(bytes.Buffer)
+	q.Encode(buffer)
+	if buffer.String() != json {
+		t.Fatalf("Query encoding error:\nexp: %s\ngot: %s", json, buffer.String())
+	}
+
+	// Ranges must be valid.
+	for _, json := range []string{`{"startTime":"2012-01-01","steps":[]}`, `{"startTime":"2012-02-01T00:00:00Z","endTime":"2012-01-01T00:00:00Z","steps":[]}`} {
+		if err := NewQuery(table, nil).Decode(bytes.NewBufferString(json)); err == nil {
+			t.Fatalf("Expected decoding error: %s", json)
+		}
+	}
+}
+
+// Ensure that time ranges can be bound to parameters.
+func TestQueryTimeRangeParams(t *testing.T) {
+	table := createTempTable(t)
+	table.Open()
+	defer table.Close()
+
+	json := `{"endTime":"$to","params":{"to":"2012-02-01T00:00:00Z"},"sessionIdleTime":0,"startTime":"$from","steps":[]}` + "\n"
+	q := NewQuery(table, nil)
+	if err := q.Decode(bytes.NewBufferString(json)); err != nil {
+		t.Fatalf("Query decoding error: %v", err)
+	}
+	buffer := new(bytes.Buffer)
+	q.Encode(buffer)
+	if buffer.String() != json {
+		t.Fatalf("Query encoding error:\nexp: %s\ngot: %s", json, buffer.String())
+	}
+	if !q.StartTime.IsZero() || q.EndTime.Format(time.RFC3339) != "2012-02-01T00:00:00Z" {
+		t.Fatalf("Unexpected time range: %v - %v", q.StartTime, q.EndTime)
+	}
+	if _, err := q.Codegen(); err == nil || err.Error() != "skyd.Query: Unbound parameter: $from" {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	// Bound values must be valid times.
+	for _, json := range []string{`{"startTime":"$from","params":{"from":"2012-01-01"},"steps":[]}`, `{"startTime":"$from","params":{"from":"2012-03-01T00:00:00Z"},"endTime":"2012-01-01T00:00:00Z","steps":[]}`, `{"startTime":"$","steps":[]}`} {
+		if err := NewQuery(table, nil).Decode(bytes.NewBufferString(json)); err == nil {
+			t.Fatalf("Expected decoding error: %s", json)
+		}
+	}
+}
+
+// Ensure that query filters are compiled against the object state.
+func TestQueryCodegenFilter(t *testing.T) {
+	table := createTempTable(t)
+	table.Open()
+	defer table.Close()
+	table.CreateProperty("price", false, FloatDataType)
+
+	q := NewQuery(table, nil)
+	q.Filter = "price > 10"
+	code, err := q.CodegenFilterFunction()
+	if err != nil || code != "function filter(cursor)\n  local event = sky_object_state(cursor)\n  return (event:price() > 10)\nend\n\n" {
+		t.Fatalf("Unexpected filter: %q (%v)", code, err)
+	}
+
+	q.Filter = "foo == 1"
+	if _, err := q.CodegenFilterFunction(); err == nil || err.Error() != "skyd.Query: Property not found: foo" {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+}
+
+// Ensure that filters can only reference permanent properties.
+func TestQueryCodegenFilterTransientProperty(t *testing.T) {
+	table := createTempTable(t)
+	table.Open()
+	defer table.Close()
+	table.CreateProperty("action", true, StringDataType)
+
+	q := NewQuery(table, nil)
+	q.Filter = "action == 'buy'"
+	if _, err := q.CodegenFilterFunction(); err == nil || err.Error() != "skyd.Query: Transient property not allowed: action" {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+}
+
+// Ensure that objects are sampled deterministically at roughly the given rate.
+func TestQuerySampleObject(t *testing.T) {
+	table := NewTable("foo", "")
+	prefix, _ := TablePrefix(table.Name)
+	count := 0
+	for i := 0; i < 10000; i++ {
+		key, _ := table.EncodeObjectId(fmt.Sprintf("obj%d", i))
+		key = key[len(prefix):]
+		if sampleObject(key, 0.25) {
+			count++
+		}
+		if sampleObject(key, 0.25) != sampleObject(key, 0.25) {
+			t.Fatalf("Sampling is not deterministic: %v", key)
+		}
+		if sampleObject(key, 0.1) && !sampleObject(key, 0.25) {
+			t.Fatalf("Smaller samples should be subsets: %v", key)
+		}
+		if !sampleObject(key, 1) {
+			t.Fatalf("Every object should be included at full rate: %v", key)
+		}
+	}
+	if count < 2300 || count > 2700 {
+		t.Fatalf("Unexpected sample size: %d", count)
+	}
+}
+
+// Ensure that merging results in Go matches merging them in Lua.
+func TestQueryMergeNative(t *testing.T) {
+	table := createTempTable(t)
+	table.Open()
+	defer table.Close()
+	table.CreateProperty("fruit", false, "string")
+	table.CreateProperty("price", false, "float")
+
+	q := NewQuery(table, nil)
+	err := q.Decode(bytes.NewBufferString(`{"steps":[{"type":"selection","name":"s","dimensions":["fruit"],"fields":[` +
+		`{"name":"count","expression":"count()"},{"name":"objects","expression":"count_objects()"},` +
+		`{"name":"total","expression":"sum(price)"},{"name":"low","expression":"min(price)"},` +
+		`{"name":"high","expression":"max(price)"},{"name":"mean","expression":"avg(price)"},` +
+		`{"name":"first","expression":"first(price)"},{"name":"last","expression":"last(price)"},` +
+		`{"name":"distinct","expression":"count_distinct(price)"},{"name":"sd","expression":"stddev(price)"},` +
+		`{"name":"median","expression":"percentile(price, 50)"}]}]}`))
+	if err != nil {
+		t.Fatalf("Unable to decode query: %v", err)
+	}
+	if !q.NativeMergeable() {
+		t.Fatalf("Expected query to be natively mergeable")
+	}
+	source, err := q.Codegen()
+	if err != nil {
+		t.Fatalf("Unable to codegen: %v", err)
+	}
+	engine, err := NewExecutionEngine(table, source)
+	if err != nil {
+		t.Fatalf("Unable to create engine: %v", err)
+	}
+	defer engine.Destroy()
+
+	lua, native := interface{}(map[interface{}]interface{}{}), interface{}(map[interface{}]interface{}{})
+	for _, data := range []map[string][]float64{
+		{"apple": {1, 2, 3}, "pear": {5}},
+		{"apple": {4, 0.5}},
+		{"grape": {7, 8}, "apple": {10}},
+	} {
+		if lua, err = engine.Merge(lua, testMergeData(data)); err != nil {
+			t.Fatalf("Unable to merge in Lua: %v", err)
+		}
+		if native, err = q.Merge(native, testMergeData(data)); err != nil {
+			t.Fatalf("Unable to merge in Go: %v", err)
+		}
+	}
+	q.Finalize(lua)
+	q.Finalize(native)
+
+	expected, _ := json.Marshal(ConvertToStringKeys(lua))
+	actual, _ := json.Marshal(ConvertToStringKeys(native))
+	if string(expected) != string(actual) {
+		t.Fatalf("Merge mismatch:\nexp: %s\ngot: %s", expected, actual)
+	}
+}
+
+// Generates aggregate results for a set of prices in each fruit dimension.
+func testMergeData(fruits map[string][]float64) map[interface{}]interface{} {
+	dimension := map[interface{}]interface{}{}
+	for fruit, prices := range fruits {
+		var sum, min, max, mean, m2 float64
+		distinct := map[interface{}]interface{}{}
+		buffer := map[interface{}]interface{}{}
+		for i, price := range prices {
+			sum += price
+			if i == 0 || price < min {
+				min = price
+			}
+			if i == 0 || price > max {
+				max = price
+			}
+			delta := price - mean
+			mean += delta / float64(i+1)
+			m2 += delta * (price - mean)
+			distinct[price] = true
+			buffer[int64(i+1)] = price
+		}
+		n := int64(len(prices))
+		dimension[fruit] = map[interface{}]interface{}{
+			"count":    n,
+			"objects":  map[interface{}]interface{}{"count": int64(1), "object": int64(1)},
+			"total":    sum,
+			"low":      min,
+			"high":     max,
+			"mean":     map[interface{}]interface{}{"sum": sum, "count": n},
+			"first":    map[interface{}]interface{}{"timestamp": int64(sum), "value": prices[0]},
+			"last":     map[interface{}]interface{}{"timestamp": int64(sum), "value": prices[len(prices)-1]},
+			"distinct": distinct,
+			"sd":       map[interface{}]interface{}{"count": n, "mean": mean, "m2": m2},
+			"median":   map[interface{}]interface{}{"n": n, "min": min, "max": max, "centroids": map[interface{}]interface{}{}, "buffer": buffer},
+		}
+	}
+	return map[interface{}]interface{}{"s": map[interface{}]interface{}{"fruit": dimension}}
+}
@@ -0,0 +1,33 @@
+package skyd
+
+// A SavedQuery is a named query definition stored with a Table.
+type SavedQuery struct {
+	Name  string                 `json:"name"`
+	Query map[string]interface{} `json:"query"`
+}
+
+// NewSavedQuery returns a new SavedQuery.
+func NewSavedQuery(name string, query map[string]interface{}) *SavedQuery {
+	return &SavedQuery{
+		Name:  name,
+		Query: query,
+	}
+}
+
+// A slice of SavedQuery objects.
+type SavedQueryList []*SavedQuery
+
+// Determines the length of a saved query slice.
+func (s SavedQueryList) Len() int {
+	return len(s)
+}
+
+// Compares two saved queries in a list.
+func (s SavedQueryList) Less(i, j int) bool {
+	return s[i].Name < s[j].Name
+}
+
+// Swaps two saved queries in a list
+func (s SavedQueryList) Swap(i, j int) {
+	s[i], s[j] = s[j], s[i]
+}
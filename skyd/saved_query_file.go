@@ -0,0 +1,209 @@
+package skyd
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"sort"
+	"sync"
+)
+
+//------------------------------------------------------------------------------
+//
+// Typedefs
+//
+//------------------------------------------------------------------------------
+
+// A SavedQueryFile manages the serialization of SavedQuery objects for a table.
+type SavedQueryFile struct {
+	opened  bool
+	path    string
+	queries map[string]*SavedQuery
+	mutex   sync.Mutex
+}
+
+//------------------------------------------------------------------------------
+//
+// Constructors
+//
+//------------------------------------------------------------------------------
+
+// NewSavedQueryFile returns a new SavedQueryFile.
+func NewSavedQueryFile(path string) *SavedQueryFile {
+	return &SavedQueryFile{
+		path:    path,
+		queries: make(map[string]*SavedQuery),
+	}
+}
+
+//------------------------------------------------------------------------------
+//
+// Accessors
+//
+//------------------------------------------------------------------------------
+
+// The path to the saved query file on disk.
+func (f *SavedQueryFile) Path() string {
+	return f.path
+}
+
+//------------------------------------------------------------------------------
+//
+// Methods
+//
+//------------------------------------------------------------------------------
+
+//--------------------------------------
+// Query Management
+//--------------------------------------
+
+// Retrieves a list of saved queries sorted by name.
+func (f *SavedQueryFile) GetQueries() []*SavedQuery {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	list := make([]*SavedQuery, 0)
+	for _, query := range f.queries {
+		list = append(list, query)
+	}
+	sort.Sort(SavedQueryList(list))
+	return list
+}
+
+// Retrieves a single saved query by name.
+func (f *SavedQueryFile) GetQuery(name string) *SavedQuery {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.queries[name]
+}
+
+// Adds or replaces a saved query and saves the file.
+func (f *SavedQueryFile) PutQuery(query *SavedQuery) error {
+	if query == nil || query.Name == "" {
+		return errors.New("skyd.SavedQueryFile: Query name required.")
+	}
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	prev := f.queries[query.Name]
+	f.queries[query.Name] = query
+	if err := f.save(); err != nil {
+		if prev != nil {
+			f.queries[query.Name] = prev
+		} else {
+			delete(f.queries, query.Name)
+		}
+		return err
+	}
+	return nil
+}
+
+// Removes a saved query and saves the file.
+func (f *SavedQueryFile) DeleteQuery(name string) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	prev := f.queries[name]
+	if prev == nil {
+		return nil
+	}
+	delete(f.queries, name)
+	if err := f.save(); err != nil {
+		f.queries[name] = prev
+		return err
+	}
+	return nil
+}
+
+//--------------------------------------
+// Encoding
+//--------------------------------------
+
+// Encodes a saved query file.
+func (f *SavedQueryFile) Encode(writer io.Writer) error {
+	list := make([]*SavedQuery, 0)
+	for _, query := range f.queries {
+		list = append(list, query)
+	}
+	sort.Sort(SavedQueryList(list))
+
+	encoder := json.NewEncoder(writer)
+	return encoder.Encode(list)
+}
+
+// Decodes a saved query file.
+func (f *SavedQueryFile) Decode(reader io.Reader) error {
+	list := make([]*SavedQuery, 0)
+	decoder := json.NewDecoder(reader)
+	if err := decoder.Decode(&list); err != nil {
+		return err
+	}
+
+	f.queries = make(map[string]*SavedQuery)
+	for _, query := range list {
+		f.queries[query.Name] = query
+	}
+	return nil
+}
+
+//--------------------------------------
+// State
+//--------------------------------------
+
+// Opens the saved query file.
+func (f *SavedQueryFile) Open() error {
+	if f.IsOpen() {
+		return errors.New("skyd.SavedQueryFile: Saved query file is already open.")
+	}
+
+	// Ignore if there is no file.
+	if _, err := os.Stat(f.path); os.IsNotExist(err) {
+		f.opened = true
+		return nil
+	}
+
+	// Otherwise open it and decode it.
+	file, err := os.Open(f.path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	if err = f.Decode(bufio.NewReader(file)); err != nil {
+		return err
+	}
+
+	f.opened = true
+
+	return nil
+}
+
+// Closes the saved query file.
+func (f *SavedQueryFile) Close() {
+	f.queries = make(map[string]*SavedQuery)
+	f.opened = false
+}
+
+// Returns whether the saved query file is currently open.
+func (f *SavedQueryFile) IsOpen() bool {
+	return f.opened
+}
+
+//--------------------------------------
+// Persistence
+//--------------------------------------
+
+// Saves the saved query file to disk.
+func (f *SavedQueryFile) save() error {
+	file, err := os.Create(f.path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	w := bufio.NewWriter(file)
+	if err = f.Encode(w); err != nil {
+		return err
+	}
+	return w.Flush()
+}
@@ -0,0 +1,38 @@
+package skyd
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+// Ensure that saved queries are persisted to disk.
+func TestSavedQueryFilePersistence(t *testing.T) {
+	path, _ := ioutil.TempDir("", "")
+	defer os.RemoveAll(path)
+
+	f := NewSavedQueryFile(path + "/queries")
+	if err := f.Open(); err != nil {
+		t.Fatalf("Unable to open saved query file: %v", err)
+	}
+	f.PutQuery(NewSavedQuery("b", map[string]interface{}{"filter": "true"}))
+	f.PutQuery(NewSavedQuery("a", map[string]interface{}{"sample": 0.5}))
+	f.PutQuery(NewSavedQuery("c", map[string]interface{}{}))
+	f.DeleteQuery("c")
+	if err := f.PutQuery(NewSavedQuery("", nil)); err == nil {
+		t.Fatalf("Expected error for unnamed query")
+	}
+	f.Close()
+
+	f = NewSavedQueryFile(path + "/queries")
+	if err := f.Open(); err != nil {
+		t.Fatalf("Unable to reopen saved query file: %v", err)
+	}
+	queries := f.GetQueries()
+	if len(queries) != 2 || queries[0].Name != "a" || queries[1].Name != "b" {
+		t.Fatalf("Unexpected queries: %v", queries)
+	}
+	if f.GetQuery("a").Query["sample"] != 0.5 || f.GetQuery("b").Query["filter"] != "true" {
+		t.Fatalf("Unexpected query definitions: %v, %v", f.GetQuery("a").Query, f.GetQuery("b").Query)
+	}
+}
@@ -17,9 +17,31 @@ import (
 	"os"
 	"regexp"
 	"runtime"
+	"sort"
+	"strconv"
+	"sync"
 	"time"
 )
 
+//------------------------------------------------------------------------------
+//
+// Constants
+//
+//------------------------------------------------------------------------------
+
+// The minimum number of objects in a key range scanned by a single engine.
+const DefaultMinScanRangeSize = 1000
+
+// The response header that reports the fraction of objects included in a
+// sampled query. Clients can divide counts by the rate to estimate totals.
+const SampleRateHeader = "Sky-Sample-Rate"
+
+const (
+	TableDeletionStatusRunning  = "running"
+	TableDeletionStatusComplete = "complete"
+	TableDeletionStatusFailed   = "failed"
+)
+
 //------------------------------------------------------------------------------
 //
 // Typedefs
@@ -34,11 +56,38 @@ type Server struct {
 	path            string
 	listener        net.Listener
 	servlets        []*Servlet
+	mergeEnginePool *ExecutionEnginePool
+	scanParallelism int
+	minScanRange    int
 	tables          map[string]*Table
 	factors         *Factors
+	deletions       map[string]*TableDeletion
+	queries         map[string]*RunningQuery
+	queryCache      *QueryCache
+	querySequence   int
 	shutdownChannel chan bool
+	mutex           sync.Mutex
 }
 
+// A TableDeletion tracks the progress of a table being deleted in the background.
+type TableDeletion struct {
+	Name   string `json:"name"`
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+// A RunningQuery tracks a query that is executing so that it can be listed
+// and cancelled.
+type RunningQuery struct {
+	Id        string    `json:"id"`
+	Table     string    `json:"table"`
+	StartTime time.Time `json:"startTime"`
+	engines   []*ExecutionEngine
+	err       error
+}
+
+type RunningQueryList []*RunningQuery
+
 //------------------------------------------------------------------------------
 //
 // Errors
@@ -58,6 +107,21 @@ func (e *TextPlainContentTypeError) Error() string {
 	return ""
 }
 
+//--------------------------------------
+// Status
+//--------------------------------------
+
+// An error that is returned to API clients with a specific HTTP status code
+// instead of an internal server error.
+type StatusError struct {
+	Status  int
+	Message string
+}
+
+func (e *StatusError) Error() string {
+	return e.Message
+}
+
 //------------------------------------------------------------------------------
 //
 // Constructors
@@ -68,11 +132,15 @@ func (e *TextPlainContentTypeError) Error() string {
 func NewServer(port uint, path string) *Server {
 	r := mux.NewRouter()
 	s := &Server{
-		httpServer: &http.Server{Addr: fmt.Sprintf(":%d", port), Handler: r},
-		router:     r,
-		logger:     log.New(os.Stdout, "", log.LstdFlags),
-		path:       path,
-		tables:     make(map[string]*Table),
+		httpServer:   &http.Server{Addr: fmt.Sprintf(":%d", port), Handler: r},
+		router:       r,
+		logger:       log.New(os.Stdout, "", log.LstdFlags),
+		path:         path,
+		tables:       make(map[string]*Table),
+		deletions:    make(map[string]*TableDeletion),
+		queries:      make(map[string]*RunningQuery),
+		queryCache:   NewQueryCache(DefaultQueryCacheSize),
+		minScanRange: DefaultMinScanRangeSize,
 	}
 
 	s.router.HandleFunc("/debug/pprof", pprof.Index)
@@ -83,8 +151,10 @@ func NewServer(port uint, path string) *Server {
 	s.addHandlers()
 	s.addTableHandlers()
 	s.addPropertyHandlers()
+	s.addFactorHandlers()
 	s.addEventHandlers()
 	s.addQueryHandlers()
+	s.addSavedQueryHandlers()
 
 	return s
 }
@@ -120,6 +190,24 @@ func (s *Server) FactorsPath() string {
 	return fmt.Sprintf("%v/factors", s.path)
 }
 
+// The maximum number of engines that scan a single servlet concurrently. By
+// default the logical CPUs are divided evenly between the servlets.
+func (s *Server) ScanParallelism() int {
+	if s.scanParallelism > 0 {
+		return s.scanParallelism
+	}
+	if len(s.servlets) == 0 {
+		return 1
+	}
+	return (runtime.NumCPU() + len(s.servlets) - 1) / len(s.servlets)
+}
+
+// Sets the maximum number of engines that scan a single servlet concurrently.
+// Zero uses the default.
+func (s *Server) SetScanParallelism(n int) {
+	s.scanParallelism = n
+}
+
 //------------------------------------------------------------------------------
 //
 // Methods
@@ -227,11 +315,20 @@ func (s *Server) open() error {
 		}
 	}
 
+	// Create a pool of compiled engines for merging results.
+	s.mergeEnginePool = NewExecutionEnginePool(DefaultExecutionEnginePoolSize)
+
 	return nil
 }
 
 // Closes the data directory and servlets.
 func (s *Server) close() {
+	// Close merge engines.
+	if s.mergeEnginePool != nil {
+		s.mergeEnginePool.Close()
+		s.mergeEnginePool = nil
+	}
+
 	// Close servlets.
 	if s.servlets != nil {
 		for _, servlet := range s.servlets {
@@ -315,6 +412,8 @@ func (s *Server) ApiHandleFunc(route string, handlerFunction func(http.ResponseW
 		var status int
 		if err == nil {
 			status = http.StatusOK
+		} else if e, ok := err.(*StatusError); ok {
+			status = e.Status
 		} else {
 			status = http.StatusInternalServerError
 		}
@@ -398,6 +497,8 @@ func (s *Server) GetObjectServletIndex(t *Table, objectId string) (uint32, error
 
 // Retrieves a table that has already been opened.
 func (s *Server) GetTable(name string) *Table {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
 	return s.tables[name]
 }
 
@@ -422,8 +523,16 @@ func (s *Server) GetAllTables() ([]*Table, error) {
 
 // Opens a table and returns a reference to it.
 func (s *Server) OpenTable(name string) (*Table, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	// Tables that are being deleted cannot be used.
+	if d := s.deletions[name]; d != nil && d.Status == TableDeletionStatusRunning {
+		return nil, fmt.Errorf("Table is being deleted: %s", name)
+	}
+
 	// If table already exists then use it.
-	table := s.GetTable(name)
+	table := s.tables[name]
 	if table != nil {
 		return table, nil
 	}
@@ -440,8 +549,19 @@ func (s *Server) OpenTable(name string) (*Table, error) {
 	return table, nil
 }
 
-// Deletes a table.
+// Deletes a table along with its data and factors. An error is returned if
+// the table is already being deleted.
 func (s *Server) DeleteTable(name string) error {
+	deletion, err := s.startTableDeletion(name)
+	if err != nil {
+		return err
+	}
+	err = s.deleteTable(name)
+	s.finishTableDeletion(deletion, err)
+	return err
+}
+
+func (s *Server) deleteTable(name string) error {
 	// Return an error if the table doesn't exist.
 	table := s.GetTable(name)
 	if table == nil {
@@ -470,8 +590,7 @@ func (s *Server) DeleteTable(name string) error {
 		iterator := servlet.db.NewIterator(ro)
 		defer iterator.Close()
 
-		iterator.Seek(prefix)
-		for iterator = iterator; iterator.Valid(); iterator.Next() {
+		for iterator.Seek(prefix); iterator.Valid(); iterator.Next() {
 			key := iterator.Key()
 			if bytes.HasPrefix(key, prefix) {
 				err := servlet.db.Delete(wo, key)
@@ -484,22 +603,102 @@ func (s *Server) DeleteTable(name string) error {
 		}
 	}
 
+	// Remove the table's factors so a recreated table starts fresh.
+	err = s.factors.DeleteNamespace(table.Name)
+	if err != nil {
+		return err
+	}
+
 	// Remove the table from the lookup and remove it's schema.
+	s.mutex.Lock()
 	delete(s.tables, name)
+	s.mutex.Unlock()
+	s.queryCache.Purge(name)
 	return table.Delete()
 }
 
+// Deletes a table in the background. The progress of the deletion can be
+// checked with GetTableDeletion().
+func (s *Server) DeleteTableAsync(name string) (*TableDeletion, error) {
+	deletion, err := s.startTableDeletion(name)
+	if err != nil {
+		return nil, err
+	}
+	ret := s.GetTableDeletion(name)
+
+	go func() {
+		s.finishTableDeletion(deletion, s.deleteTable(name))
+	}()
+
+	return ret, nil
+}
+
+// Marks a table as being deleted. Only one deletion per table is allowed at a
+// time so a conflict is returned if the table is already being deleted.
+func (s *Server) startTableDeletion(name string) (*TableDeletion, error) {
+	if !NewTable(name, s.TablePath(name)).Exists() {
+		return nil, fmt.Errorf("Table does not exist: %s", name)
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if d := s.deletions[name]; d != nil && d.Status == TableDeletionStatusRunning {
+		return nil, &StatusError{Status: http.StatusConflict, Message: fmt.Sprintf("Table is already being deleted: %s", name)}
+	}
+	deletion := &TableDeletion{Name: name, Status: TableDeletionStatusRunning}
+	s.deletions[name] = deletion
+	return deletion, nil
+}
+
+// Records the outcome of a table deletion.
+func (s *Server) finishTableDeletion(deletion *TableDeletion, err error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if err != nil {
+		deletion.Status = TableDeletionStatusFailed
+		deletion.Error = err.Error()
+	} else {
+		deletion.Status = TableDeletionStatusComplete
+	}
+}
+
+// Retrieves the status of the last deletion of a table.
+func (s *Server) GetTableDeletion(name string) *TableDeletion {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if d := s.deletions[name]; d != nil {
+		return d.clone()
+	}
+	return nil
+}
+
+// Removes the status of a table's finished deletion.
+func (s *Server) clearTableDeletion(name string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if d := s.deletions[name]; d != nil && d.Status != TableDeletionStatusRunning {
+		delete(s.deletions, name)
+	}
+}
+
+// Returns a copy of the deletion status that is safe to read without a lock.
+func (d *TableDeletion) clone() *TableDeletion {
+	tmp := *d
+	return &tmp
+}
+
 //--------------------------------------
 // Query
 //--------------------------------------
 
 // Runs a query against a table.
 func (s *Server) RunQuery(table *Table, query *Query) (interface{}, error) {
-	var engine *ExecutionEngine
-	engines := make([]*ExecutionEngine, 0)
-
-	// Create a channel to receive aggregate responses.
-	rchannel := make(chan interface{}, len(s.servlets))
+	// Return a cached result if the table hasn't changed since it was
+	// computed or if it is within the query's maximum staleness.
+	if result, ok := s.queryCache.Get(table, query); ok {
+		return result, nil
+	}
+	stamp := s.queryCache.Stamp(table)
 
 	// Generate the query source code.
 	source, err := query.Codegen()
@@ -507,64 +706,109 @@ func (s *Server) RunQuery(table *Table, query *Query) (interface{}, error) {
 		return nil, err
 	}
 
-	// Create an engine for merging results.
-	engine, err = NewExecutionEngine(table, source)
-	if err != nil {
-		return nil, err
+	// Retrieve an engine for merging results if the query can't be merged
+	// natively in Go.
+	var engine *ExecutionEngine
+	native := query.NativeMergeable()
+	if !native {
+		if engine, err = s.mergeEnginePool.Get(table, source); err != nil {
+			return nil, err
+		}
+		defer s.mergeEnginePool.Put(engine)
 	}
-	defer engine.Destroy()
 	//fmt.Println(engine.FullAnnotatedSource())
 
-	// Initialize one execution engine for each servlet.
+	// Retrieve execution engines for each servlet. Large servlets are split
+	// into key ranges that are scanned concurrently. Engines are returned to
+	// their servlet's pool after every servlet has finished with them.
+	engines := make([]*ExecutionEngine, 0)
+	pools := make([]*ExecutionEnginePool, 0)
+	defer func() {
+		for i, e := range engines {
+			pools[i].Put(e)
+		}
+	}()
+	parallelism := s.ScanParallelism()
 	for _, servlet := range s.servlets {
-		// Create an engine for each servlet.
-		e, err := NewExecutionEngine(table, source)
+		ranges, err := servlet.KeyRanges(table, parallelism, s.minScanRange)
 		if err != nil {
 			return nil, err
 		}
 
-		// Initialize iterator.
-		ro := levigo.NewReadOptions()
-		iterator := servlet.db.NewIterator(ro)
-		err = e.SetIterator(iterator)
-		if err != nil {
-			return nil, err
+		for _, r := range ranges {
+			// Retrieve an engine for each key range.
+			e, err := servlet.enginePool.Get(table, source)
+			if err != nil {
+				return nil, err
+			}
+			engines = append(engines, e)
+			pools = append(pools, servlet.enginePool)
+			e.SetKeyRange(r.Start, r.Limit)
+			e.SetTimeRange(query.StartTime, query.EndTime)
+			e.SetSample(query.Sample)
+
+			// Initialize iterator.
+			ro := levigo.NewReadOptions()
+			iterator := servlet.db.NewIterator(ro)
+			err = e.SetIterator(iterator)
+			if err != nil {
+				return nil, err
+			}
 		}
+	}
 
-		engines = append(engines, e)
+	// Register the query so that it can be cancelled and stop it if it runs
+	// longer than its timeout.
+	r, err := s.registerQuery(table, query, engines)
+	if err != nil {
+		return nil, err
+	}
+	defer s.unregisterQuery(r)
+	if query.Timeout > 0 {
+		timeout := time.Duration(query.Timeout * float64(time.Second))
+		timer := time.AfterFunc(timeout, func() {
+			s.cancelQuery(r, fmt.Errorf("skyd.Server: Query timed out after %v: %s", timeout, r.Id))
+		})
+		defer timer.Stop()
 	}
 
 	// Execute servlets asynchronously and retrieve responses outside
 	// of the server context.
-	for index, _ := range s.servlets {
-		e := engines[index]
-		go func() {
+	rchannel := make(chan interface{}, len(engines))
+	for _, e := range engines {
+		go func(e *ExecutionEngine) {
 			if result, err := e.Aggregate(); err != nil {
 				rchannel <- err
 			} else {
 				rchannel <- result
 			}
-		}()
+		}(e)
 	}
 
 	// Wait for each servlet to complete and then merge the results.
 	var servletError error
 	var result interface{}
 	result = make(map[interface{}]interface{})
-	for i := 0; i < len(s.servlets); i++ {
+	for i := 0; i < len(engines); i++ {
 		ret := <-rchannel
 		if err, ok := ret.(error); ok {
 			fmt.Printf("skyd.Server: Aggregate error: %v", err)
 			servletError = err
-		} else {
+		} else if servletError == nil {
 			// Defactorize aggregate results.
-			err = query.Defactorize(ret)
-			if err != nil {
-				return nil, err
+			if err = query.Defactorize(ret); err != nil {
+				servletError = err
+				continue
 			}
 
 			// Merge results.
-			if ret != nil {
+			if ret != nil && native {
+				result, err = query.Merge(result, ret)
+				if err != nil {
+					fmt.Printf("skyd.Server: Merge error: %v", err)
+					servletError = err
+				}
+			} else if ret != nil {
 				result, err = engine.Merge(result, ret)
 				if err != nil {
 					fmt.Printf("skyd.Server: Merge error: %v", err)
@@ -575,11 +819,119 @@ func (s *Server) RunQuery(table *Table, query *Query) (interface{}, error) {
 	}
 	err = servletError
 
-	// Clean up engines.
-	// TODO: Defer clean up earlier on in case of failure.
-	for _, e := range engines {
-		e.Destroy()
+	// Cancelled queries only have partial results.
+	if err := s.queryError(r); err != nil {
+		return nil, err
+	}
+
+	// Finalize merged results.
+	if err == nil {
+		err = query.Finalize(result)
+	}
+
+	// Cache successful results.
+	if err == nil {
+		s.queryCache.Put(table, query, stamp, result)
 	}
 
 	return result, err
 }
+
+// Retrieves a list of the queries that are currently running.
+func (s *Server) GetRunningQueries() []*RunningQuery {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	queries := make([]*RunningQuery, 0)
+	for _, r := range s.queries {
+		queries = append(queries, r.clone())
+	}
+	sort.Sort(RunningQueryList(queries))
+	return queries
+}
+
+// Cancels a running query. The query returns an error once each servlet has
+// stopped reading objects.
+func (s *Server) CancelQuery(id string) error {
+	s.mutex.Lock()
+	r := s.queries[id]
+	s.mutex.Unlock()
+	if r == nil {
+		return fmt.Errorf("skyd.Server: Query not found: %s", id)
+	}
+	s.cancelQuery(r, fmt.Errorf("skyd.Server: Query cancelled: %s", id))
+	return nil
+}
+
+// Adds a query to the list of running queries. An identifier is generated if
+// the query doesn't have one.
+func (s *Server) registerQuery(table *Table, query *Query, engines []*ExecutionEngine) (*RunningQuery, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	id := query.Id
+	if id == "" {
+		s.querySequence++
+		id = strconv.Itoa(s.querySequence)
+	}
+	if s.queries[id] != nil {
+		return nil, fmt.Errorf("skyd.Server: Query is already running: %s", id)
+	}
+	r := &RunningQuery{Id: id, Table: table.Name, StartTime: time.Now().UTC(), engines: engines}
+	s.queries[id] = r
+	return r, nil
+}
+
+// Removes a query from the list of running queries.
+func (s *Server) unregisterQuery(r *RunningQuery) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.queries[r.Id] == r {
+		delete(s.queries, r.Id)
+	}
+}
+
+// Stops each of a query's engines. Only the first reason is kept. Queries
+// that have already been unregistered are ignored since their engines may
+// have been returned to the pool and handed out to another query.
+func (s *Server) cancelQuery(r *RunningQuery, err error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.queries[r.Id] != r {
+		return
+	}
+	if r.err == nil {
+		r.err = err
+	}
+	for _, e := range r.engines {
+		e.Cancel()
+	}
+}
+
+// Retrieves the reason that a query was cancelled, if any.
+func (s *Server) queryError(r *RunningQuery) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return r.err
+}
+
+// Returns a copy of the running query that is safe to read without a lock.
+func (r *RunningQuery) clone() *RunningQuery {
+	return &RunningQuery{Id: r.Id, Table: r.Table, StartTime: r.StartTime}
+}
+
+//--------------------------------------
+// Sorting
+//--------------------------------------
+
+func (l RunningQueryList) Len() int {
+	return len(l)
+}
+
+func (l RunningQueryList) Less(i, j int) bool {
+	return l[i].StartTime.Before(l[j].StartTime)
+}
+
+func (l RunningQueryList) Swap(i, j int) {
+	l[i], l[j] = l[j], l[i]
+}
@@ -0,0 +1,93 @@
+package skyd
+
+import (
+	"errors"
+	"fmt"
+	"github.com/gorilla/mux"
+	"net/http"
+	"strconv"
+)
+
+func (s *Server) addFactorHandlers() {
+	s.ApiHandleFunc("/tables/{name}/properties/{propertyName}/factors", func(w http.ResponseWriter, req *http.Request, params map[string]interface{}) (interface{}, error) {
+		return s.getFactorsHandler(w, req, params)
+	}).Methods("GET")
+	s.ApiHandleFunc("/tables/{name}/properties/{propertyName}/factors/rename", func(w http.ResponseWriter, req *http.Request, params map[string]interface{}) (interface{}, error) {
+		return s.renameFactorHandler(w, req, params)
+	}).Methods("POST")
+}
+
+// GET /tables/:name/properties/:propertyName/factors
+func (s *Server) getFactorsHandler(w http.ResponseWriter, req *http.Request, params map[string]interface{}) (interface{}, error) {
+	vars := mux.Vars(req)
+	table, property, err := s.getFactorProperty(vars["name"], vars["propertyName"])
+	if err != nil {
+		return nil, err
+	}
+
+	// Parse paging options from the query string.
+	query := req.URL.Query()
+	limit := 0
+	if str := query.Get("limit"); str != "" {
+		if limit, err = strconv.Atoi(str); err != nil || limit < 0 {
+			return nil, fmt.Errorf("Invalid limit: %v", str)
+		}
+	}
+
+	// Retrieve the total count and the requested page.
+	count, err := s.factors.Count(table.Name, property.Name)
+	if err != nil {
+		return nil, err
+	}
+	factors, err := s.factors.Find(table.Name, property.Name, query.Get("prefix"), query.Get("after"), limit)
+	if err != nil {
+		return nil, err
+	}
+
+	return map[string]interface{}{"count": count, "factors": factors}, nil
+}
+
+// POST /tables/:name/properties/:propertyName/factors/rename
+func (s *Server) renameFactorHandler(w http.ResponseWriter, req *http.Request, params map[string]interface{}) (interface{}, error) {
+	vars := mux.Vars(req)
+	table, property, err := s.getFactorProperty(vars["name"], vars["propertyName"])
+	if err != nil {
+		return nil, err
+	}
+
+	from, _ := params["from"].(string)
+	to, _ := params["to"].(string)
+	if from == "" || to == "" {
+		return nil, errors.New("Factor 'from' and 'to' values required.")
+	}
+	err = s.factors.Rename(table.Name, property.Name, from, to)
+	if err != nil {
+		return nil, err
+	}
+	table.touch()
+
+	sequence, err := s.factors.Factorize(table.Name, property.Name, to, false)
+	if err != nil {
+		return nil, err
+	}
+	return &Factor{Id: sequence, Value: to}, nil
+}
+
+// Retrieves a table and one of its factor properties.
+func (s *Server) getFactorProperty(tableName string, propertyName string) (*Table, *Property, error) {
+	table, err := s.OpenTable(tableName)
+	if err != nil {
+		return nil, nil, err
+	}
+	property, err := table.GetPropertyByName(propertyName)
+	if err != nil {
+		return nil, nil, err
+	}
+	if property == nil {
+		return nil, nil, errors.New("Property does not exist.")
+	}
+	if property.DataType != FactorDataType {
+		return nil, nil, fmt.Errorf("Property is not a factor: %v", property.Name)
+	}
+	return table, property, nil
+}
@@ -0,0 +1,39 @@
+package skyd
+
+import (
+	"testing"
+)
+
+// Ensure that we can list the factors of a property through the server.
+func TestServerGetFactors(t *testing.T) {
+	runTestServer(func(s *Server) {
+		setupTestTable("foo")
+		setupTestProperty("foo", "action", false, "factor")
+		setupTestData(t, "foo", [][]string{
+			[]string{"a0", "2012-01-01T00:00:00Z", `{"data":{"action":"signup"}}`},
+			[]string{"a0", "2012-01-01T00:00:01Z", `{"data":{"action":"checkout"}}`},
+			[]string{"a1", "2012-01-01T00:00:00Z", `{"data":{"action":"search"}}`},
+		})
+		resp, _ := sendTestHttpRequest("GET", "http://localhost:8586/tables/foo/properties/action/factors", "application/json", "")
+		assertResponse(t, resp, 200, `{"count":3,"factors":[{"id":2,"value":"checkout"},{"id":3,"value":"search"},{"id":1,"value":"signup"}]}`+"\n", "GET /tables/:name/properties/:propertyName/factors failed.")
+		resp, _ = sendTestHttpRequest("GET", "http://localhost:8586/tables/foo/properties/action/factors?prefix=s&limit=1", "application/json", "")
+		assertResponse(t, resp, 200, `{"count":3,"factors":[{"id":3,"value":"search"}]}`+"\n", "GET /tables/:name/properties/:propertyName/factors with prefix failed.")
+		resp, _ = sendTestHttpRequest("GET", "http://localhost:8586/tables/foo/properties/action/factors?prefix=s&after=search", "application/json", "")
+		assertResponse(t, resp, 200, `{"count":3,"factors":[{"id":1,"value":"signup"}]}`+"\n", "GET /tables/:name/properties/:propertyName/factors with paging failed.")
+	})
+}
+
+// Ensure that we can rename a factor through the server.
+func TestServerRenameFactor(t *testing.T) {
+	runTestServer(func(s *Server) {
+		setupTestTable("foo")
+		setupTestProperty("foo", "action", false, "factor")
+		setupTestData(t, "foo", [][]string{
+			[]string{"a0", "2012-01-01T00:00:00Z", `{"data":{"action":"sigup"}}`},
+		})
+		resp, _ := sendTestHttpRequest("POST", "http://localhost:8586/tables/foo/properties/action/factors/rename", "application/json", `{"from":"sigup","to":"signup"}`)
+		assertResponse(t, resp, 200, `{"id":1,"value":"signup"}`+"\n", "POST /tables/:name/properties/:propertyName/factors/rename failed.")
+		resp, _ = sendTestHttpRequest("GET", "http://localhost:8586/tables/foo/properties/action/factors", "application/json", "")
+		assertResponse(t, resp, 200, `{"count":1,"factors":[{"id":1,"value":"signup"}]}`+"\n", "GET /tables/:name/properties/:propertyName/factors after rename failed.")
+	})
+}
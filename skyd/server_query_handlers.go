@@ -1,8 +1,10 @@
 package skyd
 
 import (
+	"fmt"
 	"github.com/gorilla/mux"
 	"net/http"
+	"strconv"
 )
 
 func (s *Server) addQueryHandlers() {
@@ -12,9 +14,18 @@ func (s *Server) addQueryHandlers() {
 	s.ApiHandleFunc("/tables/{name}/query", func(w http.ResponseWriter, req *http.Request, params map[string]interface{}) (interface{}, error) {
 		return s.queryHandler(w, req, params)
 	}).Methods("POST")
+	s.ApiHandleFunc("/tables/{name}/query/text", func(w http.ResponseWriter, req *http.Request, params map[string]interface{}) (interface{}, error) {
+		return s.textQueryHandler(w, req, params)
+	}).Methods("POST")
 	s.ApiHandleFunc("/tables/{name}/query/codegen", func(w http.ResponseWriter, req *http.Request, params map[string]interface{}) (interface{}, error) {
 		return s.queryCodegenHandler(w, req, params)
 	}).Methods("POST")
+	s.ApiHandleFunc("/queries", func(w http.ResponseWriter, req *http.Request, params map[string]interface{}) (interface{}, error) {
+		return s.getQueriesHandler(w, req, params)
+	}).Methods("GET")
+	s.ApiHandleFunc("/queries/{id}", func(w http.ResponseWriter, req *http.Request, params map[string]interface{}) (interface{}, error) {
+		return s.cancelQueryHandler(w, req, params)
+	}).Methods("DELETE")
 }
 
 // GET /tables/:name/stats
@@ -53,7 +64,38 @@ func (s *Server) queryHandler(w http.ResponseWriter, req *http.Request, params m
 		return nil, err
 	}
 
-	return s.RunQuery(table, query)
+	return s.runQuery(w, table, query)
+}
+
+// POST /tables/:name/query/text
+func (s *Server) textQueryHandler(w http.ResponseWriter, req *http.Request, params map[string]interface{}) (interface{}, error) {
+	vars := mux.Vars(req)
+
+	// Retrieve the table.
+	table, err := s.OpenTable(vars["name"])
+	if err != nil {
+		return nil, err
+	}
+
+	// Deserialize the options that aren't part of the text and then parse
+	// the text into the query.
+	text, ok := params["query"].(string)
+	if !ok {
+		return nil, fmt.Errorf("Invalid 'query': %v", params["query"])
+	}
+	options := map[string]interface{}{}
+	for _, key := range []string{"id", "timeout", "maxStaleness", "params"} {
+		options[key] = params[key]
+	}
+	query := NewQuery(table, s.factors)
+	if err := query.Deserialize(options); err != nil {
+		return nil, err
+	}
+	if err := NewQueryParser(text).Parse(query); err != nil {
+		return nil, err
+	}
+
+	return s.runQuery(w, table, query)
 }
 
 // POST /tables/:name/query/codegen
@@ -81,3 +123,22 @@ func (s *Server) queryCodegenHandler(w http.ResponseWriter, req *http.Request, p
 
 	return source, &TextPlainContentTypeError{}
 }
+
+// GET /queries
+func (s *Server) getQueriesHandler(w http.ResponseWriter, req *http.Request, params map[string]interface{}) (interface{}, error) {
+	return s.GetRunningQueries(), nil
+}
+
+// DELETE /queries/:id
+func (s *Server) cancelQueryHandler(w http.ResponseWriter, req *http.Request, params map[string]interface{}) (interface{}, error) {
+	vars := mux.Vars(req)
+	return nil, s.CancelQuery(vars["id"])
+}
+
+// Runs a query and reports its sampling rate in the response header.
+func (s *Server) runQuery(w http.ResponseWriter, table *Table, query *Query) (interface{}, error) {
+	if query.Sample < 1 {
+		w.Header().Set(SampleRateHeader, strconv.FormatFloat(query.Sample, 'g', -1, 64))
+	}
+	return s.RunQuery(table, query)
+}
@@ -1,6 +1,10 @@
 package skyd
 
 import (
+	"fmt"
+	"github.com/jmhodges/levigo"
+	"io/ioutil"
+	"sync/atomic"
 	"testing"
 )
 
@@ -166,3 +170,656 @@ func TestServerSessionizedFunnelAnalysisQuery(t *testing.T) {
 		assertResponse(t, resp, 200, `{"action":{"A1":{"count":1}}}`+"\n", "POST /tables/:name/query failed.")
 	})
 }
+
+// Ensure that we can use compound condition expressions.
+func TestServerCompoundConditionQuery(t *testing.T) {
+	runTestServer(func(s *Server) {
+		setupTestTable("foo")
+		setupTestProperty("foo", "action", false, "factor")
+		setupTestProperty("foo", "price", true, "float")
+		setupTestData(t, "foo", [][]string{
+			[]string{"g0", "2012-01-01T00:00:00Z", `{"data":{"action":"view", "price":5}}`},
+			[]string{"g0", "2012-01-01T00:00:01Z", `{"data":{"action":"buy", "price":20}}`},
+			[]string{"g1", "2012-01-01T00:00:00Z", `{"data":{"action":"buy", "price":8}}`},
+			[]string{"g1", "2012-01-01T00:00:01Z", `{"data":{"action":"refund", "price":20}}`},
+		})
+
+		query := `{
+			"steps":[
+				{"type":"condition","expression":"action in ('buy', 'refund') and not (price < 10)","steps":[
+					{"type":"selection","dimensions":["action"],"fields":[{"name":"count","expression":"count()"}]}
+				]}
+			]
+		}`
+		resp, _ := sendTestHttpRequest("POST", "http://localhost:8586/tables/foo/query", "application/json", query)
+		assertResponse(t, resp, 200, `{"action":{"buy":{"count":1},"refund":{"count":1}}}`+"\n", "POST /tables/:name/query failed.")
+	})
+}
+
+// Ensure that we can find a condition within a number of seconds.
+func TestServerWithinSecondsQuery(t *testing.T) {
+	runTestServer(func(s *Server) {
+		setupTestTable("foo")
+		setupTestProperty("foo", "action", false, "factor")
+		setupTestData(t, "foo", [][]string{
+			// A1 occurs 30 seconds after A0.
+			[]string{"h0", "2012-01-01T00:00:00Z", `{"data":{"action":"A0"}}`},
+			[]string{"h0", "2012-01-01T00:00:30Z", `{"data":{"action":"A1"}}`},
+			[]string{"h0", "2012-01-01T00:02:00Z", `{"data":{"action":"A1"}}`},
+
+			// A1 occurs 90 seconds after A0.
+			[]string{"h1", "2012-01-01T00:00:00Z", `{"data":{"action":"A0"}}`},
+			[]string{"h1", "2012-01-01T00:01:30Z", `{"data":{"action":"A1"}}`},
+		})
+
+		query := `{
+			"steps":[
+				{"type":"condition","expression":"action == 'A0'","steps":[
+					{"type":"condition","expression":"action == 'A1'","within":[1,60],"withinUnits":"seconds","steps":[
+						{"type":"selection","dimensions":["action"],"fields":[{"name":"count","expression":"count()"}]}
+					]}
+				]}
+			]
+		}`
+		resp, _ := sendTestHttpRequest("POST", "http://localhost:8586/tables/foo/query", "application/json", query)
+		assertResponse(t, resp, 200, `{"action":{"A1":{"count":1}}}`+"\n", "POST /tables/:name/query failed.")
+	})
+}
+
+// Ensure that we can find a condition within a number of following sessions.
+func TestServerWithinSessionsQuery(t *testing.T) {
+	runTestServer(func(s *Server) {
+		setupTestTable("foo")
+		setupTestProperty("foo", "action", false, "factor")
+		setupTestData(t, "foo", [][]string{
+			// A1 occurs in the session after A0.
+			[]string{"i0", "2012-01-01T00:00:00Z", `{"data":{"action":"A0"}}`},
+			[]string{"i0", "2012-01-02T00:00:00Z", `{"data":{"action":"A1"}}`},
+
+			// A1 occurs in the same session as A0.
+			[]string{"i1", "2012-01-01T00:00:00Z", `{"data":{"action":"A0"}}`},
+			[]string{"i1", "2012-01-01T00:10:00Z", `{"data":{"action":"A1"}}`},
+		})
+
+		query := `{
+			"sessionIdleTime":3600,
+			"steps":[
+				{"type":"condition","expression":"action == 'A0'","steps":[
+					{"type":"condition","expression":"action == 'A1'","within":[1,1],"withinUnits":"sessions","steps":[
+						{"type":"selection","dimensions":["action"],"fields":[{"name":"count","expression":"count()"}]}
+					]}
+				]}
+			]
+		}`
+		resp, _ := sendTestHttpRequest("POST", "http://localhost:8586/tables/foo/query", "application/json", query)
+		assertResponse(t, resp, 200, `{"action":{"A1":{"count":1}}}`+"\n", "POST /tables/:name/query failed.")
+	})
+}
+
+// Ensure that we can use mergeable aggregate functions in selections.
+func TestServerAggregateFunctionsQuery(t *testing.T) {
+	runTestServer(func(s *Server) {
+		setupTestTable("foo")
+		setupTestProperty("foo", "gender", false, "string")
+		setupTestProperty("foo", "state", true, "factor")
+		setupTestProperty("foo", "price", true, "float")
+		setupTestData(t, "foo", [][]string{
+			[]string{"j0", "2012-01-01T00:00:00Z", `{"data":{"gender":"m", "state":"NY", "price":10}}`},
+			[]string{"j0", "2012-01-01T00:00:01Z", `{"data":{"state":"CA", "price":20}}`},
+
+			[]string{"j1", "2012-01-01T00:00:02Z", `{"data":{"gender":"m", "state":"CA", "price":30}}`},
+			[]string{"j1", "2012-01-01T00:00:03Z", `{"data":{"state":"TX", "price":40}}`},
+
+			[]string{"j2", "2012-01-01T00:00:00Z", `{"data":{"gender":"f", "state":"CA", "price":5}}`},
+		})
+
+		query := `{
+			"steps":[
+				{"type":"selection","dimensions":["gender"],"fields":[
+					{"name":"avg","expression":"avg(price)"},
+					{"name":"first","expression":"first(state)"},
+					{"name":"last","expression":"last(state)"},
+					{"name":"distinct","expression":"count_distinct(state)"},
+					{"name":"stddev","expression":"stddev(price)"}
+				]}
+			]
+		}`
+		resp, _ := sendTestHttpRequest("POST", "http://localhost:8586/tables/foo/query", "application/json", query)
+		assertResponse(t, resp, 200, `{"gender":{"f":{"avg":5,"distinct":1,"first":"CA","last":"CA","stddev":0},"m":{"avg":25,"distinct":3,"first":"NY","last":"TX","stddev":11.180339887498949}}}`+"\n", "POST /tables/:name/query failed.")
+	})
+}
+
+// Ensure that we can compute percentiles and histograms across servlets.
+func TestServerPercentileQuery(t *testing.T) {
+	runTestServer(func(s *Server) {
+		setupTestTable("foo")
+		setupTestProperty("foo", "gender", false, "string")
+		setupTestProperty("foo", "price", true, "float")
+		setupTestData(t, "foo", [][]string{
+			[]string{"k0", "2012-01-01T00:00:00Z", `{"data":{"gender":"m", "price":10}}`},
+			[]string{"k0", "2012-01-01T00:00:01Z", `{"data":{"price":40}}`},
+			[]string{"k1", "2012-01-01T00:00:00Z", `{"data":{"gender":"m", "price":30}}`},
+			[]string{"k2", "2012-01-01T00:00:00Z", `{"data":{"gender":"m", "price":20}}`},
+			[]string{"k3", "2012-01-01T00:00:00Z", `{"data":{"gender":"f", "price":5}}`},
+		})
+
+		query := `{
+			"steps":[
+				{"type":"selection","dimensions":["gender"],"fields":[
+					{"name":"p50","expression":"percentile(price, 50)"},
+					{"name":"p95","expression":"percentile(price, 95)"},
+					{"name":"hist","expression":"histogram(price, 2)"}
+				]}
+			]
+		}`
+		resp, _ := sendTestHttpRequest("POST", "http://localhost:8586/tables/foo/query", "application/json", query)
+		assertResponse(t, resp, 200, `{"gender":{"f":{"hist":[{"min":5,"max":5,"count":1}],"p50":5,"p95":5},"m":{"hist":[{"min":10,"max":25,"count":2},{"min":25,"max":40,"count":2}],"p50":25,"p95":40}}}`+"\n", "POST /tables/:name/query failed.")
+	})
+}
+
+// Ensure that we can count distinct objects per dimension.
+func TestServerCountObjectsQuery(t *testing.T) {
+	runTestServer(func(s *Server) {
+		setupTestTable("foo")
+		setupTestProperty("foo", "action", true, "factor")
+		setupTestData(t, "foo", [][]string{
+			[]string{"l0", "2012-01-01T00:00:00Z", `{"data":{"action":"A0"}}`},
+			[]string{"l0", "2012-01-01T00:00:01Z", `{"data":{"action":"A0"}}`},
+			[]string{"l0", "2012-01-01T00:00:02Z", `{"data":{"action":"A1"}}`},
+			[]string{"l1", "2012-01-01T00:00:00Z", `{"data":{"action":"A0"}}`},
+			[]string{"l2", "2012-01-01T00:00:00Z", `{"data":{"action":"A1"}}`},
+			[]string{"l2", "2012-01-01T00:00:01Z", `{"data":{"action":"A1"}}`},
+			[]string{"l3", "2012-01-01T00:00:00Z", `{"data":{"action":"A0"}}`},
+		})
+
+		query := `{
+			"steps":[
+				{"type":"selection","name":"total","fields":[{"name":"objects","expression":"count_objects()"}]},
+				{"type":"selection","dimensions":["action"],"fields":[
+					{"name":"count","expression":"count()"},
+					{"name":"objects","expression":"count_objects()"}
+				]}
+			]
+		}`
+		resp, _ := sendTestHttpRequest("POST", "http://localhost:8586/tables/foo/query", "application/json", query)
+		assertResponse(t, resp, 200, `{"action":{"A0":{"count":4,"objects":3},"A1":{"count":3,"objects":2}},"total":{"objects":4}}`+"\n", "POST /tables/:name/query failed.")
+	})
+}
+
+// Ensure that selection fields can use arithmetic expressions.
+func TestServerArithmeticFieldQuery(t *testing.T) {
+	runTestServer(func(s *Server) {
+		setupTestTable("foo")
+		setupTestProperty("foo", "price", true, "float")
+		setupTestProperty("foo", "quantity", true, "float")
+		setupTestProperty("foo", "duration", true, "float")
+		setupTestData(t, "foo", [][]string{
+			[]string{"m0", "2012-01-01T00:00:00Z", `{"data":{"price":2.5, "quantity":4, "duration":1500}}`},
+			[]string{"m0", "2012-01-01T00:00:01Z", `{"data":{"price":10, "quantity":3, "duration":500}}`},
+			[]string{"m1", "2012-01-01T00:00:00Z", `{"data":{"price":1, "quantity":0, "duration":4000}}`},
+		})
+
+		query := `{
+			"steps":[
+				{"type":"condition","expression":"price * quantity > 0","steps":[
+					{"type":"selection","name":"sold","fields":[{"name":"count","expression":"count()"}]}
+				]},
+				{"type":"selection","fields":[
+					{"name":"revenue","expression":"sum(price * quantity)"},
+					{"name":"longest","expression":"max(duration / 1000)"},
+					{"name":"unit","expression":"sum(price / quantity)"},
+					{"name":"adjusted","expression":"sum(-(price - 1) * 2)"}
+				]}
+			]
+		}`
+		resp, _ := sendTestHttpRequest("POST", "http://localhost:8586/tables/foo/query", "application/json", query)
+		assertResponse(t, resp, 200, `{"adjusted":-21,"longest":4,"revenue":40,"sold":{"count":2},"unit":3.9583333333333335}`+"\n", "POST /tables/:name/query failed.")
+	})
+}
+
+// Ensure that we can group by calendar units of the event timestamp.
+func TestServerTimestampDimensionQuery(t *testing.T) {
+	runTestServer(func(s *Server) {
+		setupTestTable("foo")
+		setupTestProperty("foo", "action", true, "factor")
+		setupTestData(t, "foo", [][]string{
+			[]string{"n0", "2012-01-01T03:00:00Z", `{"data":{"action":"A0"}}`},
+			[]string{"n0", "2012-01-01T23:00:00Z", `{"data":{"action":"A0"}}`},
+			[]string{"n1", "2012-01-02T02:00:00Z", `{"data":{"action":"A0"}}`},
+			[]string{"n2", "2012-07-01T03:30:00Z", `{"data":{"action":"A0"}}`},
+		})
+
+		query := `{
+			"steps":[
+				{"type":"selection","name":"day","dimensions":["@timestamp:day"],"fields":[{"name":"count","expression":"count()"}]},
+				{"type":"selection","name":"hour","dimensions":["@timestamp:hour"],"fields":[{"name":"count","expression":"count()"}]},
+				{"type":"selection","name":"week","dimensions":["@timestamp:week"],"fields":[{"name":"count","expression":"count()"}]},
+				{"type":"selection","name":"dow","dimensions":["@timestamp:dow"],"fields":[{"name":"count","expression":"count()"}]},
+				{"type":"selection","name":"ny","dimensions":["@timestamp:day(America/New_York)"],"fields":[{"name":"count","expression":"count()"}]},
+				{"type":"selection","name":"nyhod","dimensions":["@timestamp:hod(America/New_York)"],"fields":[{"name":"count","expression":"count()"}]}
+			]
+		}`
+		resp, _ := sendTestHttpRequest("POST", "http://localhost:8586/tables/foo/query", "application/json", query)
+		assertResponse(t, resp, 200, `{"day":{"@timestamp:day":{"2012-01-01":{"count":2},"2012-01-02":{"count":1},"2012-07-01":{"count":1}}},`+
+			`"dow":{"@timestamp:dow":{"0":{"count":3},"1":{"count":1}}},`+
+			`"hour":{"@timestamp:hour":{"2012-01-01T03:00":{"count":1},"2012-01-01T23:00":{"count":1},"2012-01-02T02:00":{"count":1},"2012-07-01T03:00":{"count":1}}},`+
+			`"ny":{"@timestamp:day(America/New_York)":{"2011-12-31":{"count":1},"2012-01-01":{"count":2},"2012-06-30":{"count":1}}},`+
+			`"nyhod":{"@timestamp:hod(America/New_York)":{"18":{"count":1},"21":{"count":1},"22":{"count":1},"23":{"count":1}}},`+
+			`"week":{"@timestamp:week":{"2011-12-26":{"count":2},"2012-01-02":{"count":1},"2012-06-25":{"count":1}}}}`+"\n", "POST /tables/:name/query failed.")
+	})
+}
+
+// Ensure that we can group numeric properties into bins and buckets.
+func TestServerNumericBucketDimensionQuery(t *testing.T) {
+	runTestServer(func(s *Server) {
+		setupTestTable("foo")
+		setupTestProperty("foo", "price", true, "float")
+		setupTestData(t, "foo", [][]string{
+			[]string{"o0", "2012-01-01T00:00:00Z", `{"data":{"price":5}}`},
+			[]string{"o0", "2012-01-01T00:00:01Z", `{"data":{"price":12.5}}`},
+			[]string{"o1", "2012-01-01T00:00:00Z", `{"data":{"price":19}}`},
+			[]string{"o2", "2012-01-01T00:00:00Z", `{"data":{"price":150}}`},
+			[]string{"o3", "2012-01-01T00:00:00Z", `{"data":{"price":-3}}`},
+		})
+
+		query := `{
+			"steps":[
+				{"type":"selection","name":"bins","dimensions":["price:bin(10)"],"fields":[{"name":"count","expression":"count()"}]},
+				{"type":"selection","name":"buckets","dimensions":["price:bucket(0, 10, 100)"],"fields":[{"name":"count","expression":"count()"}]}
+			]
+		}`
+		resp, _ := sendTestHttpRequest("POST", "http://localhost:8586/tables/foo/query", "application/json", query)
+		assertResponse(t, resp, 200, `{"bins":{"price:bin(10)":{"[-10,0)":{"count":1},"[0,10)":{"count":1},"[10,20)":{"count":2},"[150,160)":{"count":1}}},`+
+			`"buckets":{"price:bucket(0, 10, 100)":{"[-inf,0)":{"count":1},"[0,10)":{"count":1},"[10,100)":{"count":2},"[100,inf)":{"count":1}}}}`+"\n", "POST /tables/:name/query failed.")
+	})
+}
+
+// Ensure that queries only include events within their time range.
+func TestServerTimeRangeQuery(t *testing.T) {
+	runTestServer(func(s *Server) {
+		setupTestTable("foo")
+		setupTestProperty("foo", "plan", false, "factor")
+		setupTestProperty("foo", "action", true, "factor")
+		setupTestData(t, "foo", [][]string{
+			[]string{"t0", "2012-01-01T00:00:00Z", `{"data":{"plan":"free", "action":"A0"}}`},
+			[]string{"t0", "2012-01-05T00:00:00Z", `{"data":{"action":"A1"}}`},
+			[]string{"t0", "2012-01-06T00:00:00Z", `{"data":{"plan":"paid", "action":"A1"}}`},
+			[]string{"t0", "2012-01-10T00:00:00Z", `{"data":{"action":"A0"}}`},
+			[]string{"t1", "2012-01-02T00:00:00Z", `{"data":{"plan":"free", "action":"A0"}}`},
+			[]string{"t2", "2012-01-05T12:00:00Z", `{"data":{"action":"A0"}}`},
+		})
+
+		query := `{
+			"startTime":"2012-01-05T00:00:00Z",
+			"endTime":"2012-01-10T00:00:00Z",
+			"steps":[
+				{"type":"selection","dimensions":["plan","action"],"fields":[
+					{"name":"count","expression":"count()"},
+					{"name":"objects","expression":"count_objects()"}
+				]}
+			]
+		}`
+		resp, _ := sendTestHttpRequest("POST", "http://localhost:8586/tables/foo/query", "application/json", query)
+		assertResponse(t, resp, 200, `{"plan":{"":{"action":{"A0":{"count":1,"objects":1}}},"free":{"action":{"A1":{"count":1,"objects":1}}},"paid":{"action":{"A1":{"count":1,"objects":1}}}}}`+"\n", "POST /tables/:name/query failed.")
+	})
+}
+
+// Ensure that funnels count the objects that reach each stage in order.
+func TestServerFunnelQuery(t *testing.T) {
+	runTestServer(func(s *Server) {
+		setupTestTable("foo")
+		setupTestProperty("foo", "plan", false, "factor")
+		setupTestProperty("foo", "action", true, "factor")
+		setupTestData(t, "foo", [][]string{
+			[]string{"f0", "2012-01-01T00:00:00Z", `{"data":{"plan":"free", "action":"home"}}`},
+			[]string{"f0", "2012-01-01T00:00:10Z", `{"data":{"action":"signup"}}`},
+			[]string{"f0", "2012-01-01T00:00:20Z", `{"data":{"action":"purchase"}}`},
+			[]string{"f1", "2012-01-01T00:00:00Z", `{"data":{"plan":"paid", "action":"home"}}`},
+			[]string{"f1", "2012-01-01T00:00:05Z", `{"data":{"action":"purchase"}}`},
+			[]string{"f2", "2012-01-01T00:00:00Z", `{"data":{"plan":"free", "action":"signup"}}`},
+			[]string{"f2", "2012-01-01T00:00:10Z", `{"data":{"action":"home"}}`},
+			[]string{"f2", "2012-01-01T00:00:20Z", `{"data":{"action":"signup"}}`},
+			[]string{"f3", "2012-01-01T00:00:00Z", `{"data":{"plan":"paid", "action":"home"}}`},
+			[]string{"f3", "2012-01-02T00:00:00Z", `{"data":{"action":"signup"}}`},
+			[]string{"f3", "2012-01-03T00:00:00Z", `{"data":{"action":"home"}}`},
+			[]string{"f3", "2012-01-03T00:00:10Z", `{"data":{"action":"signup"}}`},
+			[]string{"f3", "2012-01-03T00:00:20Z", `{"data":{"action":"purchase"}}`},
+			[]string{"f4", "2012-01-01T00:00:00Z", `{"data":{"plan":"free", "action":"home"}}`},
+			[]string{"f4", "2012-01-01T02:00:00Z", `{"data":{"action":"signup"}}`},
+		})
+
+		// Stages must occur within an hour of the first stage.
+		query := `{
+			"steps":[
+				{"type":"funnel","name":"checkout","within":3600,"stages":["action == 'home'","action == 'signup'","action == 'purchase'"]}
+			]
+		}`
+		resp, _ := sendTestHttpRequest("POST", "http://localhost:8586/tables/foo/query", "application/json", query)
+		assertResponse(t, resp, 200, `{"checkout":[5,3,2]}`+"\n", "POST /tables/:name/query failed.")
+
+		// Break down by the plan at the start of the funnel.
+		query = `{
+			"steps":[
+				{"type":"funnel","name":"checkout","dimension":"plan","stages":["action == 'home'","action == 'signup'","action == 'purchase'"]}
+			]
+		}`
+		resp, _ = sendTestHttpRequest("POST", "http://localhost:8586/tables/foo/query", "application/json", query)
+		assertResponse(t, resp, 200, `{"checkout":{"plan":{"free":[3,3,1],"paid":[2,1,1]}}}`+"\n", "POST /tables/:name/query failed.")
+	})
+}
+
+// Ensure that retention queries group objects into weekly cohorts.
+func TestServerRetentionQuery(t *testing.T) {
+	runTestServer(func(s *Server) {
+		setupTestTable("foo")
+		setupTestProperty("foo", "action", true, "factor")
+		setupTestData(t, "foo", [][]string{
+			[]string{"r0", "2012-01-02T00:00:00Z", `{"data":{"action":"signup"}}`},
+			[]string{"r0", "2012-01-10T00:00:00Z", `{"data":{"action":"login"}}`},
+			[]string{"r0", "2012-01-11T00:00:00Z", `{"data":{"action":"login"}}`},
+			[]string{"r0", "2012-01-24T00:00:00Z", `{"data":{"action":"login"}}`},
+			[]string{"r1", "2012-01-04T00:00:00Z", `{"data":{"action":"signup"}}`},
+			[]string{"r1", "2012-01-05T00:00:00Z", `{"data":{"action":"login"}}`},
+			[]string{"r1", "2012-01-17T00:00:00Z", `{"data":{"action":"login"}}`},
+			[]string{"r2", "2012-01-03T00:00:00Z", `{"data":{"action":"login"}}`},
+			[]string{"r2", "2012-01-09T00:00:00Z", `{"data":{"action":"signup"}}`},
+			[]string{"r2", "2012-01-16T00:00:00Z", `{"data":{"action":"login"}}`},
+			[]string{"r3", "2012-01-02T00:00:00Z", `{"data":{"action":"login"}}`},
+		})
+
+		query := `{
+			"steps":[
+				{"type":"retention","name":"weekly","cohort":"action == 'signup'","return":"action == 'login'","periods":3}
+			]
+		}`
+		resp, _ := sendTestHttpRequest("POST", "http://localhost:8586/tables/foo/query", "application/json", query)
+		assertResponse(t, resp, 200, `{"weekly":{"2012-01-02":{"objects":2,"returned":[1,1,1],"retention":[0.5,0.5,0.5]},"2012-01-09":{"objects":1,"returned":[1,0,0],"retention":[1,0,0]}}}`+"\n", "POST /tables/:name/query failed.")
+	})
+}
+
+// Ensure that paths after and before an anchor event are counted in a trie.
+func TestServerPathsQuery(t *testing.T) {
+	runTestServer(func(s *Server) {
+		setupTestTable("foo")
+		setupTestProperty("foo", "action", true, "factor")
+		setupTestData(t, "foo", [][]string{
+			[]string{"p0", "2012-01-01T00:00:00Z", `{"data":{"action":"home"}}`},
+			[]string{"p0", "2012-01-01T00:00:01Z", `{"data":{"action":"checkout_failed"}}`},
+			[]string{"p0", "2012-01-01T00:00:02Z", `{"data":{"action":"cart"}}`},
+			[]string{"p0", "2012-01-01T00:00:03Z", `{"data":{"action":"checkout"}}`},
+			[]string{"p0", "2012-01-01T00:00:04Z", `{"data":{"action":"home"}}`},
+			[]string{"p1", "2012-01-01T00:00:00Z", `{"data":{"action":"checkout_failed"}}`},
+			[]string{"p1", "2012-01-01T00:00:01Z", `{"data":{"action":"checkout_failed"}}`},
+			[]string{"p1", "2012-01-01T00:00:02Z", `{"data":{"action":"home"}}`},
+			[]string{"p2", "2012-01-01T00:00:00Z", `{"data":{"action":"search"}}`},
+			[]string{"p2", "2012-01-01T00:00:01Z", `{"data":{"action":"checkout_failed"}}`},
+			[]string{"p2", "2012-01-01T00:00:02Z", `{"data":{"action":"cart"}}`},
+			[]string{"p2", "2012-01-01T00:00:03Z", `{"data":{"action":"cart"}}`},
+			[]string{"p3", "2012-01-01T00:00:00Z", `{"data":{"action":"home"}}`},
+			[]string{"p3", "2012-01-01T00:00:01Z", `{"data":{"action":"search"}}`},
+			[]string{"p3", "2012-01-01T00:00:02Z", `{"data":{"action":"checkout_failed"}}`},
+		})
+
+		// Keep the two most common actions after the anchor.
+		query := `{
+			"steps":[
+				{"type":"paths","name":"after","anchor":"action == 'checkout_failed'","property":"action","depth":2,"limit":2}
+			]
+		}`
+		resp, _ := sendTestHttpRequest("POST", "http://localhost:8586/tables/foo/query", "application/json", query)
+		assertResponse(t, resp, 200, `{"after":{"count":5,"children":[{"value":"cart","count":2,"children":[{"value":"cart","count":1},{"value":"checkout","count":1}]},{"value":"checkout_failed","count":1,"children":[{"value":"home","count":1}]}]}}`+"\n", "POST /tables/:name/query failed.")
+
+		// Previous paths start with the most recent action.
+		query = `{
+			"steps":[
+				{"type":"paths","name":"before","anchor":"action == 'checkout_failed'","property":"action","direction":"previous","depth":2,"limit":0}
+			]
+		}`
+		resp, _ = sendTestHttpRequest("POST", "http://localhost:8586/tables/foo/query", "application/json", query)
+		assertResponse(t, resp, 200, `{"before":{"count":5,"children":[{"value":"search","count":2,"children":[{"value":"home","count":1}]},{"value":"checkout_failed","count":1},{"value":"home","count":1}]}}`+"\n", "POST /tables/:name/query failed.")
+	})
+}
+
+// Ensure that queries only include objects whose current state matches the filter.
+func TestServerFilterQuery(t *testing.T) {
+	runTestServer(func(s *Server) {
+		setupTestTable("foo")
+		setupTestProperty("foo", "plan", false, "factor")
+		setupTestProperty("foo", "country", false, "string")
+		setupTestProperty("foo", "action", true, "factor")
+		setupTestData(t, "foo", [][]string{
+			[]string{"s0", "2012-01-01T00:00:00Z", `{"data":{"plan":"free", "country":"us", "action":"A0"}}`},
+			[]string{"s0", "2012-01-02T00:00:00Z", `{"data":{"plan":"pro", "action":"A1"}}`},
+			[]string{"s1", "2012-01-01T00:00:00Z", `{"data":{"plan":"free", "country":"us", "action":"A0"}}`},
+			[]string{"s2", "2012-01-01T00:00:00Z", `{"data":{"plan":"pro", "country":"fr", "action":"A1"}}`},
+			[]string{"s2", "2012-01-02T00:00:00Z", `{"data":{"action":"A1"}}`},
+		})
+
+		query := `{
+			"filter":"plan == 'pro'",
+			"steps":[
+				{"type":"selection","dimensions":["action"],"fields":[{"name":"count","expression":"count()"}]}
+			]
+		}`
+		resp, _ := sendTestHttpRequest("POST", "http://localhost:8586/tables/foo/query", "application/json", query)
+		assertResponse(t, resp, 200, `{"action":{"A0":{"count":1},"A1":{"count":3}}}`+"\n", "POST /tables/:name/query failed.")
+
+		query = `{
+			"filter":"plan == 'pro' and country == 'us'",
+			"steps":[
+				{"type":"selection","fields":[{"name":"count","expression":"count()"}]}
+			]
+		}`
+		resp, _ = sendTestHttpRequest("POST", "http://localhost:8586/tables/foo/query", "application/json", query)
+		assertResponse(t, resp, 200, `{"count":2}`+"\n", "POST /tables/:name/query failed.")
+	})
+}
+
+// Ensure that sampled queries only include a subset of objects and return the rate.
+func TestServerSampleQuery(t *testing.T) {
+	runTestServer(func(s *Server) {
+		prefix, _ := TablePrefix("foo")
+		data, expected := [][]string{}, 0
+		for i := 0; i < 40; i++ {
+			objectId := fmt.Sprintf("o%d", i)
+			data = append(data, []string{objectId, "2012-01-01T00:00:00Z", `{"data":{"action":"A0"}}`})
+			if key, _ := NewTable("foo", "").EncodeObjectId(objectId); sampleObject(key[len(prefix):], 0.5) {
+				expected++
+			}
+		}
+
+		// The same objects are sampled from each table.
+		query := `{"sample":0.5,"steps":[{"type":"selection","fields":[{"name":"count","expression":"count()"}]}]}`
+		for _, name := range []string{"foo", "barbaz"} {
+			setupTestTable(name)
+			setupTestProperty(name, "action", true, "factor")
+			setupTestData(t, name, data)
+
+			resp, _ := sendTestHttpRequest("POST", "http://localhost:8586/tables/"+name+"/query", "application/json", query)
+			if resp.Header.Get(SampleRateHeader) != "0.5" {
+				t.Fatalf("Unexpected sample rate header: %q", resp.Header.Get(SampleRateHeader))
+			}
+			assertResponse(t, resp, 200, fmt.Sprintf(`{"count":%d}`, expected)+"\n", "POST /tables/:name/query failed.")
+		}
+		if expected == 0 || expected == 40 {
+			t.Fatalf("Unexpected sample size: %d", expected)
+		}
+	})
+}
+
+// Ensure that running queries can be listed and cancelled.
+func TestServerCancelQuery(t *testing.T) {
+	runTestServer(func(s *Server) {
+		setupTestTable("foo")
+		setupTestProperty("foo", "action", true, "factor")
+		setupTestData(t, "foo", [][]string{
+			[]string{"c0", "2012-01-01T00:00:00Z", `{"data":{"action":"A0"}}`},
+			[]string{"c1", "2012-01-01T00:00:00Z", `{"data":{"action":"A0"}}`},
+		})
+		resp, _ := sendTestHttpRequest("GET", "http://localhost:8586/queries", "application/json", "")
+		assertResponse(t, resp, 200, `[]`+"\n", "GET /queries failed.")
+
+		// Register an engine for each servlet.
+		table, _ := s.OpenTable("foo")
+		query := NewQuery(table, s.factors)
+		query.Id = "q1"
+		selection := NewQuerySelection(query)
+		selection.Fields = append(selection.Fields, NewQuerySelectionField("count", "count()"))
+		query.Steps = append(query.Steps, selection)
+		source, _ := query.Codegen()
+		engines := []*ExecutionEngine{}
+		for _, servlet := range s.servlets {
+			e, _ := NewExecutionEngine(table, source)
+			defer e.Destroy()
+			e.SetIterator(servlet.db.NewIterator(levigo.NewReadOptions()))
+			engines = append(engines, e)
+		}
+		r, _ := s.registerQuery(table, query, engines)
+		if _, err := s.registerQuery(table, query, nil); err == nil || err.Error() != "skyd.Server: Query is already running: q1" {
+			t.Fatalf("Expected duplicate query error: %v", err)
+		}
+
+		resp, _ = sendTestHttpRequest("DELETE", "http://localhost:8586/queries/q1", "application/json", "")
+		assertResponse(t, resp, 200, "", "DELETE /queries/:id failed.")
+		if err := s.queryError(r); err == nil || err.Error() != "skyd.Server: Query cancelled: q1" {
+			t.Fatalf("Expected cancellation error: %v", err)
+		}
+		if err := s.CancelQuery("q2"); err == nil || err.Error() != "skyd.Server: Query not found: q2" {
+			t.Fatalf("Expected missing query error: %v", err)
+		}
+
+		// Cancelled engines stop before reading any objects.
+		for _, e := range engines {
+			result, err := e.Aggregate()
+			if m, ok := result.(map[interface{}]interface{}); err != nil || !ok || len(m) != 0 {
+				t.Fatalf("Unexpected cancelled result: %v (%v)", result, err)
+			}
+		}
+		s.unregisterQuery(r)
+
+		// Late cancels of an unregistered query leave its engines alone.
+		for _, e := range engines {
+			atomic.StoreInt32(&e.cancelled, 0)
+		}
+		s.cancelQuery(r, fmt.Errorf("skyd.Server: Query timed out after 1ns: q1"))
+		for _, e := range engines {
+			if atomic.LoadInt32(&e.cancelled) != 0 {
+				t.Fatalf("Expected engine to not be cancelled")
+			}
+		}
+	})
+}
+
+// Ensure that queries are stopped when they run past their timeout.
+func TestServerQueryTimeout(t *testing.T) {
+	runTestServer(func(s *Server) {
+		setupTestTable("foo")
+		setupTestProperty("foo", "fruit", true, "string")
+
+		// Write enough objects directly that the scan outlasts the timeout.
+		for i := 0; i < 100000; i++ {
+			objectId := fmt.Sprintf("a%d", i)
+			table, servlet, _ := s.GetObjectContext("foo", objectId)
+			property := table.propertyFile.GetPropertyByName("fruit")
+			event := NewEvent("2012-01-01T00:00:00Z", map[int64]interface{}{property.Id: "apple"})
+			if err := servlet.PutEvent(table, objectId, event, true); err != nil {
+				t.Fatalf("Unable to put event: %v", err)
+			}
+		}
+
+		query := `{"id":"slow","timeout":0.000000001,"steps":[{"type":"selection","dimensions":["fruit"],"fields":[{"name":"count","expression":"count()"}]}]}`
+		resp, _ := sendTestHttpRequest("POST", "http://localhost:8586/tables/foo/query", "application/json", query)
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != 500 || string(body) != `{"message":"skyd.Server: Query timed out after 1ns: slow"}`+"\n" {
+			t.Fatalf("Expected timeout error: [%v] %s", resp.StatusCode, body)
+		}
+
+		// Timed out queries are unregistered and aren't cached.
+		if queries := s.GetRunningQueries(); len(queries) != 0 {
+			t.Fatalf("Expected no running queries: %v", queries)
+		}
+		resp, _ = sendTestHttpRequest("POST", "http://localhost:8586/tables/foo/query", "application/json", `{"id":"slow","steps":[{"type":"selection","dimensions":["fruit"],"fields":[{"name":"count","expression":"count()"}]}]}`)
+		assertResponse(t, resp, 200, `{"fruit":{"apple":{"count":100000}}}`+"\n", "POST /tables/:name/query after timeout failed.")
+	})
+}
+
+// Ensure that servlets can be scanned by multiple engines concurrently.
+func TestServerParallelScanQuery(t *testing.T) {
+	runTestServer(func(s *Server) {
+		s.SetScanParallelism(4)
+		s.minScanRange = 1
+		setupTestTable("foo")
+		setupTestProperty("foo", "fruit", true, "string")
+		items := [][]string{}
+		for i := 0; i < 40; i++ {
+			fruit := []string{"apple", "grape", "orange", "pear"}[i%4]
+			items = append(items, []string{fmt.Sprintf("a%d", i), "2012-01-01T00:00:00Z", `{"data":{"fruit":"` + fruit + `"}}`})
+		}
+		setupTestData(t, "foo", items)
+
+		query := `{
+			"steps":[
+				{"type":"selection","dimensions":["fruit"],"fields":[{"name":"count","expression":"count()"}]}
+			]
+		}`
+		resp, _ := sendTestHttpRequest("POST", "http://localhost:8586/tables/foo/query", "application/json", query)
+		assertResponse(t, resp, 200, `{"fruit":{"apple":{"count":10},"grape":{"count":10},"orange":{"count":10},"pear":{"count":10}}}`+"\n", "POST /tables/:name/query failed.")
+	})
+}
+
+// Ensure that query results are cached until the table is written to.
+func TestServerCachedQuery(t *testing.T) {
+	runTestServer(func(s *Server) {
+		setupTestTable("foo")
+		setupTestProperty("foo", "fruit", true, "string")
+		setupTestData(t, "foo", [][]string{
+			[]string{"a0", "2012-01-01T00:00:00Z", `{"data":{"fruit":"apple"}}`},
+		})
+
+		query := `{"steps":[{"type":"selection","dimensions":[],"fields":[{"name":"count","expression":"count()"}]}]}`
+		stale := `{"maxStaleness":60,"steps":[{"type":"selection","dimensions":[],"fields":[{"name":"count","expression":"count()"}]}]}`
+		resp, _ := sendTestHttpRequest("POST", "http://localhost:8586/tables/foo/query", "application/json", query)
+		assertResponse(t, resp, 200, `{"count":1}`+"\n", "POST /tables/:name/query failed.")
+		if s.queryCache.Len() != 1 {
+			t.Fatalf("Expected cached result: %v", s.queryCache.Len())
+		}
+
+		// Writes invalidate the result unless staleness is allowed.
+		setupTestData(t, "foo", [][]string{
+			[]string{"a1", "2012-01-01T00:00:00Z", `{"data":{"fruit":"grape"}}`},
+		})
+		resp, _ = sendTestHttpRequest("POST", "http://localhost:8586/tables/foo/query", "application/json", stale)
+		assertResponse(t, resp, 200, `{"count":1}`+"\n", "POST /tables/:name/query failed.")
+		resp, _ = sendTestHttpRequest("POST", "http://localhost:8586/tables/foo/query", "application/json", query)
+		assertResponse(t, resp, 200, `{"count":2}`+"\n", "POST /tables/:name/query failed.")
+
+		// Deletes invalidate the result as well.
+		resp, _ = sendTestHttpRequest("DELETE", "http://localhost:8586/tables/foo/objects/a1/events", "application/json", "")
+		assertResponse(t, resp, 200, "", "DELETE /tables/:name/objects/:objectId/events failed.")
+		resp, _ = sendTestHttpRequest("POST", "http://localhost:8586/tables/foo/query", "application/json", query)
+		assertResponse(t, resp, 200, `{"count":1}`+"\n", "POST /tables/:name/query failed.")
+	})
+}
+
+// Ensure that we can run a query written in the query language.
+func TestServerTextQuery(t *testing.T) {
+	runTestServer(func(s *Server) {
+		setupTestTable("foo")
+		setupTestProperty("foo", "action", true, "factor")
+		setupTestProperty("foo", "page", true, "string")
+		setupTestData(t, "foo", [][]string{
+			[]string{"a0", "2012-01-01T00:00:00Z", `{"data":{"action":"signup","page":"home"}}`},
+			[]string{"a0", "2012-01-01T00:00:01Z", `{"data":{"action":"view","page":"pricing"}}`},
+			[]string{"a1", "2012-01-01T00:00:00Z", `{"data":{"action":"signup","page":"blog"}}`},
+			[]string{"a2", "2012-01-02T00:00:00Z", `{"data":{"action":"signup","page":"home"}}`},
+		})
+		resp, _ := sendTestHttpRequest("POST", "http://localhost:8586/tables/foo/query/text", "application/json", `{"query":"TO $to WHEN action == $action THEN SELECT count() GROUP BY page", "params":{"action":"signup","to":"2012-01-02T00:00:00Z"}}`)
+		assertResponse(t, resp, 200, `{"page":{"blog":{"count":1},"home":{"count":1}}}`+"\n", "POST /tables/:name/query/text failed.")
+		resp, _ = sendTestHttpRequest("POST", "http://localhost:8586/tables/foo/query/text", "application/json", `{"query":"SELECT count() GROUP"}`)
+		resp.Body.Close()
+		if resp.StatusCode != 500 {
+			t.Fatalf("Expected 500 for invalid query text, got %v", resp.StatusCode)
+		}
+	})
+}
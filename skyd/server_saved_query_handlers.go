@@ -0,0 +1,187 @@
+package skyd
+
+import (
+	"errors"
+	"fmt"
+	"github.com/gorilla/mux"
+	"net/http"
+)
+
+func (s *Server) addSavedQueryHandlers() {
+	s.ApiHandleFunc("/tables/{name}/queries", func(w http.ResponseWriter, req *http.Request, params map[string]interface{}) (interface{}, error) {
+		return s.getSavedQueriesHandler(w, req, params)
+	}).Methods("GET")
+	s.ApiHandleFunc("/tables/{name}/queries", func(w http.ResponseWriter, req *http.Request, params map[string]interface{}) (interface{}, error) {
+		return s.createSavedQueryHandler(w, req, params)
+	}).Methods("POST")
+
+	s.ApiHandleFunc("/tables/{name}/queries/{queryName}", func(w http.ResponseWriter, req *http.Request, params map[string]interface{}) (interface{}, error) {
+		return s.getSavedQueryHandler(w, req, params)
+	}).Methods("GET")
+	s.ApiHandleFunc("/tables/{name}/queries/{queryName}", func(w http.ResponseWriter, req *http.Request, params map[string]interface{}) (interface{}, error) {
+		return s.updateSavedQueryHandler(w, req, params)
+	}).Methods("PUT")
+	s.ApiHandleFunc("/tables/{name}/queries/{queryName}", func(w http.ResponseWriter, req *http.Request, params map[string]interface{}) (interface{}, error) {
+		return s.deleteSavedQueryHandler(w, req, params)
+	}).Methods("DELETE")
+
+	s.ApiHandleFunc("/tables/{name}/queries/{queryName}/run", func(w http.ResponseWriter, req *http.Request, params map[string]interface{}) (interface{}, error) {
+		return s.runSavedQueryHandler(w, req, params)
+	}).Methods("POST")
+}
+
+// GET /tables/:name/queries
+func (s *Server) getSavedQueriesHandler(w http.ResponseWriter, req *http.Request, params map[string]interface{}) (interface{}, error) {
+	vars := mux.Vars(req)
+	table, err := s.OpenTable(vars["name"])
+	if err != nil {
+		return nil, err
+	}
+
+	return table.GetSavedQueries()
+}
+
+// POST /tables/:name/queries
+func (s *Server) createSavedQueryHandler(w http.ResponseWriter, req *http.Request, params map[string]interface{}) (interface{}, error) {
+	vars := mux.Vars(req)
+	table, err := s.OpenTable(vars["name"])
+	if err != nil {
+		return nil, err
+	}
+
+	name, _ := params["name"].(string)
+	if name == "" {
+		return nil, errors.New("Query name required.")
+	}
+	if query, _ := table.GetSavedQuery(name); query != nil {
+		return nil, fmt.Errorf("Query already exists: %s", name)
+	}
+
+	return s.putSavedQuery(table, name, params["query"])
+}
+
+// GET /tables/:name/queries/:queryName
+func (s *Server) getSavedQueryHandler(w http.ResponseWriter, req *http.Request, params map[string]interface{}) (interface{}, error) {
+	vars := mux.Vars(req)
+	table, err := s.OpenTable(vars["name"])
+	if err != nil {
+		return nil, err
+	}
+
+	return s.getSavedQuery(table, vars["queryName"])
+}
+
+// PUT /tables/:name/queries/:queryName
+func (s *Server) updateSavedQueryHandler(w http.ResponseWriter, req *http.Request, params map[string]interface{}) (interface{}, error) {
+	vars := mux.Vars(req)
+	table, err := s.OpenTable(vars["name"])
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := s.getSavedQuery(table, vars["queryName"]); err != nil {
+		return nil, err
+	}
+	return s.putSavedQuery(table, vars["queryName"], params["query"])
+}
+
+// DELETE /tables/:name/queries/:queryName
+func (s *Server) deleteSavedQueryHandler(w http.ResponseWriter, req *http.Request, params map[string]interface{}) (interface{}, error) {
+	vars := mux.Vars(req)
+	table, err := s.OpenTable(vars["name"])
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := s.getSavedQuery(table, vars["queryName"]); err != nil {
+		return nil, err
+	}
+	return nil, table.DeleteSavedQuery(vars["queryName"])
+}
+
+// POST /tables/:name/queries/:queryName/run
+func (s *Server) runSavedQueryHandler(w http.ResponseWriter, req *http.Request, params map[string]interface{}) (interface{}, error) {
+	vars := mux.Vars(req)
+	table, err := s.OpenTable(vars["name"])
+	if err != nil {
+		return nil, err
+	}
+
+	savedQuery, err := s.getSavedQuery(table, vars["queryName"])
+	if err != nil {
+		return nil, err
+	}
+
+	// Bind parameters from the request over any saved defaults.
+	obj, err := bindSavedQueryParams(savedQuery.Query, params["params"])
+	if err != nil {
+		return nil, err
+	}
+
+	// Deserialize the query.
+	query := NewQuery(table, s.factors)
+	err = query.Deserialize(obj)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.runQuery(w, table, query)
+}
+
+// Returns a copy of a saved query definition with parameter values merged
+// into its "params". The saved definition is left unchanged.
+func bindSavedQueryParams(obj map[string]interface{}, values interface{}) (map[string]interface{}, error) {
+	if values == nil {
+		return obj, nil
+	}
+	m, ok := values.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("Invalid 'params': %v", values)
+	}
+
+	params := make(map[string]interface{})
+	if defaults, ok := obj["params"].(map[string]interface{}); ok {
+		for k, v := range defaults {
+			params[k] = v
+		}
+	}
+	for k, v := range m {
+		params[k] = v
+	}
+
+	bound := make(map[string]interface{})
+	for k, v := range obj {
+		bound[k] = v
+	}
+	bound["params"] = params
+	return bound, nil
+}
+
+// Retrieves a saved query by name. Returns an error if it doesn't exist.
+func (s *Server) getSavedQuery(table *Table, name string) (*SavedQuery, error) {
+	query, err := table.GetSavedQuery(name)
+	if err != nil {
+		return nil, err
+	}
+	if query == nil {
+		return nil, fmt.Errorf("Query does not exist: %s", name)
+	}
+	return query, nil
+}
+
+// Validates a query definition and saves it on the table.
+func (s *Server) putSavedQuery(table *Table, name string, obj interface{}) (*SavedQuery, error) {
+	m, ok := obj.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("Invalid query: %v", obj)
+	}
+	if err := NewQuery(table, s.factors).Deserialize(m); err != nil {
+		return nil, err
+	}
+
+	query := NewSavedQuery(name, m)
+	if err := table.PutSavedQuery(query); err != nil {
+		return nil, err
+	}
+	return query, nil
+}
@@ -0,0 +1,109 @@
+package skyd
+
+import (
+	"testing"
+)
+
+// Ensure that we can create and retrieve saved queries through the server.
+func TestServerCreateSavedQuery(t *testing.T) {
+	runTestServer(func(s *Server) {
+		setupTestTable("foo")
+		resp, _ := sendTestHttpRequest("POST", "http://localhost:8586/tables/foo/queries", "application/json", `{"name":"total", "query":{"steps":[{"type":"selection","fields":[{"name":"count","expression":"count()"}]}]}}`)
+		assertResponse(t, resp, 200, `{"name":"total","query":{"steps":[{"fields":[{"expression":"count()","name":"count"}],"type":"selection"}]}}`+"\n", "POST /tables/:name/queries failed.")
+		resp, _ = sendTestHttpRequest("POST", "http://localhost:8586/tables/foo/queries", "application/json", `{"name":"apples", "query":{"filter":"true"}}`)
+		assertResponse(t, resp, 200, `{"name":"apples","query":{"filter":"true"}}`+"\n", "POST /tables/:name/queries failed.")
+		resp, _ = sendTestHttpRequest("GET", "http://localhost:8586/tables/foo/queries", "application/json", "")
+		assertResponse(t, resp, 200, `[{"name":"apples","query":{"filter":"true"}},{"name":"total","query":{"steps":[{"fields":[{"expression":"count()","name":"count"}],"type":"selection"}]}}]`+"\n", "GET /tables/:name/queries failed.")
+		resp, _ = sendTestHttpRequest("GET", "http://localhost:8586/tables/foo/queries/apples", "application/json", "")
+		assertResponse(t, resp, 200, `{"name":"apples","query":{"filter":"true"}}`+"\n", "GET /tables/:name/queries/:queryName failed.")
+	})
+}
+
+// Ensure that invalid or duplicate saved queries are rejected.
+func TestServerCreateInvalidSavedQuery(t *testing.T) {
+	runTestServer(func(s *Server) {
+		setupTestTable("foo")
+		for _, body := range []string{
+			`{"query":{}}`,
+			`{"name":"bad", "query":{"steps":[{"type":"bogus"}]}}`,
+			`{"name":"bad", "query":{"sample":2}}`,
+			`{"name":"bad"}`,
+		} {
+			resp, _ := sendTestHttpRequest("POST", "http://localhost:8586/tables/foo/queries", "application/json", body)
+			resp.Body.Close()
+			if resp.StatusCode != 500 {
+				t.Fatalf("Expected 500 for %s, got %v", body, resp.StatusCode)
+			}
+		}
+
+		resp, _ := sendTestHttpRequest("POST", "http://localhost:8586/tables/foo/queries", "application/json", `{"name":"q", "query":{}}`)
+		resp.Body.Close()
+		resp, _ = sendTestHttpRequest("POST", "http://localhost:8586/tables/foo/queries", "application/json", `{"name":"q", "query":{}}`)
+		resp.Body.Close()
+		if resp.StatusCode != 500 {
+			t.Fatalf("Expected 500 for duplicate query, got %v", resp.StatusCode)
+		}
+	})
+}
+
+// Ensure that we can update and delete saved queries through the server.
+func TestServerUpdateDeleteSavedQuery(t *testing.T) {
+	runTestServer(func(s *Server) {
+		setupTestTable("foo")
+		resp, _ := sendTestHttpRequest("POST", "http://localhost:8586/tables/foo/queries", "application/json", `{"name":"q", "query":{"filter":"true"}}`)
+		resp.Body.Close()
+		resp, _ = sendTestHttpRequest("PUT", "http://localhost:8586/tables/foo/queries/q", "application/json", `{"query":{"filter":"false"}}`)
+		assertResponse(t, resp, 200, `{"name":"q","query":{"filter":"false"}}`+"\n", "PUT /tables/:name/queries/:queryName failed.")
+		resp, _ = sendTestHttpRequest("DELETE", "http://localhost:8586/tables/foo/queries/q", "application/json", "")
+		assertResponse(t, resp, 200, "", "DELETE /tables/:name/queries/:queryName failed.")
+		resp, _ = sendTestHttpRequest("GET", "http://localhost:8586/tables/foo/queries", "application/json", "")
+		assertResponse(t, resp, 200, `[]`+"\n", "GET /tables/:name/queries after delete failed.")
+		resp, _ = sendTestHttpRequest("PUT", "http://localhost:8586/tables/foo/queries/q", "application/json", `{"query":{}}`)
+		resp.Body.Close()
+		if resp.StatusCode != 500 {
+			t.Fatalf("Expected 500 for missing query, got %v", resp.StatusCode)
+		}
+	})
+}
+
+// Ensure that we can run a saved query by name.
+func TestServerRunSavedQuery(t *testing.T) {
+	runTestServer(func(s *Server) {
+		setupTestTable("foo")
+		setupTestProperty("foo", "fruit", true, "string")
+		setupTestData(t, "foo", [][]string{
+			[]string{"a0", "2012-01-01T00:00:00Z", `{"data":{"fruit":"apple"}}`},
+			[]string{"a1", "2012-01-01T00:00:00Z", `{"data":{"fruit":"grape"}}`},
+			[]string{"a2", "2012-01-01T00:00:00Z", `{"data":{"fruit":"apple"}}`},
+		})
+		resp, _ := sendTestHttpRequest("POST", "http://localhost:8586/tables/foo/queries", "application/json", `{"name":"fruits", "query":{"steps":[{"type":"selection","dimensions":["fruit"],"fields":[{"name":"count","expression":"count()"}]}]}}`)
+		resp.Body.Close()
+		resp, _ = sendTestHttpRequest("POST", "http://localhost:8586/tables/foo/queries/fruits/run", "application/json", "")
+		assertResponse(t, resp, 200, `{"fruit":{"apple":{"count":2},"grape":{"count":1}}}`+"\n", "POST /tables/:name/queries/:queryName/run failed.")
+	})
+}
+
+// Ensure that parameters are bound when running a saved query.
+func TestServerRunSavedQueryParams(t *testing.T) {
+	runTestServer(func(s *Server) {
+		setupTestTable("foo")
+		setupTestProperty("foo", "fruit", false, "factor")
+		setupTestProperty("foo", "price", false, "float")
+		setupTestData(t, "foo", [][]string{
+			[]string{"a0", "2012-01-01T00:00:00Z", `{"data":{"fruit":"apple","price":10}}`},
+			[]string{"a1", "2012-01-01T00:00:00Z", `{"data":{"fruit":"grape","price":20}}`},
+			[]string{"a1", "2012-02-01T00:00:00Z", `{"data":{"fruit":"apple","price":30}}`},
+		})
+		resp, _ := sendTestHttpRequest("POST", "http://localhost:8586/tables/foo/queries", "application/json", `{"name":"q", "query":{"startTime":"$from","params":{"from":"2011-01-01T00:00:00Z"},"steps":[{"type":"condition","expression":"fruit == $fruit","steps":[{"type":"selection","fields":[{"name":"total","expression":"sum(price)"}]}]}]}}`)
+		assertResponse(t, resp, 200, `{"name":"q","query":{"params":{"from":"2011-01-01T00:00:00Z"},"startTime":"$from","steps":[{"expression":"fruit == $fruit","steps":[{"fields":[{"expression":"sum(price)","name":"total"}],"type":"selection"}],"type":"condition"}]}}`+"\n", "POST /tables/:name/queries failed.")
+		resp, _ = sendTestHttpRequest("POST", "http://localhost:8586/tables/foo/queries/q/run", "application/json", `{"params":{"fruit":"apple"}}`)
+		assertResponse(t, resp, 200, `{"total":40}`+"\n", "POST /tables/:name/queries/:queryName/run failed.")
+		resp, _ = sendTestHttpRequest("POST", "http://localhost:8586/tables/foo/queries/q/run", "application/json", `{"params":{"fruit":"apple","from":"2012-01-15T00:00:00Z"}}`)
+		assertResponse(t, resp, 200, `{"total":30}`+"\n", "POST /tables/:name/queries/:queryName/run with time failed.")
+		resp, _ = sendTestHttpRequest("POST", "http://localhost:8586/tables/foo/queries/q/run", "application/json", "")
+		resp.Body.Close()
+		if resp.StatusCode != 500 {
+			t.Fatalf("Expected 500 for unbound parameter, got %v", resp.StatusCode)
+		}
+	})
+}
@@ -19,6 +19,9 @@ func (s *Server) addTableHandlers() {
 	s.ApiHandleFunc("/tables/{name}", func(w http.ResponseWriter, req *http.Request, params map[string]interface{}) (interface{}, error) {
 		return s.deleteTableHandler(w, req, params)
 	}).Methods("DELETE")
+	s.ApiHandleFunc("/tables/{name}/deletion", func(w http.ResponseWriter, req *http.Request, params map[string]interface{}) (interface{}, error) {
+		return s.getTableDeletionHandler(w, req, params)
+	}).Methods("GET")
 }
 
 // GET /tables
@@ -52,6 +55,7 @@ func (s *Server) createTableHandler(w http.ResponseWriter, req *http.Request, pa
 	if err != nil {
 		return nil, err
 	}
+	s.clearTableDeletion(tableName)
 
 	return table, nil
 }
@@ -61,5 +65,19 @@ func (s *Server) deleteTableHandler(w http.ResponseWriter, req *http.Request, pa
 	vars := mux.Vars(req)
 	tableName := vars["name"]
 
+	// Large tables can be deleted in the background.
+	if async, _ := params["async"].(bool); async {
+		return s.DeleteTableAsync(tableName)
+	}
 	return nil, s.DeleteTable(tableName)
 }
+
+// GET /tables/:name/deletion
+func (s *Server) getTableDeletionHandler(w http.ResponseWriter, req *http.Request, params map[string]interface{}) (interface{}, error) {
+	vars := mux.Vars(req)
+	deletion := s.GetTableDeletion(vars["name"])
+	if deletion == nil {
+		return nil, errors.New("Table deletion not found.")
+	}
+	return deletion, nil
+}
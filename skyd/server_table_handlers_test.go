@@ -1,9 +1,12 @@
 package skyd
 
 import (
+	"errors"
 	"fmt"
+	"io/ioutil"
 	"os"
 	"testing"
+	"time"
 )
 
 // Ensure that we can retrieve a list of all available tables on the server.
@@ -72,3 +75,85 @@ func TestServerDeleteTable(t *testing.T) {
 		}
 	})
 }
+
+// Ensure that deleting a table removes its factors.
+func TestServerDeleteTableFactors(t *testing.T) {
+	runTestServer(func(s *Server) {
+		setupTestTable("foo")
+		setupTestProperty("foo", "action", false, "factor")
+		setupTestData(t, "foo", [][]string{
+			[]string{"a0", "2012-01-01T00:00:00Z", `{"data":{"action":"signup"}}`},
+		})
+		resp, _ := sendTestHttpRequest("DELETE", "http://localhost:8586/tables/foo", "application/json", ``)
+		assertResponse(t, resp, 200, "", "DELETE /tables/:name failed.")
+
+		// Recreate the table and make sure the sequence starts over.
+		setupTestTable("foo")
+		setupTestProperty("foo", "action", false, "factor")
+		setupTestData(t, "foo", [][]string{
+			[]string{"a0", "2012-01-01T00:00:00Z", `{"data":{"action":"checkout"}}`},
+		})
+		resp, _ = sendTestHttpRequest("GET", "http://localhost:8586/tables/foo/properties/action/factors", "application/json", "")
+		assertResponse(t, resp, 200, `{"count":1,"factors":[{"id":1,"value":"checkout"}]}`+"\n", "GET /tables/:name/properties/:propertyName/factors failed.")
+	})
+}
+
+// Ensure that a table can't be deleted while it's already being deleted.
+func TestServerDeleteTableConflict(t *testing.T) {
+	runTestServer(func(s *Server) {
+		setupTestTable("foo")
+		deletion, err := s.startTableDeletion("foo")
+		if err != nil {
+			t.Fatalf("Unable to start deletion: %v", err)
+		}
+		for _, body := range []string{``, `{"async":true}`} {
+			resp, _ := sendTestHttpRequest("DELETE", "http://localhost:8586/tables/foo", "application/json", body)
+			b, _ := ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+			if resp.StatusCode != 409 || string(b) != `{"message":"Table is already being deleted: foo"}`+"\n" {
+				t.Fatalf("Expected conflict: [%v] %s", resp.StatusCode, b)
+			}
+		}
+		if _, err := os.Stat(fmt.Sprintf("%v/tables/foo", s.Path())); os.IsNotExist(err) {
+			t.Fatalf("DELETE /tables/:name deleted table during deletion.")
+		}
+
+		// The table can be deleted once the running deletion finishes.
+		s.finishTableDeletion(deletion, errors.New("interrupted"))
+		resp, _ := sendTestHttpRequest("DELETE", "http://localhost:8586/tables/foo", "application/json", ``)
+		assertResponse(t, resp, 200, "", "DELETE /tables/:name failed.")
+		if d := s.GetTableDeletion("foo"); d == nil || d.Status != TableDeletionStatusComplete {
+			t.Fatalf("Unexpected deletion status: %v", d)
+		}
+	})
+}
+
+// Ensure that we can delete a table in the background and check on its status.
+func TestServerDeleteTableAsync(t *testing.T) {
+	runTestServer(func(s *Server) {
+		setupTestTable("foo")
+		resp, _ := sendTestHttpRequest("DELETE", "http://localhost:8586/tables/foo", "application/json", `{"async":true}`)
+		resp.Body.Close()
+		if resp.StatusCode != 200 {
+			t.Fatalf("DELETE /tables/:name async failed: %v", resp.StatusCode)
+		}
+
+		// Wait for the deletion to complete.
+		var body string
+		for i := 0; i < 100; i++ {
+			resp, _ = sendTestHttpRequest("GET", "http://localhost:8586/tables/foo/deletion", "application/json", ``)
+			b, _ := ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+			if body = string(b); body != `{"name":"foo","status":"running"}`+"\n" {
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		if body != `{"name":"foo","status":"complete"}`+"\n" {
+			t.Fatalf("GET /tables/:name/deletion failed: %s", body)
+		}
+		if _, err := os.Stat(fmt.Sprintf("%v/tables/foo", s.Path())); !os.IsNotExist(err) {
+			t.Fatalf("DELETE /tables/:name did not delete table.")
+		}
+	})
+}
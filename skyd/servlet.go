@@ -2,6 +2,7 @@ package skyd
 
 import (
 	"bytes"
+	"encoding/binary"
 	"errors"
 	"fmt"
 	"github.com/jmhodges/levigo"
@@ -14,6 +15,15 @@ import (
 	"time"
 )
 
+//------------------------------------------------------------------------------
+//
+// Constants
+//
+//------------------------------------------------------------------------------
+
+// The maximum number of keys read when splitting a table into key ranges.
+const servletKeySampleSize = 1024
+
 //------------------------------------------------------------------------------
 //
 // Typedefs
@@ -22,10 +32,11 @@ import (
 
 // A Servlet is a small wrapper around a single shard of a LevelDB data file.
 type Servlet struct {
-	path    string
-	db      *levigo.DB
-	factors *Factors
-	mutex   sync.Mutex
+	path       string
+	db         *levigo.DB
+	factors    *Factors
+	enginePool *ExecutionEnginePool
+	mutex      sync.Mutex
 }
 
 //------------------------------------------------------------------------------
@@ -37,8 +48,9 @@ type Servlet struct {
 // NewServlet returns a new Servlet with a data shard stored at a given path.
 func NewServlet(path string, factors *Factors) *Servlet {
 	return &Servlet{
-		path:    path,
-		factors: factors,
+		path:       path,
+		factors:    factors,
+		enginePool: NewExecutionEnginePool(DefaultExecutionEnginePoolSize),
 	}
 }
 
@@ -70,8 +82,9 @@ func (s *Servlet) Open() error {
 	return nil
 }
 
-// Closes the underlying LevelDB database.
+// Destroys any pooled engines and closes the underlying LevelDB database.
 func (s *Servlet) Close() {
+	s.enginePool.Close()
 	if s.db != nil {
 		s.db.Close()
 	}
@@ -372,7 +385,12 @@ func (s *Servlet) SetRawEvents(table *Table, objectId string, data []byte, state
 	// Write bytes to the database.
 	wo := levigo.NewWriteOptions()
 	defer wo.Close()
-	return s.db.Put(wo, encodedObjectId, buffer.Bytes())
+	if err = s.db.Put(wo, encodedObjectId, buffer.Bytes()); err != nil {
+		return err
+	}
+	table.touch()
+
+	return nil
 }
 
 // Deletes all events for a given object in a table.
@@ -392,6 +410,227 @@ func (s *Servlet) DeleteEvents(table *Table, objectId string) error {
 	wo := levigo.NewWriteOptions()
 	err = s.db.Delete(wo, encodedObjectId)
 	wo.Close()
+	if err != nil {
+		return err
+	}
+	table.touch()
 
 	return nil
 }
+
+//--------------------------------------
+// Key Ranges
+//--------------------------------------
+
+// Splits the objects of a table in the servlet into at most n key ranges of
+// about the same number of objects so that the ranges can be scanned
+// concurrently. Ranges are never smaller than minSize objects. The first range
+// has no start key and the last range has no limit key.
+//
+// Only a bounded number of keys are read. Small tables are split exactly at
+// their keys while larger tables are split at the keys found by seeking to
+// points spaced evenly between the first and last keys of the table.
+func (s *Servlet) KeyRanges(table *Table, n int, minSize int) ([]levigo.Range, error) {
+	if n <= 1 {
+		return []levigo.Range{{}}, nil
+	}
+
+	// Make sure the servlet is open.
+	if s.db == nil {
+		return nil, fmt.Errorf("Servlet is not open: %v", s.path)
+	}
+
+	prefix, err := TablePrefix(table.Name)
+	if err != nil {
+		return nil, err
+	}
+
+	ro := levigo.NewReadOptions()
+	defer ro.Close()
+	ro.SetFillCache(false)
+	iterator := s.db.NewIterator(ro)
+	defer iterator.Close()
+
+	// Read keys from the start of the table until the sample is full.
+	keys := make([][]byte, 0)
+	for iterator.Seek(prefix); iterator.Valid() && len(keys) <= servletKeySampleSize; iterator.Next() {
+		key := iterator.Key()
+		if !bytes.HasPrefix(key, prefix) {
+			break
+		}
+		keys = append(keys, key)
+	}
+
+	// Limit the number of ranges by the minimum range size. The number of
+	// keys read is a lower bound on the size of larger tables.
+	if minSize < 1 {
+		minSize = 1
+	}
+	if max := len(keys) / minSize; n > max {
+		n = max
+	}
+	if n <= 1 {
+		return []levigo.Range{{}}, nil
+	}
+
+	// Find the range boundaries.
+	boundaries := make([][]byte, 0, n-1)
+	if len(keys) <= servletKeySampleSize {
+		for i := 1; i < n; i++ {
+			boundaries = append(boundaries, keys[i*len(keys)/n])
+		}
+	} else {
+		first, last := keys[0], lastKeyWithPrefix(iterator, prefix)
+		for i := 1; i < n && last != nil; i++ {
+			iterator.Seek(interpolateKey(first, last, float64(i)/float64(n)))
+			if !iterator.Valid() {
+				break
+			}
+			key := iterator.Key()
+			if !bytes.HasPrefix(key, prefix) {
+				break
+			}
+			if bytes.Compare(key, first) <= 0 || (len(boundaries) > 0 && bytes.Compare(key, boundaries[len(boundaries)-1]) <= 0) {
+				continue
+			}
+			boundaries = append(boundaries, key)
+		}
+	}
+
+	ranges := make([]levigo.Range, 0, len(boundaries)+1)
+	var start []byte
+	for _, key := range boundaries {
+		ranges = append(ranges, levigo.Range{Start: start, Limit: key})
+		start = key
+	}
+	ranges = append(ranges, levigo.Range{Start: start})
+
+	return ranges, nil
+}
+
+// Retrieves the last key that starts with a given prefix or nil if there are
+// no keys with the prefix.
+func lastKeyWithPrefix(iterator *levigo.Iterator, prefix []byte) []byte {
+	// Seek past the prefix and step back.
+	limit := append([]byte{}, prefix...)
+	for i := len(limit) - 1; i >= 0; i-- {
+		if limit[i]++; limit[i] != 0 {
+			break
+		}
+		limit = limit[:i]
+	}
+	if len(limit) > 0 {
+		iterator.Seek(limit)
+	}
+	if len(limit) > 0 && iterator.Valid() {
+		iterator.Prev()
+	} else {
+		iterator.SeekToLast()
+	}
+
+	if !iterator.Valid() {
+		return nil
+	}
+	if key := iterator.Key(); bytes.HasPrefix(key, prefix) {
+		return key
+	}
+	return nil
+}
+
+// Generates a key that lies a given fraction of the way between two keys.
+// The eight bytes after the keys' common prefix are treated as numbers.
+func interpolateKey(a []byte, b []byte, fraction float64) []byte {
+	i := 0
+	for i < len(a) && i < len(b) && a[i] == b[i] {
+		i++
+	}
+	x, y := keyNumber(a[i:]), keyNumber(b[i:])
+	key := make([]byte, i+8)
+	copy(key, a[:i])
+	binary.BigEndian.PutUint64(key[i:], x+uint64(float64(y-x)*fraction))
+	return key
+}
+
+// Converts the first eight bytes of a key to a number, padding with zeros.
+func keyNumber(b []byte) uint64 {
+	buf := make([]byte, 8)
+	copy(buf, b)
+	return binary.BigEndian.Uint64(buf)
+}
+
+//------------------------------------------------------------------------------
+//
+// Functions
+//
+//------------------------------------------------------------------------------
+
+// Reads the timestamp of an object's last event from the state at the
+// beginning of its serialized data. The state is an [timestamp, data] array
+// wrapped in a raw value. Returns false if the state cannot be read.
+func stateTimestamp(data []byte) (int64, bool) {
+	// Skip over the raw header.
+	if len(data) == 0 {
+		return 0, false
+	}
+	switch b := data[0]; {
+	case b >= 0xa0 && b <= 0xbf:
+		data = data[1:]
+	case b == 0xda && len(data) >= 3:
+		data = data[3:]
+	case b == 0xdb && len(data) >= 5:
+		data = data[5:]
+	default:
+		return 0, false
+	}
+
+	// Skip over the array header.
+	if len(data) == 0 {
+		return 0, false
+	}
+	switch b := data[0]; {
+	case b >= 0x90 && b <= 0x9f:
+		data = data[1:]
+	case b == 0xdc && len(data) >= 3:
+		data = data[3:]
+	default:
+		return 0, false
+	}
+
+	// Read the timestamp.
+	if len(data) == 0 {
+		return 0, false
+	}
+	b := data[0]
+	switch {
+	case b <= 0x7f:
+		return int64(b), true
+	case b >= 0xe0:
+		return int64(int8(b)), true
+	}
+	var sz int
+	switch b {
+	case 0xcc, 0xd0:
+		sz = 1
+	case 0xcd, 0xd1:
+		sz = 2
+	case 0xce, 0xd2:
+		sz = 4
+	case 0xcf, 0xd3:
+		sz = 8
+	default:
+		return 0, false
+	}
+	if len(data) < 1+sz {
+		return 0, false
+	}
+	var value uint64
+	for _, c := range data[1 : 1+sz] {
+		value = (value << 8) | uint64(c)
+	}
+	if b >= 0xd0 {
+		// Sign extend signed integers.
+		shift := uint(64 - 8*sz)
+		return int64(value<<shift) >> shift, true
+	}
+	return int64(value), true
+}
@@ -1,6 +1,9 @@
 package skyd
 
 import (
+	"bytes"
+	"fmt"
+	"github.com/jmhodges/levigo"
 	"io/ioutil"
 	"os"
 	"testing"
@@ -67,3 +70,119 @@ func TestServletPutEvent(t *testing.T) {
 		}
 	}
 }
+
+// Ensure that the last event timestamp can be read from an object's state.
+func TestServletStateTimestamp(t *testing.T) {
+	path, err := ioutil.TempDir("", "")
+	defer os.RemoveAll(path)
+	table := NewTable("test", "/tmp/test")
+	servlet := NewServlet(path, nil)
+	defer servlet.Close()
+	_ = servlet.Open()
+
+	// Insert out of order so that the state is rewritten.
+	servlet.PutEvent(table, "bob", NewEvent("2012-01-02T00:00:00Z", map[int64]interface{}{1: "foo"}), true)
+	servlet.PutEvent(table, "bob", NewEvent("2012-01-01T00:00:00Z", map[int64]interface{}{1: "bar"}), true)
+
+	key, _ := table.EncodeObjectId("bob")
+	ro := levigo.NewReadOptions()
+	defer ro.Close()
+	data, err := servlet.db.Get(ro, key)
+	if err != nil {
+		t.Fatalf("Unable to read object: %v", err)
+	}
+	timestamp, ok := stateTimestamp(data)
+	if !ok || timestamp != ShiftTime(NewEvent("2012-01-02T00:00:00Z", nil).Timestamp) {
+		t.Fatalf("Unexpected state timestamp: %v (%v)", UnshiftTime(timestamp), ok)
+	}
+
+	// Negative timestamps are sign extended.
+	if timestamp, ok := stateTimestamp([]byte{0xa3, 0x92, 0xff, 0x80}); !ok || timestamp != -1 {
+		t.Fatalf("Unexpected negative timestamp: %v (%v)", timestamp, ok)
+	}
+	if timestamp, ok := stateTimestamp([]byte{0xa4, 0x92, 0xd1, 0xff, 0xfe}); !ok || timestamp != -2 {
+		t.Fatalf("Unexpected negative timestamp: %v (%v)", timestamp, ok)
+	}
+
+	// Empty states cannot be read.
+	if _, ok := stateTimestamp([]byte{0xa0}); ok {
+		t.Fatalf("Expected empty state to be unreadable")
+	}
+}
+
+// Ensure that a table can be split into key ranges.
+func TestServletKeyRanges(t *testing.T) {
+	path, _ := ioutil.TempDir("", "")
+	defer os.RemoveAll(path)
+	table := NewTable("test", "/tmp/test")
+	other := NewTable("other", "/tmp/other")
+	servlet := NewServlet(path, nil)
+	defer servlet.Close()
+	_ = servlet.Open()
+
+	for i := 0; i < 10; i++ {
+		event := NewEvent("2012-01-01T00:00:00Z", map[int64]interface{}{1: "foo"})
+		if err := servlet.PutEvent(table, fmt.Sprintf("obj%d", i), event, true); err != nil {
+			t.Fatalf("Unable to add event: %v", err)
+		}
+	}
+	servlet.PutEvent(other, "obj0", NewEvent("2012-01-01T00:00:00Z", map[int64]interface{}{1: "foo"}), true)
+
+	// Split into three ranges.
+	ranges, err := servlet.KeyRanges(table, 3, 1)
+	if err != nil || len(ranges) != 3 {
+		t.Fatalf("Expected 3 ranges: %v (%v)", len(ranges), err)
+	}
+	if ranges[0].Start != nil || ranges[2].Limit != nil {
+		t.Fatalf("Expected open ended ranges: %v", ranges)
+	}
+	for i, objectId := range []string{"obj3", "obj6"} {
+		key, _ := table.EncodeObjectId(objectId)
+		if !bytes.Equal(ranges[i].Limit, key) || !bytes.Equal(ranges[i+1].Start, key) {
+			t.Fatalf("Unexpected boundary %d: %v", i, ranges)
+		}
+	}
+
+	// Ranges are limited by the minimum size.
+	if ranges, _ := servlet.KeyRanges(table, 3, 5); len(ranges) != 2 {
+		t.Fatalf("Expected 2 ranges: %v", len(ranges))
+	}
+	if ranges, _ := servlet.KeyRanges(other, 3, 1); len(ranges) != 1 {
+		t.Fatalf("Expected 1 range: %v", len(ranges))
+	}
+}
+
+// Ensure that large tables are split without reading every key.
+func TestServletKeyRangesLargeTable(t *testing.T) {
+	path, _ := ioutil.TempDir("", "")
+	defer os.RemoveAll(path)
+	table := NewTable("test", "/tmp/test")
+	servlet := NewServlet(path, nil)
+	defer servlet.Close()
+	_ = servlet.Open()
+
+	count := servletKeySampleSize * 4
+	for i := 0; i < count; i++ {
+		event := NewEvent("2012-01-01T00:00:00Z", map[int64]interface{}{1: "foo"})
+		if err := servlet.PutEvent(table, fmt.Sprintf("obj%05d", i), event, true); err != nil {
+			t.Fatalf("Unable to add event: %v", err)
+		}
+	}
+
+	ranges, err := servlet.KeyRanges(table, 4, 1)
+	if err != nil || len(ranges) != 4 {
+		t.Fatalf("Expected 4 ranges: %v (%v)", len(ranges), err)
+	}
+	for i, r := range ranges {
+		n := 0
+		for j := 0; j < count; j++ {
+			key, _ := table.EncodeObjectId(fmt.Sprintf("obj%05d", j))
+			if (r.Start == nil || bytes.Compare(key, r.Start) >= 0) && (r.Limit == nil || bytes.Compare(key, r.Limit) < 0) {
+				n++
+			}
+		}
+		if n < count/8 || n > count/2 {
+			t.Fatalf("Unbalanced range %d: %v objects", i, n)
+		}
+	}
+}
@@ -6,6 +6,7 @@ import (
 	"github.com/ugorji/go-msgpack"
 	"os"
 	"path/filepath"
+	"sync/atomic"
 	"time"
 )
 
@@ -17,9 +18,11 @@ import (
 
 // A Table is a collection of objects.
 type Table struct {
-	Name         string `json:"name"`
-	path         string
-	propertyFile *PropertyFile
+	Name           string `json:"name"`
+	path           string
+	propertyFile   *PropertyFile
+	savedQueryFile *SavedQueryFile
+	writeVersion   int64
 }
 
 //------------------------------------------------------------------------------
@@ -52,6 +55,16 @@ func (t *Table) Path() string {
 	return t.path
 }
 
+// Retrieves a counter that changes whenever the table's data is written.
+func (t *Table) WriteVersion() int64 {
+	return atomic.LoadInt64(&t.writeVersion)
+}
+
+// Marks the table's data as changed.
+func (t *Table) touch() {
+	atomic.AddInt64(&t.writeVersion, 1)
+}
+
 //------------------------------------------------------------------------------
 //
 // Methods
@@ -108,6 +121,14 @@ func (t *Table) Open() error {
 		return err
 	}
 
+	// Load saved query file.
+	t.savedQueryFile = NewSavedQueryFile(fmt.Sprintf("%v/%v", t.path, "queries"))
+	err = t.savedQueryFile.Open()
+	if err != nil {
+		t.Close()
+		return err
+	}
+
 	return nil
 }
 
@@ -117,6 +138,10 @@ func (t *Table) Close() {
 		t.propertyFile.Close()
 	}
 	t.propertyFile = nil
+	if t.savedQueryFile != nil {
+		t.savedQueryFile.Close()
+	}
+	t.savedQueryFile = nil
 }
 
 // Checks if the table is currently open.
@@ -218,6 +243,42 @@ func (t *Table) DenormalizeMap(m map[int64]interface{}) (map[string]interface{},
 	return t.propertyFile.DenormalizeMap(m)
 }
 
+//--------------------------------------
+// Saved Query Management
+//--------------------------------------
+
+// Retrieves a list of the saved queries on the table.
+func (t *Table) GetSavedQueries() ([]*SavedQuery, error) {
+	if !t.IsOpen() {
+		return nil, errors.New("Table is not open")
+	}
+	return t.savedQueryFile.GetQueries(), nil
+}
+
+// Retrieves a single saved query from the table by name.
+func (t *Table) GetSavedQuery(name string) (*SavedQuery, error) {
+	if !t.IsOpen() {
+		return nil, errors.New("Table is not open")
+	}
+	return t.savedQueryFile.GetQuery(name), nil
+}
+
+// Adds or replaces a saved query on the table.
+func (t *Table) PutSavedQuery(query *SavedQuery) error {
+	if !t.IsOpen() {
+		return errors.New("Table is not open")
+	}
+	return t.savedQueryFile.PutQuery(query)
+}
+
+// Deletes a saved query from the table.
+func (t *Table) DeleteSavedQuery(name string) error {
+	if !t.IsOpen() {
+		return errors.New("Table is not open")
+	}
+	return t.savedQueryFile.DeleteQuery(name)
+}
+
 //--------------------------------------
 // Event Encoding
 //--------------------------------------
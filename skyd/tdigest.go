@@ -0,0 +1,251 @@
+package skyd
+
+import (
+	"sort"
+)
+
+//------------------------------------------------------------------------------
+//
+// Constants
+//
+//------------------------------------------------------------------------------
+
+// The compression used when combining centroids. This must match
+// SKY_TDIGEST_COMPRESSION in the Lua header.
+const tdigestCompression = 100
+
+//------------------------------------------------------------------------------
+//
+// Typedefs
+//
+//------------------------------------------------------------------------------
+
+// A tdigest is the Go representation of the t-digest sketch built by the Lua
+// header. It is only used to compute final values from merged results.
+type tdigest struct {
+	min       float64
+	max       float64
+	centroids tdigestCentroids
+}
+
+type tdigestCentroid struct {
+	mean  float64
+	count float64
+}
+
+type tdigestCentroids []tdigestCentroid
+
+// A HistogramBucket is a single range of a histogram() field.
+type HistogramBucket struct {
+	Min   float64 `json:"min"`
+	Max   float64 `json:"max"`
+	Count int     `json:"count"`
+}
+
+//------------------------------------------------------------------------------
+//
+// Constructors
+//
+//------------------------------------------------------------------------------
+
+// Creates a digest from the untyped state returned by the merge function.
+// Buffered values that were not compressed are treated as single centroids.
+func newTDigestFromState(state interface{}) *tdigest {
+	d := &tdigest{}
+	m, ok := state.(map[interface{}]interface{})
+	if !ok {
+		return d
+	}
+
+	d.min, _ = castFloat64(m["min"])
+	d.max, _ = castFloat64(m["max"])
+
+	// Lua arrays are encoded as maps keyed by index.
+	if centroids, ok := m["centroids"].(map[interface{}]interface{}); ok {
+		for _, c := range centroids {
+			var centroid tdigestCentroid
+			if c, ok := c.(map[interface{}]interface{}); ok {
+				for k, v := range c {
+					switch normalize(k) {
+					case int64(1):
+						centroid.mean, _ = castFloat64(v)
+					case int64(2):
+						centroid.count, _ = castFloat64(v)
+					}
+				}
+			}
+			if centroid.count > 0 {
+				d.centroids = append(d.centroids, centroid)
+			}
+		}
+	}
+	if buffer, ok := m["buffer"].(map[interface{}]interface{}); ok {
+		for _, v := range buffer {
+			if value, ok := castFloat64(v); ok {
+				d.centroids = append(d.centroids, tdigestCentroid{mean: value, count: 1})
+			}
+		}
+	}
+	sort.Sort(d.centroids)
+
+	return d
+}
+
+//------------------------------------------------------------------------------
+//
+// Methods
+//
+//------------------------------------------------------------------------------
+
+// Estimates the value at a given quantile between 0 and 1. Values are
+// interpolated between the centers of neighboring centroids.
+func (d *tdigest) quantile(q float64) interface{} {
+	if len(d.centroids) == 0 {
+		return nil
+	}
+	if q <= 0 {
+		return d.min
+	} else if q >= 1 {
+		return d.max
+	}
+
+	var total float64
+	for _, c := range d.centroids {
+		total += c.count
+	}
+	target := q * total
+
+	// Interpolate from the minimum to the first centroid.
+	first := d.centroids[0]
+	if target < first.count/2 {
+		return d.min + (first.mean-d.min)*target/(first.count/2)
+	}
+
+	// Interpolate between the centers of neighboring centroids.
+	sofar := first.count / 2
+	for i := 1; i < len(d.centroids); i++ {
+		prev, c := d.centroids[i-1], d.centroids[i]
+		step := (prev.count + c.count) / 2
+		if target < sofar+step {
+			return prev.mean + (c.mean-prev.mean)*(target-sofar)/step
+		}
+		sofar += step
+	}
+
+	// Interpolate from the last centroid to the maximum.
+	last := d.centroids[len(d.centroids)-1]
+	return last.mean + (d.max-last.mean)*(target-sofar)/(last.count/2)
+}
+
+// Splits the range of values into equal width buckets and counts the values
+// in each. Each centroid is counted in the bucket that contains its mean.
+func (d *tdigest) histogram(n int) []*HistogramBucket {
+	buckets := []*HistogramBucket{}
+	if len(d.centroids) == 0 || n <= 0 {
+		return buckets
+	}
+
+	// Use a single bucket if every value is the same.
+	if d.min == d.max {
+		n = 1
+	}
+	width := (d.max - d.min) / float64(n)
+	for i := 0; i < n; i++ {
+		buckets = append(buckets, &HistogramBucket{Min: d.min + width*float64(i), Max: d.min + width*float64(i+1)})
+	}
+	buckets[n-1].Max = d.max
+
+	for _, c := range d.centroids {
+		index := n - 1
+		if width > 0 {
+			index = int((c.mean - d.min) / width)
+		}
+		if index >= n {
+			index = n - 1
+		} else if index < 0 {
+			index = 0
+		}
+		buckets[index].Count += int(c.count + 0.5)
+	}
+
+	return buckets
+}
+
+// Adds the centroids of another digest and compresses the result.
+func (d *tdigest) merge(other *tdigest) {
+	if len(other.centroids) == 0 {
+		return
+	}
+	if len(d.centroids) == 0 || other.min < d.min {
+		d.min = other.min
+	}
+	if len(d.centroids) == 0 || other.max > d.max {
+		d.max = other.max
+	}
+	d.centroids = append(d.centroids, other.centroids...)
+	d.compress()
+}
+
+// Combines neighboring centroids using the same size limit as the Lua header.
+func (d *tdigest) compress() {
+	if len(d.centroids) == 0 {
+		return
+	}
+	sort.Sort(d.centroids)
+
+	var total float64
+	for _, c := range d.centroids {
+		total += c.count
+	}
+
+	centroids := tdigestCentroids{}
+	current := d.centroids[0]
+	var sofar float64
+	for _, c := range d.centroids[1:] {
+		q := (sofar + (current.count+c.count)/2) / total
+		if current.count+c.count <= 4*total*q*(1-q)/tdigestCompression {
+			current.mean += (c.mean - current.mean) * c.count / (current.count + c.count)
+			current.count += c.count
+		} else {
+			sofar += current.count
+			centroids = append(centroids, current)
+			current = c
+		}
+	}
+	d.centroids = append(centroids, current)
+}
+
+// Converts the digest back into the untyped state used by the Lua header.
+func (d *tdigest) state() map[interface{}]interface{} {
+	var n float64
+	centroids := map[interface{}]interface{}{}
+	for i, c := range d.centroids {
+		centroids[int64(i+1)] = map[interface{}]interface{}{int64(1): c.mean, int64(2): c.count}
+		n += c.count
+	}
+	state := map[interface{}]interface{}{
+		"n":         n,
+		"centroids": centroids,
+		"buffer":    map[interface{}]interface{}{},
+	}
+	if n > 0 {
+		state["min"], state["max"] = d.min, d.max
+	}
+	return state
+}
+
+//--------------------------------------
+// Sorting
+//--------------------------------------
+
+func (s tdigestCentroids) Len() int {
+	return len(s)
+}
+
+func (s tdigestCentroids) Less(i, j int) bool {
+	return s[i].mean < s[j].mean
+}
+
+func (s tdigestCentroids) Swap(i, j int) {
+	s[i], s[j] = s[j], s[i]
+}
@@ -0,0 +1,57 @@
+package skyd
+
+import (
+	"math"
+	"testing"
+)
+
+// Ensure that quantiles are interpolated between centroids.
+func TestTDigestQuantile(t *testing.T) {
+	d := newTDigestFromState(map[interface{}]interface{}{
+		"min":       int64(0),
+		"max":       int64(100),
+		"centroids": map[interface{}]interface{}{},
+		"buffer":    map[interface{}]interface{}{},
+	})
+	for i := 0; i <= 100; i++ {
+		d.centroids = append(d.centroids, tdigestCentroid{mean: float64(i), count: 1})
+	}
+
+	tests := []struct {
+		q   float64
+		exp float64
+	}{
+		{0, 0},
+		{0.5, 50},
+		{0.95, 95.45},
+		{1, 100},
+	}
+	for i, test := range tests {
+		if v := d.quantile(test.q).(float64); math.Abs(v-test.exp) > 0.01 {
+			t.Fatalf("[%d] Wrong quantile for %v: exp %v, got %v", i, test.q, test.exp, v)
+		}
+	}
+}
+
+// Ensure that digests can be read from merged Lua results.
+func TestTDigestFromState(t *testing.T) {
+	d := newTDigestFromState(map[interface{}]interface{}{
+		"min": int64(1),
+		"max": float64(9),
+		"centroids": map[interface{}]interface{}{
+			int64(1): map[interface{}]interface{}{int64(1): float64(5), int64(2): int64(3)},
+		},
+		"buffer": map[interface{}]interface{}{int64(1): int64(9), int64(2): int64(1)},
+	})
+	if len(d.centroids) != 3 || d.centroids[0].mean != 1 || d.centroids[1].count != 3 || d.centroids[2].mean != 9 {
+		t.Fatalf("Invalid centroids: %v", d.centroids)
+	}
+
+	buckets := d.histogram(2)
+	if len(buckets) != 2 || buckets[0].Count != 1 || buckets[1].Count != 4 || buckets[1].Min != 5 {
+		t.Fatalf("Invalid histogram: %v, %v", buckets[0], buckets[1])
+	}
+	if d := newTDigestFromState(nil); d.quantile(0.5) != nil || len(d.histogram(2)) != 0 {
+		t.Fatalf("Expected empty digest")
+	}
+}